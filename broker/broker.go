@@ -0,0 +1,55 @@
+// Package broker provides the messaging backbone shared by the replicas of a
+// goretro cluster.
+//
+// Replicas use it to agree on which of them owns a room (using Claim, Refresh,
+// Owner and Release) and to forward commands and events between each other (using
+// Publish and Subscribe).
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrClosed = errors.New("broker closed")
+
+type Broker interface {
+	// Publish sends data to all the current subscribers of subject. Messages
+	// published while nobody is subscribed are lost, but subscribers lagging
+	// behind slow down delivery rather than losing messages.
+	Publish(subject string, data []byte) error
+
+	// Subscribe starts receiving the messages published on subject. The
+	// subscription is active when Subscribe returns.
+	Subscribe(subject string) (Subscription, error)
+
+	// Claim atomically makes owner the owner of key for ttl if key has no
+	// owner yet. It returns the owner of key after the operation. Owners keep
+	// their keys by calling Refresh before ttl elapses, so that the keys of a
+	// replica that stopped are eventually freed.
+	Claim(key, owner string, ttl time.Duration) (string, error)
+
+	// Refresh extends the ownership of key by owner to ttl from now. It
+	// returns false if owner does not own key anymore.
+	Refresh(key, owner string, ttl time.Duration) (bool, error)
+
+	// Owner returns the owner of key, or an empty string if key has no owner.
+	Owner(key string) (string, error)
+
+	// Release removes the ownership of key, if it is owned by owner.
+	Release(key, owner string) error
+
+	Close() error
+}
+
+type Subscription interface {
+	// Messages returns the channel on which the messages are received. The
+	// channel is closed when the subscription ends.
+	Messages() <-chan []byte
+
+	Unsubscribe() error
+}
+
+// subscriptionBufferSize is the number of messages that can be queued for a
+// subscriber before delivery waits for it.
+const subscriptionBufferSize = 256
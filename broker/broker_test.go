@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Now()
+
+	testBroker(t, func(t *testing.T) Broker {
+		b := NewMemory()
+		b.now = func() time.Time { return now }
+		return b
+	}, func(d time.Duration) {
+		now = now.Add(d)
+	})
+}
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	testBroker(t, func(t *testing.T) Broker {
+		server.FlushAll()
+
+		b, err := NewRedis(server.Addr())
+		if err != nil {
+			t.Fatalf("error creating Redis broker: %s", err)
+		}
+
+		return b
+	}, server.FastForward)
+}
+
+// testBroker runs the tests shared by all brokers. elapse makes time pass for
+// the ownerships of the brokers created by newBroker.
+func testBroker(t *testing.T, newBroker func(t *testing.T) Broker, elapse func(time.Duration)) {
+	t.Run("ownership", func(t *testing.T) {
+		b := newBroker(t)
+		defer b.Close()
+
+		owner, err := b.Owner("room")
+		checkOwner(t, "", owner, err)
+
+		owner, err = b.Claim("room", "a", time.Minute)
+		checkOwner(t, "a", owner, err)
+
+		owner, err = b.Claim("room", "b", time.Minute)
+		checkOwner(t, "a", owner, err)
+
+		if err := b.Release("room", "b"); err != nil {
+			t.Fatalf("error releasing: %s", err)
+		}
+
+		owner, err = b.Owner("room")
+		checkOwner(t, "a", owner, err)
+
+		if err := b.Release("room", "a"); err != nil {
+			t.Fatalf("error releasing: %s", err)
+		}
+
+		owner, err = b.Owner("room")
+		checkOwner(t, "", owner, err)
+	})
+
+	t.Run("ownership expiry", func(t *testing.T) {
+		b := newBroker(t)
+		defer b.Close()
+
+		owner, err := b.Claim("room", "a", time.Minute)
+		checkOwner(t, "a", owner, err)
+
+		// refreshing keeps the ownership past the initial TTL
+		elapse(40 * time.Second)
+		checkRefresh(t, b, "room", "a", true)
+		elapse(40 * time.Second)
+
+		owner, err = b.Owner("room")
+		checkOwner(t, "a", owner, err)
+
+		// other replicas cannot refresh it
+		checkRefresh(t, b, "room", "b", false)
+
+		// the ownership of an owner that stopped refreshing expires
+		elapse(time.Minute)
+
+		owner, err = b.Owner("room")
+		checkOwner(t, "", owner, err)
+
+		checkRefresh(t, b, "room", "a", false)
+
+		owner, err = b.Claim("room", "b", time.Minute)
+		checkOwner(t, "b", owner, err)
+	})
+
+	t.Run("publish and subscribe", func(t *testing.T) {
+		b := newBroker(t)
+		defer b.Close()
+
+		sub1, err := b.Subscribe("subject")
+		if err != nil {
+			t.Fatalf("error subscribing: %s", err)
+		}
+
+		sub2, err := b.Subscribe("subject")
+		if err != nil {
+			t.Fatalf("error subscribing: %s", err)
+		}
+
+		other, err := b.Subscribe("other")
+		if err != nil {
+			t.Fatalf("error subscribing: %s", err)
+		}
+
+		defer other.Unsubscribe()
+
+		for _, msg := range []string{"hello", "world"} {
+			if err := b.Publish("subject", []byte(msg)); err != nil {
+				t.Fatalf("error publishing: %s", err)
+			}
+		}
+
+		for _, sub := range []Subscription{sub1, sub2} {
+			expectMessage(t, sub, "hello")
+			expectMessage(t, sub, "world")
+		}
+
+		select {
+		case msg := <-other.Messages():
+			t.Errorf("unexpected message on other subject: %q", msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if err := sub1.Unsubscribe(); err != nil {
+			t.Fatalf("error unsubscribing: %s", err)
+		}
+
+		// the channel must get closed
+		for range sub1.Messages() {
+		}
+
+		if err := b.Publish("subject", []byte("again")); err != nil {
+			t.Fatalf("error publishing: %s", err)
+		}
+
+		expectMessage(t, sub2, "again")
+		sub2.Unsubscribe()
+	})
+
+	t.Run("lagging subscribers", func(t *testing.T) {
+		b := newBroker(t)
+		defer b.Close()
+
+		sub, err := b.Subscribe("subject")
+		if err != nil {
+			t.Fatalf("error subscribing: %s", err)
+		}
+
+		defer sub.Unsubscribe()
+
+		// more messages than the subscription can buffer
+		const count = 3 * subscriptionBufferSize
+
+		go func() {
+			for i := 0; i < count; i++ {
+				if err := b.Publish("subject", []byte(fmt.Sprint(i))); err != nil {
+					t.Errorf("error publishing: %s", err)
+					return
+				}
+			}
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		for i := 0; i < count; i++ {
+			expectMessage(t, sub, fmt.Sprint(i))
+		}
+	})
+
+	t.Run("lagging subscribers can unsubscribe", func(t *testing.T) {
+		b := newBroker(t)
+		defer b.Close()
+
+		sub, err := b.Subscribe("subject")
+		if err != nil {
+			t.Fatalf("error subscribing: %s", err)
+		}
+
+		published := make(chan struct{})
+
+		go func() {
+			defer close(published)
+
+			for i := 0; i < 3*subscriptionBufferSize; i++ {
+				b.Publish("subject", []byte(fmt.Sprint(i)))
+			}
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		if err := sub.Unsubscribe(); err != nil {
+			t.Fatalf("error unsubscribing: %s", err)
+		}
+
+		for range sub.Messages() {
+		}
+
+		select {
+		case <-published:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("publishing blocked by an ended subscription")
+		}
+	})
+}
+
+func checkOwner(t *testing.T, expected string, actual string, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected != actual {
+		t.Errorf("expected owner %q, got %q", expected, actual)
+	}
+}
+
+func checkRefresh(t *testing.T, b Broker, key, owner string, expected bool) {
+	t.Helper()
+
+	refreshed, err := b.Refresh(key, owner, time.Minute)
+	if err != nil {
+		t.Fatalf("error refreshing: %s", err)
+	}
+
+	if refreshed != expected {
+		t.Errorf("expected refresh by %q to return %t, got %t", owner, expected, refreshed)
+	}
+}
+
+func expectMessage(t *testing.T, sub Subscription, expected string) {
+	t.Helper()
+
+	select {
+	case msg := <-sub.Messages():
+		if string(msg) != expected {
+			t.Errorf("expected message %q, got %q", expected, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for message %q", expected)
+	}
+}
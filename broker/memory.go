@@ -0,0 +1,230 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Broker. It is enough for a single replica, or for
+// several replicas living in the same process.
+type Memory struct {
+	lock          sync.Mutex
+	closed        bool
+	owners        map[string]ownership
+	subscriptions map[string]map[*memorySubscription]struct{}
+	now           func() time.Time
+}
+
+type ownership struct {
+	owner     string
+	expiresAt time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		owners:        map[string]ownership{},
+		subscriptions: map[string]map[*memorySubscription]struct{}{},
+		now:           time.Now,
+	}
+}
+
+func (m *Memory) Publish(subject string, data []byte) error {
+	m.lock.Lock()
+
+	if m.closed {
+		m.lock.Unlock()
+		return ErrClosed
+	}
+
+	subscriptions := make([]*memorySubscription, 0, len(m.subscriptions[subject]))
+	for s := range m.subscriptions[subject] {
+		subscriptions = append(subscriptions, s)
+	}
+
+	m.lock.Unlock()
+
+	// delivering without holding the lock, so that a lagging subscriber can
+	// still unsubscribe
+	for _, s := range subscriptions {
+		s.deliver(append([]byte{}, data...))
+	}
+
+	return nil
+}
+
+func (m *Memory) Subscribe(subject string) (Subscription, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	s := &memorySubscription{
+		broker:   m,
+		subject:  subject,
+		messages: make(chan []byte, subscriptionBufferSize),
+		done:     make(chan struct{}),
+	}
+
+	if m.subscriptions[subject] == nil {
+		m.subscriptions[subject] = map[*memorySubscription]struct{}{}
+	}
+
+	m.subscriptions[subject][s] = struct{}{}
+
+	return s, nil
+}
+
+func (m *Memory) Claim(key, owner string, ttl time.Duration) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return "", ErrClosed
+	}
+
+	if current := m.ownerLocked(key); current != "" {
+		return current, nil
+	}
+
+	m.owners[key] = ownership{owner: owner, expiresAt: m.now().Add(ttl)}
+
+	return owner, nil
+}
+
+func (m *Memory) Refresh(key, owner string, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return false, ErrClosed
+	}
+
+	if m.ownerLocked(key) != owner {
+		return false, nil
+	}
+
+	m.owners[key] = ownership{owner: owner, expiresAt: m.now().Add(ttl)}
+
+	return true, nil
+}
+
+func (m *Memory) Owner(key string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return "", ErrClosed
+	}
+
+	return m.ownerLocked(key), nil
+}
+
+// ownerLocked returns the owner of key, forgetting it if its ownership
+// expired.
+func (m *Memory) ownerLocked(key string) string {
+	current, ok := m.owners[key]
+	if ok && !m.now().Before(current.expiresAt) {
+		delete(m.owners, key)
+		return ""
+	}
+
+	return current.owner
+}
+
+func (m *Memory) Release(key, owner string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	if m.ownerLocked(key) == owner {
+		delete(m.owners, key)
+	}
+
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+
+	for _, subscriptions := range m.subscriptions {
+		for s := range subscriptions {
+			s.close()
+		}
+	}
+
+	m.subscriptions = nil
+
+	return nil
+}
+
+type memorySubscription struct {
+	broker    *Memory
+	subject   string
+	messages  chan []byte
+	done      chan struct{} // closed when the subscription ends
+	lock      sync.RWMutex  // held for reading while delivering
+	closeOnce sync.Once
+}
+
+// deliver waits for the subscriber to have room for data, unless the
+// subscription ends in the meantime.
+func (s *memorySubscription) deliver(data []byte) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	select {
+	case s.messages <- data:
+	case <-s.done:
+	}
+}
+
+// close ends the subscription, once the messages being delivered gave up.
+func (s *memorySubscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.lock.Lock()
+		close(s.messages)
+		s.lock.Unlock()
+	})
+}
+
+func (s *memorySubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	s.broker.lock.Lock()
+	defer s.broker.lock.Unlock()
+
+	if _, ok := s.broker.subscriptions[s.subject][s]; !ok {
+		return nil
+	}
+
+	delete(s.broker.subscriptions[s.subject], s)
+	if len(s.broker.subscriptions[s.subject]) == 0 {
+		delete(s.broker.subscriptions, s.subject)
+	}
+
+	s.close()
+
+	return nil
+}
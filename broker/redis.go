@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// keyPrefix namespaces the keys and channels used by goretro in Redis.
+	keyPrefix = "goretro:"
+
+	// redisRetryDelay is how long subscriptions wait before receiving again
+	// after a connection error.
+	redisRetryDelay = 100 * time.Millisecond
+)
+
+// releaseScript deletes a key only if it still has the expected value.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// refreshScript extends the expiry of a key only if it still has the expected
+// value.
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// Redis is a Broker backed by a Redis (or Redis compatible) server, allowing
+// replicas running on different hosts to cooperate.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis connects to the Redis server at addr (host:port).
+func NewRedis(addr string) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to Redis at %s: %w", addr, err)
+	}
+
+	return &Redis{client: client}, nil
+}
+
+func (r *Redis) Publish(subject string, data []byte) error {
+	return r.client.Publish(context.Background(), keyPrefix+subject, data).Err()
+}
+
+func (r *Redis) Subscribe(subject string) (Subscription, error) {
+	ctx := context.Background()
+	pubsub := r.client.Subscribe(ctx, keyPrefix+subject)
+
+	// wait for the subscription to be confirmed, so that no message published
+	// after Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("error subscribing to %s: %w", subject, err)
+	}
+
+	s := &redisSubscription{
+		pubsub:   pubsub,
+		messages: make(chan []byte, subscriptionBufferSize),
+		done:     make(chan struct{}),
+	}
+
+	go s.forward()
+
+	return s, nil
+}
+
+func (r *Redis) Claim(key, owner string, ttl time.Duration) (string, error) {
+	ctx := context.Background()
+
+	ok, err := r.client.SetNX(ctx, keyPrefix+key, owner, ttl).Result()
+	if err != nil {
+		return "", err
+	}
+
+	if ok {
+		return owner, nil
+	}
+
+	return r.Owner(key)
+}
+
+func (r *Redis) Refresh(key, owner string, ttl time.Duration) (bool, error) {
+	refreshed, err := refreshScript.Run(context.Background(), r.client, []string{keyPrefix + key}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return refreshed == 1, nil
+}
+
+func (r *Redis) Owner(key string) (string, error) {
+	owner, err := r.client.Get(context.Background(), keyPrefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+
+	return owner, err
+}
+
+func (r *Redis) Release(key, owner string) error {
+	return releaseScript.Run(context.Background(), r.client, []string{keyPrefix + key}, owner).Err()
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+type redisSubscription struct {
+	pubsub    *redis.PubSub
+	messages  chan []byte
+	done      chan struct{} // closed by Unsubscribe
+	closeOnce sync.Once
+}
+
+// forward hands the messages received from Redis to the subscriber. While the
+// subscriber lags behind, messages are not read from the connection and wait
+// in the output buffer Redis keeps for the subscription.
+func (s *redisSubscription) forward() {
+	defer close(s.messages)
+
+	for {
+		msg, err := s.pubsub.ReceiveMessage(context.Background())
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+
+			if errors.Is(err, redis.ErrClosed) {
+				// the broker was closed
+				return
+			}
+
+			// the connection is reestablished on the next receive
+			time.Sleep(redisRetryDelay)
+			continue
+		}
+
+		select {
+		case s.messages <- []byte(msg.Payload):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *redisSubscription) Unsubscribe() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.pubsub.Close()
+	})
+
+	return err
+}
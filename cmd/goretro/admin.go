@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+const adminPrefix = "/admin/"
+
+type adminRoom struct {
+	retro.RoomInfo
+	StateName  string  `json:"stateName"`
+	AgeSeconds float64 `json:"ageSeconds"`
+}
+
+// transferHostRequest refers to the new host by its participant ID, as listed
+// in the room state.
+type transferHostRequest struct {
+	ParticipantID retro.ParticipantID `json:"participantId"`
+}
+
+// adminHandler serves the administration API. All requests must carry the
+// admin token in an "Authorization: Bearer <token>" header.
+//
+// Routes:
+// - GET /admin/rooms lists all rooms
+// - GET /admin/rooms/{id} returns the complete state of a room
+// - DELETE /admin/rooms/{id} closes a room
+// - POST /admin/rooms/{id}/host transfers the host role to another participant
+// - DELETE /admin/rooms/{id}/participants/{participantId} revokes a participant
+func adminHandler(logger *slog.Logger, token string, manager *retro.Manager, connections *sseconn.Handler) http.Handler {
+	router := mux.NewRouter().PathPrefix(adminPrefix).Subrouter()
+
+	router.Methods("GET").Path("/rooms").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		rooms := manager.Rooms()
+		res := make([]adminRoom, 0, len(rooms))
+
+		for _, room := range rooms {
+			res = append(res, adminRoom{
+				RoomInfo:   room,
+				StateName:  room.State.String(),
+				AgeSeconds: now.Sub(room.CreatedAt).Seconds(),
+			})
+		}
+
+		writeJSON(w, res)
+	})
+
+	router.Methods("GET").Path("/rooms/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID, ok := roomIDFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		room, err := manager.Room(roomID)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		writeJSON(w, room)
+	})
+
+	router.Methods("DELETE").Path("/rooms/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID, ok := roomIDFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := manager.CloseRoom(roomID); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		logger.Info("admin closed room", "room_id", roomID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router.Methods("POST").Path("/rooms/{id}/host").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID, ok := roomIDFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var req transferHostRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.ParticipantID == "" {
+			http.Error(w, "Invalid participant ID", http.StatusBadRequest)
+			return
+		}
+
+		participantID := req.ParticipantID
+
+		if err := manager.TransferHost(roomID, participantID); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		logger.Info("admin transferred host", "room_id", roomID, "participant_id", participantID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router.Methods("DELETE").Path("/rooms/{id}/participants/{participantId}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID, ok := roomIDFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		participantID := retro.ParticipantID(mux.Vars(r)["participantId"])
+
+		clientID, err := manager.ParticipantClientID(roomID, participantID)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		if err := connections.RevokeClient(clientID); err != nil {
+			logger.Error("error revoking participant", "room_id", roomID, "participant_id", participantID, "error", err)
+			writeAdminError(w, err)
+			return
+		}
+
+		logger.Info("admin revoked participant", "room_id", roomID, "participant_id", participantID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return requireToken(token, router)
+}
+
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const bearerPrefix = "Bearer "
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(bearerPrefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func roomIDFromRequest(w http.ResponseWriter, r *http.Request) (sseconn.ClientID, bool) {
+	roomID, err := sseconn.ClientIDFromString(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return roomID, false
+	}
+
+	return roomID, true
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, retro.ErrRoomNotFound), errors.Is(err, retro.ErrParticipantNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
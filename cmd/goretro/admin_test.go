@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+const testAdminToken = "admin-token"
+
+func TestAdminHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	connHandler := sseconn.NewHandler(apiPrefix, sseconn.Options{Logger: logger, MaxProtocolVersion: retro.ProtocolVersion})
+	defer connHandler.Close()
+
+	manager, err := retro.NewManager(connHandler, retro.Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	api := httptest.NewServer(connHandler)
+	defer api.Close()
+
+	handler := adminHandler(logger, testAdminToken, manager, connHandler)
+
+	serve := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("requests need the admin token", func(t *testing.T) {
+		for _, token := range []string{"", "wrong-token"} {
+			rec := serve("GET", adminPrefix+"rooms", token, "")
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected status 401 with token %q, got %d", token, rec.Code)
+			}
+
+			if rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("expected a Bearer challenge with token %q", token)
+			}
+		}
+	})
+
+	host := connectTestClient(t, api.URL)
+	host.send(t, `{"name": "identify", "nickname": "Host"}`)
+	host.send(t, `{"name": "create-room", "roomName": "Retro"}`)
+
+	rooms := waitForRooms(t, manager, 1)
+	roomID := rooms[0].ID
+	roomPath := adminPrefix + "rooms/" + roomID.String()
+
+	guest := connectTestClient(t, api.URL)
+	guest.send(t, `{"name": "identify", "nickname": "Guest"}`)
+	guest.send(t, fmt.Sprintf(`{"name": "join-room", "roomId": "%s"}`, roomID))
+
+	waitForParticipants(t, manager, roomID, 2)
+
+	t.Run("rooms are listed", func(t *testing.T) {
+		rec := serve("GET", adminPrefix+"rooms", testAdminToken, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+
+		var rooms []adminRoom
+		if err := json.NewDecoder(rec.Body).Decode(&rooms); err != nil {
+			t.Fatalf("error decoding rooms: %s", err)
+		}
+
+		if len(rooms) != 1 {
+			t.Fatalf("expected 1 room, got %d", len(rooms))
+		}
+
+		room := rooms[0]
+		if room.ID != roomID || room.Name != "Retro" || room.HostName != "Host" || room.Participants != 2 || room.StateName == "" {
+			t.Errorf("unexpected room %+v", room)
+		}
+	})
+
+	t.Run("invalid room IDs are rejected", func(t *testing.T) {
+		if rec := serve("GET", adminPrefix+"rooms/invalid", testAdminToken, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("host transfers need a participant", func(t *testing.T) {
+		for _, body := range []string{`{}`, `not json`} {
+			if rec := serve("POST", roomPath+"/host", testAdminToken, body); rec.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for %s, got %d", body, rec.Code)
+			}
+		}
+
+		if rec := serve("POST", roomPath+"/host", testAdminToken, `{"participantId": "unknown"}`); rec.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for an unknown participant, got %d", rec.Code)
+		}
+	})
+
+	t.Run("the host can be transferred", func(t *testing.T) {
+		body := fmt.Sprintf(`{"participantId": "%s"}`, retro.ParticipantIDOf(guest.clientID))
+		if rec := serve("POST", roomPath+"/host", testAdminToken, body); rec.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d", rec.Code)
+		}
+
+		room, err := manager.Room(roomID)
+		if err != nil {
+			t.Fatalf("error looking up room: %s", err)
+		}
+
+		if room.HostID != guest.clientID {
+			t.Errorf("expected the guest to be the host, got %s", room.HostID)
+		}
+	})
+
+	t.Run("rooms can be closed", func(t *testing.T) {
+		if rec := serve("DELETE", roomPath, testAdminToken, ""); rec.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d", rec.Code)
+		}
+
+		if len(manager.Rooms()) != 0 {
+			t.Errorf("expected the room to be closed")
+		}
+
+		for _, method := range []string{"GET", "DELETE"} {
+			if rec := serve(method, roomPath, testAdminToken, ""); rec.Code != http.StatusNotFound {
+				t.Errorf("expected status 404 for %s of a closed room, got %d", method, rec.Code)
+			}
+		}
+	})
+}
+
+// testClient sends commands to the API like the web client does.
+type testClient struct {
+	apiURL   string
+	clientID sseconn.ClientID
+	secret   string
+}
+
+func connectTestClient(t *testing.T, serverURL string) *testClient {
+	t.Helper()
+
+	c := &testClient{apiURL: serverURL + apiPrefix}
+
+	var credentials struct {
+		ClientID string `json:"clientId"`
+		Secret   string `json:"secret"`
+	}
+	if res := c.post(t, "credentials", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 for credentials, got %d", res.StatusCode)
+	} else if err := json.NewDecoder(res.Body).Decode(&credentials); err != nil {
+		t.Fatalf("error decoding credentials: %s", err)
+	}
+
+	clientID, err := sseconn.ClientIDFromString(credentials.ClientID)
+	if err != nil {
+		t.Fatalf("invalid client ID: %s", err)
+	}
+
+	c.clientID, c.secret = clientID, credentials.Secret
+
+	hello := map[string]interface{}{"name": "hello", "clientId": credentials.ClientID, "secret": c.secret, "protocolVersion": retro.ProtocolVersion}
+	if res := c.post(t, "command", hello); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 for hello, got %d", res.StatusCode)
+	}
+
+	return c
+}
+
+// send sends a data command, retrying while the manager does not listen on
+// the connection yet.
+func (c *testClient) send(t *testing.T, payload string) {
+	t.Helper()
+
+	cmd := map[string]interface{}{"name": "data", "clientId": c.clientID.String(), "secret": c.secret, "payload": json.RawMessage(payload)}
+
+	for i := 0; i < 50; i++ {
+		res := c.post(t, "command", cmd)
+		if res.StatusCode == http.StatusOK {
+			return
+		} else if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status 200 for %s, got %d", payload, res.StatusCode)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout sending %s", payload)
+}
+
+func (c *testClient) post(t *testing.T, path string, body interface{}) *http.Response {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("error marshaling request: %s", err)
+	}
+
+	res, err := http.Post(c.apiURL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+func waitForRooms(t *testing.T, manager *retro.Manager, count int) []retro.RoomInfo {
+	t.Helper()
+
+	for i := 0; i < 50; i++ {
+		if rooms := manager.Rooms(); len(rooms) == count {
+			return rooms
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for %d rooms", count)
+	return nil
+}
+
+func waitForParticipants(t *testing.T, manager *retro.Manager, roomID sseconn.ClientID, count int) {
+	t.Helper()
+
+	for i := 0; i < 50; i++ {
+		if room, err := manager.Room(roomID); err == nil && len(room.Participants) == count {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for %d participants", count)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/abustany/goretro/sseconn"
+)
+
+const (
+	authPrefix = "/auth/"
+
+	authModeProxy = "proxy"
+	authModeOIDC  = "oidc"
+
+	sessionCookieName   = "goretro_session"
+	oidcStateCookieName = "goretro_oidc_state"
+	oidcStateTTL        = 10 * time.Minute
+)
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// authenticator verifies the identity of the users sending requests.
+type authenticator interface {
+	// identify returns the identity of the user sending r, if it could be
+	// verified.
+	identify(r *http.Request) (sseconn.Identity, bool)
+
+	// loginURL returns the URL of the page where unauthenticated users
+	// visiting r should log in, or "" if logging in is handled elsewhere.
+	loginURL(r *http.Request) string
+}
+
+type authConfig struct {
+	mode string
+
+	proxyUserHeader  string
+	proxyNameHeader  string
+	proxyEmailHeader string
+
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+
+	sessionKey string
+	sessionTTL time.Duration
+
+	// trustForwardedProto marks cookies as secure when the X-Forwarded-Proto
+	// header of the request is https, for servers behind a TLS terminating
+	// reverse proxy.
+	trustForwardedProto bool
+}
+
+// newAuthenticator returns the authenticator selected by config.mode, or nil
+// if authentication is disabled.
+func newAuthenticator(ctx context.Context, logger *slog.Logger, config authConfig) (authenticator, error) {
+	switch config.mode {
+	case "":
+		return nil, nil
+	case authModeProxy:
+		if config.proxyUserHeader == "" {
+			return nil, errors.New("the user header of the proxy must be set")
+		}
+
+		return proxyAuthenticator{
+			userHeader:  config.proxyUserHeader,
+			nameHeader:  config.proxyNameHeader,
+			emailHeader: config.proxyEmailHeader,
+		}, nil
+	case authModeOIDC:
+		if config.oidcIssuer == "" || config.oidcClientID == "" || config.oidcRedirectURL == "" {
+			return nil, errors.New("the OIDC issuer, client ID and redirect URL must be set")
+		}
+
+		key := []byte(config.sessionKey)
+		if len(key) == 0 {
+			logger.Warn("no session key set, sessions will not survive restarts nor be shared between replicas")
+
+			key = make([]byte, sha256.Size)
+			if _, err := rand.Read(key); err != nil {
+				return nil, fmt.Errorf("error generating session key: %w", err)
+			}
+		}
+
+		return newOIDCAuthenticator(ctx, logger, config, cookieSigner{key: key})
+	default:
+		return nil, fmt.Errorf("unknown authentication mode %q (expected %s or %s)", config.mode, authModeProxy, authModeOIDC)
+	}
+}
+
+// requireAuth only lets requests from authenticated users reach h, and
+// attaches their identity to the request context. Unauthenticated users
+// loading a page are sent to the login page, other requests are rejected.
+func requireAuth(auth authenticator, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.identify(r)
+		if !ok {
+			if loginURL := auth.loginURL(r); loginURL != "" && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, loginURL, http.StatusFound)
+				return
+			}
+
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(sseconn.ContextWithIdentity(r.Context(), identity)))
+	})
+}
+
+// allowPreflight sends the CORS preflight requests to preflight, and the
+// other requests to h. Browsers never send credentials with preflight
+// requests, so APIs protected by requireAuth must answer them before
+// authentication.
+func allowPreflight(preflight, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			preflight.ServeHTTP(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// proxyAuthenticator trusts the identity headers set by an authenticating
+// reverse proxy. The proxy must strip these headers from the requests it
+// receives, otherwise anybody can pick their identity.
+type proxyAuthenticator struct {
+	userHeader  string
+	nameHeader  string
+	emailHeader string
+}
+
+func (a proxyAuthenticator) identify(r *http.Request) (sseconn.Identity, bool) {
+	user := r.Header.Get(a.userHeader)
+	if user == "" {
+		return sseconn.Identity{}, false
+	}
+
+	identity := sseconn.Identity{Subject: user}
+
+	if a.nameHeader != "" {
+		identity.Name = r.Header.Get(a.nameHeader)
+	}
+
+	if a.emailHeader != "" {
+		identity.Email = r.Header.Get(a.emailHeader)
+	}
+
+	return identity, true
+}
+
+func (a proxyAuthenticator) loginURL(r *http.Request) string {
+	return ""
+}
+
+// oidcAuthenticator logs users in with the authorization code flow of an
+// OpenID Connect issuer, and keeps their identity in a signed session cookie.
+//
+// Routes:
+// - GET /auth/login?return={path} redirects to the issuer
+// - GET /auth/callback is where the issuer sends users back
+// - GET /auth/logout clears the session
+type oidcAuthenticator struct {
+	logger     *slog.Logger
+	oauth2     oauth2.Config
+	verifier   *oidc.IDTokenVerifier
+	cookies    cookieSigner
+	sessionTTL time.Duration
+
+	trustForwardedProto bool
+}
+
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"returnTo"`
+}
+
+func newOIDCAuthenticator(ctx context.Context, logger *slog.Logger, config authConfig, cookies cookieSigner) (*oidcAuthenticator, error) {
+	provider, err := oidc.NewProvider(ctx, config.oidcIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering the OIDC issuer: %w", err)
+	}
+
+	return &oidcAuthenticator{
+		logger: logger,
+		oauth2: oauth2.Config{
+			ClientID:     config.oidcClientID,
+			ClientSecret: config.oidcClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  config.oidcRedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier:   provider.Verifier(&oidc.Config{ClientID: config.oidcClientID}),
+		cookies:    cookies,
+		sessionTTL: config.sessionTTL,
+
+		trustForwardedProto: config.trustForwardedProto,
+	}, nil
+}
+
+func (a *oidcAuthenticator) identify(r *http.Request) (sseconn.Identity, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return sseconn.Identity{}, false
+	}
+
+	var identity sseconn.Identity
+	if err := a.cookies.decode(sessionCookieName, cookie.Value, &identity, time.Now()); err != nil || identity.Subject == "" {
+		return sseconn.Identity{}, false
+	}
+
+	return identity, true
+}
+
+func (a *oidcAuthenticator) loginURL(r *http.Request) string {
+	return authPrefix + "login?" + url.Values{"return": {r.URL.RequestURI()}}.Encode()
+}
+
+func (a *oidcAuthenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, authPrefix) {
+	case "login":
+		a.handleLogin(w, r)
+	case "callback":
+		a.handleCallback(w, r)
+	case "logout":
+		a.setCookie(w, r, sessionCookieName, "", -1)
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *oidcAuthenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("return")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		// only redirect to local pages after logging in
+		returnTo = "/"
+	}
+
+	state := oidcState{State: randomToken(), Nonce: randomToken(), ReturnTo: returnTo}
+
+	value, err := a.cookies.encode(oidcStateCookieName, state, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		a.logger.Error("error encoding OIDC state", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	a.setCookie(w, r, oidcStateCookieName, value, int(oidcStateTTL.Seconds()))
+	http.Redirect(w, r, a.oauth2.AuthCodeURL(state.State, oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+func (a *oidcAuthenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err == nil {
+		err = a.cookies.decode(oidcStateCookieName, cookie.Value, &state, time.Now())
+	}
+
+	if err != nil || r.URL.Query().Get("state") != state.State {
+		http.Error(w, "Invalid login state, please try again", http.StatusBadRequest)
+		return
+	}
+
+	a.setCookie(w, r, oidcStateCookieName, "", -1)
+
+	identity, err := a.exchange(r.Context(), r.URL.Query().Get("code"), state.Nonce)
+	if err != nil {
+		a.logger.Warn("OIDC login failed", "error", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	value, err := a.cookies.encode(sessionCookieName, identity, time.Now().Add(a.sessionTTL))
+	if err != nil {
+		a.logger.Error("error encoding session", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	a.logger.Info("user logged in", "subject", identity.Subject)
+	a.setCookie(w, r, sessionCookieName, value, int(a.sessionTTL.Seconds()))
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// exchange trades an authorization code for the identity of the user.
+func (a *oidcAuthenticator) exchange(ctx context.Context, code, nonce string) (sseconn.Identity, error) {
+	token, err := a.oauth2.Exchange(ctx, code)
+	if err != nil {
+		return sseconn.Identity{}, fmt.Errorf("error exchanging code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return sseconn.Identity{}, errors.New("no ID token in the token response")
+	}
+
+	idToken, err := a.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return sseconn.Identity{}, fmt.Errorf("error verifying ID token: %w", err)
+	}
+
+	if idToken.Nonce != nonce {
+		return sseconn.Identity{}, errors.New("invalid ID token nonce")
+	}
+
+	var claims struct {
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return sseconn.Identity{}, fmt.Errorf("error decoding ID token claims: %w", err)
+	}
+
+	identity := sseconn.Identity{Subject: idToken.Subject, Name: claims.Name, Email: claims.Email}
+	if identity.Name == "" {
+		identity.Name = claims.PreferredUsername
+	}
+
+	return identity, nil
+}
+
+func (a *oidcAuthenticator) setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// isHTTPS returns true if the user reached the server over HTTPS, either
+// directly or through a TLS terminating reverse proxy.
+func (a *oidcAuthenticator) isHTTPS(r *http.Request) bool {
+	if proto := r.Header.Get("X-Forwarded-Proto"); a.trustForwardedProto && proto != "" {
+		return strings.EqualFold(proto, "https")
+	}
+
+	return r.TLS != nil
+}
+
+// cookieSigner encodes values in cookies along with an expiry date and an
+// HMAC, so that they can be trusted when read back. Each value is signed for a
+// purpose (the name of its cookie), so that a cookie cannot be replayed as
+// another one.
+type cookieSigner struct {
+	key []byte
+}
+
+type signedCookie struct {
+	Purpose string          `json:"purpose"`
+	Expiry  int64           `json:"exp"`
+	Value   json.RawMessage `json:"value"`
+}
+
+func (s cookieSigner) encode(purpose string, v interface{}, expiry time.Time) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(signedCookie{Purpose: purpose, Expiry: expiry.Unix(), Value: value})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(s.mac(data)), nil
+}
+
+func (s cookieSigner) decode(purpose, cookie string, v interface{}, now time.Time) error {
+	encodedData, encodedMAC, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return errInvalidCookie
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encodedData)
+	if err != nil {
+		return errInvalidCookie
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, s.mac(data)) {
+		return errInvalidCookie
+	}
+
+	var signed signedCookie
+	if err := json.Unmarshal(data, &signed); err != nil || signed.Purpose != purpose || now.Unix() > signed.Expiry {
+		return errInvalidCookie
+	}
+
+	return json.Unmarshal(signed.Value, v)
+}
+
+func (s cookieSigner) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func randomToken() string {
+	var data [16]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		panic("error generating random token: " + err.Error())
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data[:])
+}
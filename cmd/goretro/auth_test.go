@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+
+	"github.com/abustany/goretro/sseconn"
+)
+
+// mockIssuer is a minimal OpenID Connect issuer, which logs in the same user
+// without asking anything.
+type mockIssuer struct {
+	*httptest.Server
+
+	t      *testing.T
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+
+	lock   sync.Mutex
+	nonces map[string]string // by code
+}
+
+func newMockIssuer(t *testing.T, claims map[string]interface{}) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	issuer := &mockIssuer{t: t, key: key, claims: claims, nonces: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "key", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		code := randomToken()
+
+		issuer.lock.Lock()
+		issuer.nonces[code] = r.URL.Query().Get("nonce")
+		issuer.lock.Unlock()
+
+		redirectURL := r.URL.Query().Get("redirect_uri") + "?" + url.Values{
+			"code":  {code},
+			"state": {r.URL.Query().Get("state")},
+		}.Encode()
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.lock.Lock()
+		nonce, ok := issuer.nonces[r.FormValue("code")]
+		issuer.lock.Unlock()
+
+		if !ok {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"id_token":     issuer.idToken(nonce),
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+
+	return issuer
+}
+
+func (i *mockIssuer) idToken(nonce string) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: i.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key"),
+	)
+	if err != nil {
+		i.t.Fatalf("error creating signer: %s", err)
+	}
+
+	now := time.Now()
+	token, err := jwt.Signed(signer).
+		Claims(jwt.Claims{
+			Issuer:   i.URL,
+			Subject:  "alice",
+			Audience: jwt.Audience{"goretro"},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+		}).
+		Claims(map[string]interface{}{"nonce": nonce}).
+		Claims(i.claims).
+		CompactSerialize()
+	if err != nil {
+		i.t.Fatalf("error signing ID token: %s", err)
+	}
+
+	return token
+}
+
+// identityHandler replies with the identity attached to the request.
+var identityHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	identity, ok := sseconn.IdentityFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no identity", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, identity)
+})
+
+func getIdentity(t *testing.T, client *http.Client, url string) (sseconn.Identity, int) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("error creating request: %s", err)
+	}
+
+	req.Header.Set("Accept", "text/html")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	var identity sseconn.Identity
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&identity); err != nil {
+			t.Fatalf("error decoding identity: %s", err)
+		}
+	}
+
+	return identity, res.StatusCode
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	issuer := newMockIssuer(t, map[string]interface{}{"name": "Alice Liddell", "email": "alice@example.com"})
+	defer issuer.Close()
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	auth, err := newAuthenticator(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), authConfig{
+		mode:            authModeOIDC,
+		oidcIssuer:      issuer.URL,
+		oidcClientID:    "goretro",
+		oidcRedirectURL: server.URL + authPrefix + "callback",
+		sessionTTL:      time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("error creating authenticator: %s", err)
+	}
+
+	mux.Handle(authPrefix, auth.(http.Handler))
+	mux.Handle("/", requireAuth(auth, identityHandler))
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("error creating cookie jar: %s", err)
+	}
+
+	client := &http.Client{Jar: jar}
+
+	t.Run("API requests are rejected before logging in", func(t *testing.T) {
+		res, err := client.Post(server.URL+"/api/command", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("pages redirect to the issuer and back", func(t *testing.T) {
+		identity, code := getIdentity(t, client, server.URL+"/room?id=abc")
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		checkIdentity(t, sseconn.Identity{Subject: "alice", Name: "Alice Liddell", Email: "alice@example.com"}, identity)
+	})
+
+	t.Run("the session cookie authenticates the next requests", func(t *testing.T) {
+		noRedirectClient := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		if _, code := getIdentity(t, noRedirectClient, server.URL+"/"); code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", code)
+		}
+	})
+
+	t.Run("tampered session cookies are rejected", func(t *testing.T) {
+		serverURL, _ := url.Parse(server.URL)
+		session := jar.Cookies(serverURL)[0]
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "x" + session.Value})
+
+		if _, ok := auth.identify(req); ok {
+			t.Errorf("tampered session cookie was accepted")
+		}
+	})
+
+	t.Run("the login state cookie is not a session cookie", func(t *testing.T) {
+		noRedirectClient := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		res, err := noRedirectClient.Get(server.URL + authPrefix + "login")
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+
+		res.Body.Close()
+
+		var state *http.Cookie
+		for _, cookie := range res.Cookies() {
+			if cookie.Name == oidcStateCookieName {
+				state = cookie
+			}
+		}
+
+		if state == nil {
+			t.Fatalf("no login state cookie set")
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: state.Value})
+
+		if _, ok := auth.identify(req); ok {
+			t.Errorf("login state cookie was accepted as a session cookie")
+		}
+	})
+
+	t.Run("sessions without a subject are rejected", func(t *testing.T) {
+		value, err := auth.(*oidcAuthenticator).cookies.encode(sessionCookieName, sseconn.Identity{}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("error encoding session: %s", err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+
+		if _, ok := auth.identify(req); ok {
+			t.Errorf("session without a subject was accepted")
+		}
+	})
+}
+
+func TestOIDCSecureCookies(t *testing.T) {
+	issuer := newMockIssuer(t, nil)
+	defer issuer.Close()
+
+	newAuth := func(trustForwardedProto bool) http.Handler {
+		auth, err := newAuthenticator(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), authConfig{
+			mode:                authModeOIDC,
+			oidcIssuer:          issuer.URL,
+			oidcClientID:        "goretro",
+			oidcRedirectURL:     "https://retro.example.com" + authPrefix + "callback",
+			sessionTTL:          time.Hour,
+			trustForwardedProto: trustForwardedProto,
+		})
+		if err != nil {
+			t.Fatalf("error creating authenticator: %s", err)
+		}
+
+		return auth.(http.Handler)
+	}
+
+	for _, test := range []struct {
+		name                string
+		trustForwardedProto bool
+		forwardedProto      string
+		secure              bool
+	}{
+		{"plain HTTP", false, "", false},
+		{"forwarded proto is ignored by default", false, "https", false},
+		{"trusted forwarded HTTPS", true, "https", true},
+		{"trusted forwarded HTTP", true, "http", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", authPrefix+"login", nil)
+			if test.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+			}
+
+			rec := httptest.NewRecorder()
+			newAuth(test.trustForwardedProto).ServeHTTP(rec, req)
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) == 0 {
+				t.Fatalf("no cookie set")
+			}
+
+			for _, cookie := range cookies {
+				if cookie.Secure != test.secure {
+					t.Errorf("expected cookie %s to have Secure=%v", cookie.Name, test.secure)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyAuthenticator(t *testing.T) {
+	auth, err := newAuthenticator(context.Background(), slog.Default(), authConfig{
+		mode:             authModeProxy,
+		proxyUserHeader:  "X-Forwarded-User",
+		proxyEmailHeader: "X-Forwarded-Email",
+	})
+	if err != nil {
+		t.Fatalf("error creating authenticator: %s", err)
+	}
+
+	handler := requireAuth(auth, identityHandler)
+
+	t.Run("requests without identity headers are rejected", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rec.Code)
+		}
+	})
+
+	t.Run("CORS preflight requests go through without identity headers", func(t *testing.T) {
+		preflight := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		handler := allowPreflight(preflight, requireAuth(auth, preflight))
+
+		req := httptest.NewRequest("OPTIONS", "/", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("expected status 204, got %d", rec.Code)
+		}
+
+		req = httptest.NewRequest("OPTIONS", "/", nil)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for an OPTIONS request that is not a preflight, got %d", rec.Code)
+		}
+	})
+
+	t.Run("identity headers are attached to the request", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-User", "bob")
+		req.Header.Set("X-Forwarded-Email", "bob@example.com")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		var identity sseconn.Identity
+		if err := json.NewDecoder(rec.Body).Decode(&identity); err != nil {
+			t.Fatalf("error decoding identity: %s", err)
+		}
+
+		checkIdentity(t, sseconn.Identity{Subject: "bob", Email: "bob@example.com"}, identity)
+	})
+}
+
+func checkIdentity(t *testing.T, expected, actual sseconn.Identity) {
+	t.Helper()
+
+	if expected != actual {
+		t.Errorf("expected identity %+v, got %+v", expected, actual)
+	}
+}
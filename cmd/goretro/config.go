@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	configFlagName = "config"
+	envPrefix      = "GORETRO_"
+)
+
+// loadConfig parses the command line arguments into the flags of fs, and
+// fills the flags that were not set on the command line from the environment
+// and from a JSON configuration file.
+//
+// Precedence is, from highest to lowest: command line, environment variables,
+// configuration file, flag defaults.
+//
+// The configuration file is a JSON object whose keys are flag names, for
+// example {"listen": "0.0.0.0:80", "keep-alive-interval": "5s"}. Environment
+// variables are named after the flags, upper cased, with dashes replaced by
+// underscores and prefixed with GORETRO_ (GORETRO_KEEP_ALIVE_INTERVAL).
+//
+// The configuration file path is taken from the -config flag, or from the
+// GORETRO_CONFIG environment variable.
+func loadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) error {
+	configPath := fs.String(configFlagName, "", "path to a JSON configuration file")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	setOnCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	if *configPath == "" {
+		*configPath = getenv(envVarName(configFlagName))
+	}
+
+	if *configPath != "" {
+		if err := loadConfigFile(fs, *configPath, setOnCommandLine); err != nil {
+			return fmt.Errorf("error loading configuration file %s: %w", *configPath, err)
+		}
+	}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || setOnCommandLine[f.Name] || f.Name == configFlagName {
+			return
+		}
+
+		name := envVarName(f.Name)
+		if value := getenv(name); value != "" {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for environment variable %s: %w", value, name, setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+func loadConfigFile(fs *flag.FlagSet, path string, setOnCommandLine map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("error decoding JSON: %w", err)
+	}
+
+	for name, value := range values {
+		f := fs.Lookup(name)
+		if f == nil || name == configFlagName {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+
+		if setOnCommandLine[name] {
+			continue
+		}
+
+		stringValue := fmt.Sprint(value)
+		if number, ok := value.(float64); ok {
+			// avoid the exponent notation for large numbers
+			stringValue = strconv.FormatFloat(number, 'f', -1, 64)
+		}
+
+		if err := f.Value.Set(stringValue); err != nil {
+			return fmt.Errorf("invalid value %v for setting %q: %w", value, name, err)
+		}
+	}
+
+	return nil
+}
+
+func envVarName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	configData := `{"listen": "file:80", "ui": "/file/ui", "interval": "5s", "size": 12}`
+	if err := os.WriteFile(configPath, []byte(configData), 0600); err != nil {
+		t.Fatalf("error writing config file: %s", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	listen := fs.String("listen", "default:80", "")
+	uiDir := fs.String("ui", "", "")
+	interval := fs.Duration("interval", time.Second, "")
+	size := fs.Int("size", 1, "")
+	untouched := fs.String("untouched", "default", "")
+
+	env := map[string]string{
+		"GORETRO_CONFIG": configPath,
+		"GORETRO_LISTEN": "env:80",
+		"GORETRO_UI":     "/env/ui",
+	}
+
+	if err := loadConfig(fs, []string{"-listen=flag:80"}, func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("error loading config: %s", err)
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Expected interface{}
+		Actual   interface{}
+	}{
+		{"command line beats everything", "flag:80", *listen},
+		{"environment beats config file", "/env/ui", *uiDir},
+		{"config file beats defaults (duration)", 5 * time.Second, *interval},
+		{"config file beats defaults (int)", 12, *size},
+		{"defaults are kept", "default", *untouched},
+	} {
+		if tc.Expected != tc.Actual {
+			t.Errorf("%s: expected %v, got %v", tc.Name, tc.Expected, tc.Actual)
+		}
+	}
+
+	t.Run("unknown settings are rejected", func(t *testing.T) {
+		if err := os.WriteFile(configPath, []byte(`{"wat": 1}`), 0600); err != nil {
+			t.Fatalf("error writing config file: %s", err)
+		}
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		if err := loadConfig(fs, []string{"-config=" + configPath}, func(string) string { return "" }); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
@@ -1,47 +1,265 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/abustany/goretro/broker"
+	debugui "github.com/abustany/goretro/debug-ui"
+	"github.com/abustany/goretro/history"
 	"github.com/abustany/goretro/retro"
 	"github.com/abustany/goretro/sseconn"
+	"github.com/abustany/goretro/ui"
 )
 
-const apiPrefix = "/api/"
+const (
+	apiPrefix     = "/api/"
+	debugUIPrefix = "/debug/"
+)
 
 func main() {
 	listenAddress := flag.String("listen", "127.0.0.1:1407", "address on which to listen")
-	uiDir := flag.String("ui", "", "directory with the UI files. If unset, do no serve UI files.")
-	flag.Parse()
+	uiDir := flag.String("ui", "", "directory with the UI files. If unset, serve the UI files embedded in the binary, if any.")
+	logLevel := flag.String("log-level", "info", "minimum level of the log messages (debug, info, warn or error)")
+	logFormat := flag.String("log-format", "text", "format of the log messages (text or json)")
+	tlsCert := flag.String("tls-cert", "", "path to a PEM encoded TLS certificate. Enables HTTPS and HTTP/2 when set along with -tls-key.")
+	tlsKey := flag.String("tls-key", "", "path to the PEM encoded private key of the TLS certificate")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "serve HTTPS and HTTP/2 with a generated self signed certificate, for local use")
+	adminToken := flag.String("admin-token", "", "token required to access the admin API under /admin/. If unset, the admin API is disabled.")
+	redisAddress := flag.String("redis", "", "address (host:port) of a Redis server used to share rooms between several replicas and to store the history of the teams. If unset, rooms are only available on this replica and the history is kept in memory.")
+	roomClaimTTL := flag.Duration("room-claim-ttl", retro.DefaultRoomClaimTTL, "how long the rooms of a replica stay claimed after it stopped refreshing their claims")
+	replicaID := flag.String("replica-id", "", "unique ID of this replica amongst those sharing the same Redis server. Defaults to a random ID.")
+	keepAliveInterval := flag.Duration("keep-alive-interval", sseconn.DefaultKeepAliveInterval, "delay between two keep-alive events on idle event streams")
+	pollTimeout := flag.Duration("poll-timeout", sseconn.DefaultPollTimeout, "how long poll requests wait for events, for clients that cannot use event streams")
+	pausedConnectionTTL := flag.Duration("paused-connection-ttl", sseconn.DefaultPausedConnectionTTL, "how long to wait for a client to reopen its event stream before closing its connection")
+	eventBufferSize := flag.Int("event-buffer-size", sseconn.DefaultEventBufferSize, "number of events that can be queued for a client")
+	commandQueueSize := flag.Int("command-queue-size", sseconn.DefaultCommandQueueSize, "number of commands of a client that can wait to be processed")
+	commandKeysTTL := flag.Duration("command-keys-ttl", sseconn.DefaultCommandKeysTTL, "how long command idempotency keys are remembered after the last keyed command of a client")
+	maxCommandKeys := flag.Int("max-command-keys", sseconn.DefaultMaxCommandKeys, "number of command idempotency keys remembered for each client")
+	janitorInterval := flag.Duration("janitor-interval", sseconn.DefaultJanitorInterval, "delay between two checks for expired connections")
+	trustForwardedProto := flag.Bool("trust-forwarded-proto", false, "take the scheme of requests from the X-Forwarded-Proto header set by a TLS terminating reverse proxy, when checking their origin and securing the login cookies")
+	allowedOrigins := flag.String("allowed-origins", "", "comma separated list of origins (e.g. http://localhost:3000) allowed to send cross origin API requests, or * for any origin")
+	eventsTokenTTL := flag.Duration("events-token-ttl", sseconn.DefaultEventsTokenTTL, "how long the event stream URL returned to a client remains valid")
+	credentialsKey := flag.String("credentials-key", "", "secret used to sign the client credentials. Must be shared by all replicas. Defaults to a random key.")
+	credentialsTTL := flag.Duration("credentials-ttl", sseconn.DefaultCredentialsTTL, "how long client credentials remain valid")
+	clientChosenCredentials := flag.Bool("client-chosen-credentials", false, "accept client IDs and secrets generated by the clients themselves, for old clients. Anybody knowing a client ID can then take it over.")
+	maxCommandSize := flag.Int64("max-command-size", sseconn.DefaultMaxCommandSize, "maximum size in bytes of a command request")
+	clientRateLimit := flag.Float64("client-rate-limit", sseconn.DefaultClientRateLimit.PerSecond, "number of commands per second a client can send. A negative value disables the limit.")
+	clientRateBurst := flag.Int("client-rate-burst", sseconn.DefaultClientRateLimit.Burst, "number of commands a client can send in a burst")
+	ipRateLimit := flag.Float64("ip-rate-limit", sseconn.DefaultIPRateLimit.PerSecond, "number of commands per second that can be sent from an IP address. A negative value disables the limit.")
+	ipRateBurst := flag.Int("ip-rate-burst", sseconn.DefaultIPRateLimit.Burst, "number of commands that can be sent in a burst from an IP address")
+	maxNoteLength := flag.Int("max-note-length", retro.DefaultMaxNoteLength, "maximum number of characters in a note")
+	maxNotesPerParticipant := flag.Int("max-notes-per-participant", retro.DefaultMaxNotesPerParticipant, "maximum number of notes a participant can write in a retro")
+	maxVotesPerParticipant := flag.Int("max-votes-per-participant", retro.DefaultMaxVotesPerParticipant, "maximum number of notes a participant can vote for in a retro")
+	maxRoomNameLength := flag.Int("max-room-name-length", retro.DefaultMaxRoomNameLength, "maximum number of characters in a room name")
+	maxNicknameLength := flag.Int("max-nickname-length", retro.DefaultMaxNicknameLength, "maximum number of characters in a nickname")
+	authMode := flag.String("auth", "", "how to verify the identity of participants: proxy (trust the headers of an authenticating reverse proxy) or oidc. If unset, participants pick any nickname.")
+	authProxyUserHeader := flag.String("auth-proxy-user-header", "X-Forwarded-User", "header carrying the user ID set by the authenticating proxy")
+	authProxyNameHeader := flag.String("auth-proxy-name-header", "X-Forwarded-Preferred-Username", "header carrying the user name set by the authenticating proxy")
+	authProxyEmailHeader := flag.String("auth-proxy-email-header", "X-Forwarded-Email", "header carrying the user email set by the authenticating proxy")
+	authOIDCIssuer := flag.String("auth-oidc-issuer", "", "URL of the OpenID Connect issuer")
+	authOIDCClientID := flag.String("auth-oidc-client-id", "", "OpenID Connect client ID")
+	authOIDCClientSecret := flag.String("auth-oidc-client-secret", "", "OpenID Connect client secret")
+	authOIDCRedirectURL := flag.String("auth-oidc-redirect-url", "", "external URL of the /auth/callback page, registered with the OpenID Connect issuer")
+	authSessionKey := flag.String("auth-session-key", "", "secret used to sign the session cookies. Must be shared by all replicas. Defaults to a random key.")
+	authSessionTTL := flag.Duration("auth-session-ttl", 12*time.Hour, "how long users stay logged in")
+
+	if err := loadConfig(flag.CommandLine, os.Args[1:], os.Getenv); err != nil {
+		log.Fatalf("error loading configuration: %s", err)
+	}
+
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("error configuring logging: %s", err)
+	}
+
+	slog.SetDefault(logger)
+
+	tlsConfig, err := newTLSConfig(*tlsCert, *tlsKey, *tlsSelfSigned, *listenAddress)
+	if err != nil {
+		logger.Error("error configuring TLS", "error", err)
+		os.Exit(1)
+	}
+
+	auth, err := newAuthenticator(context.Background(), logger, authConfig{
+		mode:             *authMode,
+		proxyUserHeader:  *authProxyUserHeader,
+		proxyNameHeader:  *authProxyNameHeader,
+		proxyEmailHeader: *authProxyEmailHeader,
+		oidcIssuer:       *authOIDCIssuer,
+		oidcClientID:     *authOIDCClientID,
+		oidcClientSecret: *authOIDCClientSecret,
+		oidcRedirectURL:  *authOIDCRedirectURL,
+		sessionKey:       *authSessionKey,
+		sessionTTL:       *authSessionTTL,
+
+		trustForwardedProto: *trustForwardedProto,
+	})
+	if err != nil {
+		logger.Error("error configuring authentication", "error", err)
+		os.Exit(1)
+	}
+
+	// withAuth protects the pages and API used by participants when
+	// authentication is enabled.
+	withAuth := func(h http.Handler) http.Handler {
+		if auth == nil {
+			return h
+		}
+
+		return requireAuth(auth, h)
+	}
+
+	// withAPIAuth is withAuth for the APIs, which answer the CORS preflight
+	// requests of other origins themselves.
+	withAPIAuth := func(h http.Handler) http.Handler {
+		if auth == nil {
+			return h
+		}
+
+		return allowPreflight(h, requireAuth(auth, h))
+	}
+
+	if *credentialsKey == "" {
+		logger.Warn("no credentials key set, client credentials will not survive restarts nor be shared between replicas")
+	}
 
 	mux := http.NewServeMux()
 
-	apiHandler := sseconn.NewHandler(apiPrefix)
+	if auth != nil {
+		logger.Info("authentication enabled", "mode", *authMode)
+	}
+
+	if authRoutes, ok := auth.(http.Handler); ok {
+		mux.Handle(authPrefix, authRoutes)
+	}
+
+	connOptions := sseconn.Options{
+		Logger:              logger,
+		KeepAliveInterval:   *keepAliveInterval,
+		PollTimeout:         *pollTimeout,
+		PausedConnectionTTL: *pausedConnectionTTL,
+		EventBufferSize:     *eventBufferSize,
+		CommandQueueSize:    *commandQueueSize,
+		MaxCommandKeys:      *maxCommandKeys,
+		CommandKeysTTL:      *commandKeysTTL,
+		JanitorInterval:     *janitorInterval,
+		MaxCommandSize:      *maxCommandSize,
+		ClientRateLimit:     sseconn.RateLimit{PerSecond: *clientRateLimit, Burst: *clientRateBurst},
+		IPRateLimit:         sseconn.RateLimit{PerSecond: *ipRateLimit, Burst: *ipRateBurst},
+		AllowedOrigins:      splitList(*allowedOrigins),
+		TrustForwardedProto: *trustForwardedProto,
+		EventsTokenTTL:      *eventsTokenTTL,
+		CredentialsKey:      []byte(*credentialsKey),
+		CredentialsTTL:      *credentialsTTL,
+		MinProtocolVersion:  retro.MinProtocolVersion,
+		MaxProtocolVersion:  retro.ProtocolVersion,
+
+		ClientChosenCredentials: *clientChosenCredentials,
+	}
+
+	managerOptions := retro.Options{
+		Logger:                 logger,
+		ReplicaID:              *replicaID,
+		RoomClaimTTL:           *roomClaimTTL,
+		MaxNoteLength:          *maxNoteLength,
+		MaxNotesPerParticipant: *maxNotesPerParticipant,
+		MaxVotesPerParticipant: *maxVotesPerParticipant,
+		MaxRoomNameLength:      *maxRoomNameLength,
+		MaxNicknameLength:      *maxNicknameLength,
+		VerifiedNames:          auth != nil,
+	}
+
+	if *redisAddress != "" {
+		redisBroker, err := broker.NewRedis(*redisAddress)
+		if err != nil {
+			logger.Error("error connecting to the broker", "error", err)
+			os.Exit(1)
+		}
+
+		defer redisBroker.Close()
+		historyStore, err := history.NewRedis(*redisAddress)
+		if err != nil {
+			logger.Error("error connecting to the history store", "error", err)
+			os.Exit(1)
+		}
+
+		defer historyStore.Close()
+		logger.Info("sharing rooms through Redis", "address", *redisAddress)
+		managerOptions.Broker = redisBroker
+		managerOptions.History = historyStore
+		connOptions.Revocations = newBrokerRevocations(redisBroker)
+	}
+
+	apiHandler := sseconn.NewHandler(apiPrefix, connOptions)
 	defer apiHandler.Close()
-	mux.Handle(apiPrefix, apiHandler)
+	mux.Handle(apiPrefix, withAPIAuth(apiHandler))
 
 	// Starts the listening on new connections
-	retro.NewManager(apiHandler)
+	manager, err := retro.NewManager(apiHandler, managerOptions)
+	if err != nil {
+		logger.Error("error creating the retro manager", "error", err)
+		os.Exit(1)
+	}
+
+	teams := withAPIAuth(teamsHandler(logger, manager, apiHandler))
+	mux.Handle(teamsPrefix, teams)
+	mux.Handle(teamsPrefix+"/", teams)
+
+	if *adminToken != "" {
+		logger.Info("admin API enabled")
+		mux.Handle(adminPrefix, adminHandler(logger, *adminToken, manager, apiHandler))
+		mux.Handle("/metrics", requireToken(*adminToken, metricsHandler(apiHandler, manager)))
+	} else {
+		logger.Warn("metrics are served without authentication, set -admin-token to protect them")
+		mux.Handle("/metrics", metricsHandler(apiHandler, manager))
+	}
+
+	if debugUIFiles := debugui.FS(); debugUIFiles != nil {
+		mux.Handle(debugUIPrefix, withAuth(http.StripPrefix(debugUIPrefix, staticHandler(debugUIFiles))))
+	}
 
 	if *uiDir != "" {
-		log.Printf("Serving UI files from %s", *uiDir)
-		mux.Handle("/", http.FileServer(http.Dir(*uiDir)))
+		logger.Info("serving UI files", "dir", *uiDir)
+		mux.Handle("/", withAuth(staticHandler(os.DirFS(*uiDir))))
+	} else if uiFiles := ui.FS(); uiFiles != nil {
+		logger.Info("serving embedded UI files")
+		mux.Handle("/", withAuth(staticHandler(uiFiles)))
 	}
 
-	log.Printf("Starting server on %s", *listenAddress)
-	http.ListenAndServe(*listenAddress, loggingHandler(mux))
+	server := &http.Server{
+		Addr:      *listenAddress,
+		Handler:   loggingHandler(logger, mux),
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		logger.Info("starting server", "address", *listenAddress, "tls", true)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("starting server", "address", *listenAddress, "tls", false)
+		err = server.ListenAndServe()
+	}
+
+	if err != nil {
+		logger.Error("error running server", "error", err)
+		os.Exit(1)
+	}
 }
 
-func loggingHandler(h http.Handler) http.Handler {
+func loggingHandler(logger *slog.Logger, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		spy := spyingResponseWriter{ResponseWriter: w}
 
 		h.ServeHTTP(&spy, r)
-		log.Printf("%s %s - %d (%s)", r.Method, r.URL.Path, spy.code, time.Since(start))
+		logger.Info("request", "method", r.Method, "path", r.URL.Path, "status", spy.code, "duration", time.Since(start))
 	})
 }
 
@@ -67,8 +285,28 @@ func (s *spyingResponseWriter) Write(data []byte) (int, error) {
 	return s.ResponseWriter.Write(data)
 }
 
+// Flush is required for the event streams, both for HTTP/1.1 and HTTP/2
+// response writers.
 func (s *spyingResponseWriter) Flush() {
 	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
 }
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (s *spyingResponseWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var res []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoggingHandlerFlushesOverHTTP2(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+	})
+
+	server := httptest.NewUnstartedServer(loggingHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), handler))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	defer close(release)
+
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", res.Proto)
+	}
+
+	// this blocks forever if the response was not flushed
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading response: %s", err)
+	}
+
+	if line != "first\n" {
+		t.Errorf("unexpected response: %q", line)
+	}
+}
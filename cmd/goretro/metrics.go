@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsHandler exposes the connection and room statistics in the Prometheus
+// text exposition format.
+func metricsHandler(connHandler *sseconn.Handler, manager *retro.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		writeMetrics(w, connHandler.Stats(), manager.Stats())
+	})
+}
+
+func writeMetrics(w io.Writer, connStats sseconn.Stats, retroStats retro.Stats) {
+	writeHeader(w, "goretro_connections", "gauge", "Current number of client connections, by state.")
+	for _, state := range sortedKeys(connStats.ConnectionsByState) {
+		fmt.Fprintf(w, "goretro_connections{state=%q} %d\n", state, connStats.ConnectionsByState[state])
+	}
+
+	writeHeader(w, "goretro_event_streams", "gauge", "Current number of open event streams.")
+	fmt.Fprintf(w, "goretro_event_streams %d\n", connStats.Streams)
+
+	writeHeader(w, "goretro_connections_expired_total", "counter", "Number of paused connections closed after their TTL expired.")
+	fmt.Fprintf(w, "goretro_connections_expired_total %d\n", connStats.ExpiredConnections)
+
+	writeHeader(w, "goretro_events_dropped_total", "counter", "Number of events dropped because the client's event buffer was full.")
+	fmt.Fprintf(w, "goretro_events_dropped_total %d\n", connStats.DroppedEvents)
+
+	writeHeader(w, "goretro_data_rejected_total", "counter", "Number of client payloads rejected because a listener was lagging behind or missing.")
+	fmt.Fprintf(w, "goretro_data_rejected_total %d\n", connStats.RejectedData)
+
+	writeHeader(w, "goretro_data_duplicate_total", "counter", "Number of client payloads ignored because their idempotency key was already used.")
+	fmt.Fprintf(w, "goretro_data_duplicate_total %d\n", connStats.DuplicateData)
+
+	roomsByState := make(map[string]int, len(retroStats.RoomsByState))
+	for state, count := range retroStats.RoomsByState {
+		roomsByState[state.String()] = count
+	}
+
+	writeHeader(w, "goretro_rooms", "gauge", "Current number of rooms, by state.")
+	for _, state := range sortedKeys(roomsByState) {
+		fmt.Fprintf(w, "goretro_rooms{state=%q} %d\n", state, roomsByState[state])
+	}
+
+	writeHeader(w, "goretro_participants", "gauge", "Current number of participants across all rooms.")
+	fmt.Fprintf(w, "goretro_participants %d\n", retroStats.Participants)
+
+	commands := append([]retro.CommandStats{}, retroStats.Commands...)
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].Name != commands[j].Name {
+			return commands[i].Name < commands[j].Name
+		}
+
+		return commands[i].Outcome < commands[j].Outcome
+	})
+
+	writeHeader(w, "goretro_commands_total", "counter", "Number of commands handled, by name and outcome.")
+	for _, c := range commands {
+		fmt.Fprintf(w, "goretro_commands_total{command=%q,outcome=%q} %d\n", c.Name, c.Outcome, c.Count)
+	}
+
+	writeHeader(w, "goretro_command_duration_seconds", "summary", "Time spent handling commands, by name and outcome.")
+	for _, c := range commands {
+		fmt.Fprintf(w, "goretro_command_duration_seconds_sum{command=%q,outcome=%q} %g\n", c.Name, c.Outcome, c.TotalDuration.Seconds())
+		fmt.Fprintf(w, "goretro_command_duration_seconds_count{command=%q,outcome=%q} %d\n", c.Name, c.Outcome, c.Count)
+	}
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	connStats := sseconn.Stats{
+		ConnectionsByState: map[string]int{"hello-received": 1, "events-open": 3, "events-paused": 0},
+		Streams:            4,
+		ExpiredConnections: 5,
+		DroppedEvents:      6,
+		RejectedData:       7,
+		DuplicateData:      8,
+	}
+
+	retroStats := retro.Stats{
+		RoomsByState: map[retro.State]int{retro.WaitingForParticipants: 1, retro.Running: 2},
+		Participants: 9,
+		Commands: []retro.CommandStats{
+			{Name: "save-note", Outcome: retro.CommandOutcomeOK, Count: 10, TotalDuration: 500 * time.Millisecond},
+			{Name: "create-room", Outcome: retro.CommandOutcomeError, Count: 1, TotalDuration: time.Millisecond},
+			{Name: "create-room", Outcome: retro.CommandOutcomeOK, Count: 2, TotalDuration: 3 * time.Second},
+		},
+	}
+
+	var out strings.Builder
+	writeMetrics(&out, connStats, retroStats)
+
+	expected := `# HELP goretro_connections Current number of client connections, by state.
+# TYPE goretro_connections gauge
+goretro_connections{state="events-open"} 3
+goretro_connections{state="events-paused"} 0
+goretro_connections{state="hello-received"} 1
+# HELP goretro_event_streams Current number of open event streams.
+# TYPE goretro_event_streams gauge
+goretro_event_streams 4
+# HELP goretro_connections_expired_total Number of paused connections closed after their TTL expired.
+# TYPE goretro_connections_expired_total counter
+goretro_connections_expired_total 5
+# HELP goretro_events_dropped_total Number of events dropped because the client's event buffer was full.
+# TYPE goretro_events_dropped_total counter
+goretro_events_dropped_total 6
+# HELP goretro_data_rejected_total Number of client payloads rejected because a listener was lagging behind or missing.
+# TYPE goretro_data_rejected_total counter
+goretro_data_rejected_total 7
+# HELP goretro_data_duplicate_total Number of client payloads ignored because their idempotency key was already used.
+# TYPE goretro_data_duplicate_total counter
+goretro_data_duplicate_total 8
+# HELP goretro_rooms Current number of rooms, by state.
+# TYPE goretro_rooms gauge
+goretro_rooms{state="running"} 2
+goretro_rooms{state="waiting-for-participants"} 1
+# HELP goretro_participants Current number of participants across all rooms.
+# TYPE goretro_participants gauge
+goretro_participants 9
+# HELP goretro_commands_total Number of commands handled, by name and outcome.
+# TYPE goretro_commands_total counter
+goretro_commands_total{command="create-room",outcome="error"} 1
+goretro_commands_total{command="create-room",outcome="ok"} 2
+goretro_commands_total{command="save-note",outcome="ok"} 10
+# HELP goretro_command_duration_seconds Time spent handling commands, by name and outcome.
+# TYPE goretro_command_duration_seconds summary
+goretro_command_duration_seconds_sum{command="create-room",outcome="error"} 0.001
+goretro_command_duration_seconds_count{command="create-room",outcome="error"} 1
+goretro_command_duration_seconds_sum{command="create-room",outcome="ok"} 3
+goretro_command_duration_seconds_count{command="create-room",outcome="ok"} 2
+goretro_command_duration_seconds_sum{command="save-note",outcome="ok"} 0.5
+goretro_command_duration_seconds_count{command="save-note",outcome="ok"} 10
+`
+
+	if out.String() != expected {
+		t.Errorf("unexpected metrics, expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
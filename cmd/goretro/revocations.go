@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/abustany/goretro/broker"
+	"github.com/abustany/goretro/sseconn"
+)
+
+const revokedOwner = "revoked"
+
+// revocationsCacheTTL is how long a replica remembers whether a client is
+// revoked before asking the broker again. Clients revoked on another replica
+// can keep using a replica that checked them recently for that long.
+const revocationsCacheTTL = 5 * time.Second
+
+// brokerRevocations shares the revoked clients between the replicas, as keys
+// of the broker that expire with the credentials of the clients. Lookups are
+// cached for revocationsCacheTTL, since every command checks its client.
+type brokerRevocations struct {
+	broker broker.Broker
+
+	lock      sync.Mutex
+	cache     map[sseconn.ClientID]cachedRevocation
+	lastPrune time.Time
+}
+
+type cachedRevocation struct {
+	revoked   bool
+	expiresAt time.Time
+}
+
+func newBrokerRevocations(b broker.Broker) *brokerRevocations {
+	return &brokerRevocations{
+		broker: b,
+		cache:  map[sseconn.ClientID]cachedRevocation{},
+	}
+}
+
+func revokedKey(clientID sseconn.ClientID) string {
+	return "revoked/" + clientID.String()
+}
+
+func (r *brokerRevocations) Revoke(clientID sseconn.ClientID, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if _, err := r.broker.Claim(revokedKey(clientID), revokedOwner, ttl); err != nil {
+		return err
+	}
+
+	r.remember(clientID, true, time.Now())
+
+	return nil
+}
+
+func (r *brokerRevocations) Revoked(clientID sseconn.ClientID) (bool, error) {
+	now := time.Now()
+
+	r.lock.Lock()
+	cached, ok := r.cache[clientID]
+	r.lock.Unlock()
+
+	if ok && now.Before(cached.expiresAt) {
+		return cached.revoked, nil
+	}
+
+	owner, err := r.broker.Owner(revokedKey(clientID))
+	if err != nil {
+		return false, err
+	}
+
+	r.remember(clientID, owner != "", now)
+
+	return owner != "", nil
+}
+
+func (r *brokerRevocations) remember(clientID sseconn.ClientID, revoked bool, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if now.Sub(r.lastPrune) >= revocationsCacheTTL {
+		for id, cached := range r.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(r.cache, id)
+			}
+		}
+
+		r.lastPrune = now
+	}
+
+	r.cache[clientID] = cachedRevocation{revoked: revoked, expiresAt: now.Add(revocationsCacheTTL)}
+}
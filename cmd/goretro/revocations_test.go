@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abustany/goretro/broker"
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+func TestBrokerRevocations(t *testing.T) {
+	b := broker.NewMemory()
+	defer b.Close()
+
+	// two replicas sharing the same credentials key and broker
+	newReplica := func() (*sseconn.Handler, *httptest.Server) {
+		handler := sseconn.NewHandler(apiPrefix, sseconn.Options{
+			Logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+			CredentialsKey:     []byte("credentials-key"),
+			Revocations:        newBrokerRevocations(b),
+			MaxProtocolVersion: retro.ProtocolVersion,
+		})
+
+		return handler, httptest.NewServer(handler)
+	}
+
+	handlerA, serverA := newReplica()
+	defer handlerA.Close()
+	defer serverA.Close()
+
+	handlerB, serverB := newReplica()
+	defer handlerB.Close()
+	defer serverB.Close()
+
+	client := connectTestClient(t, serverA.URL)
+
+	if err := handlerA.RevokeClient(client.clientID); err != nil {
+		t.Fatalf("error revoking client: %s", err)
+	}
+
+	// the client moving to the other replica is rejected there too
+	clientB := &testClient{apiURL: serverB.URL + apiPrefix, clientID: client.clientID, secret: client.secret}
+	hello := map[string]interface{}{"name": "hello", "clientId": client.clientID.String(), "secret": client.secret, "protocolVersion": retro.ProtocolVersion}
+
+	if res := clientB.post(t, "command", hello); res.StatusCode == http.StatusOK {
+		t.Errorf("expected hello of a revoked client to fail on another replica")
+	}
+}
+
+// countingBroker counts the lookups of key owners.
+type countingBroker struct {
+	broker.Broker
+	owners int
+}
+
+func (b *countingBroker) Owner(key string) (string, error) {
+	b.owners++
+	return b.Broker.Owner(key)
+}
+
+func TestBrokerRevocationsCache(t *testing.T) {
+	b := &countingBroker{Broker: broker.NewMemory()}
+	defer b.Close()
+
+	revocations := newBrokerRevocations(b)
+	clientID := sseconn.ClientID{1}
+
+	for i := 0; i < 3; i++ {
+		if revoked, err := revocations.Revoked(clientID); err != nil || revoked {
+			t.Fatalf("expected client not to be revoked, got %v (error: %v)", revoked, err)
+		}
+	}
+
+	if b.owners != 1 {
+		t.Errorf("expected the broker to be asked once, got %d lookups", b.owners)
+	}
+
+	// revoking the client on this replica replaces the cached answer
+	if err := revocations.Revoke(clientID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("error revoking client: %s", err)
+	}
+
+	if revoked, err := revocations.Revoked(clientID); err != nil || !revoked {
+		t.Errorf("expected client to be revoked, got %v (error: %v)", revoked, err)
+	}
+
+	if b.owners != 1 {
+		t.Errorf("expected the revocation to be answered from the cache, got %d lookups", b.owners)
+	}
+}
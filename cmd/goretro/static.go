@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	indexFile = "index.html"
+
+	// files under static/ have a content hash in their name, see
+	// https://create-react-app.dev/docs/production-build/#static-file-caching
+	immutablePrefix        = "static/"
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+)
+
+// staticHandler serves the files of fsys. Requests for paths that don't match
+// any file and don't look like a file name get index.html, so that the UI can
+// handle its own routes.
+func staticHandler(fsys fs.FS) http.Handler {
+	fileServer := http.FileServer(http.FS(fsys))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+		if name != "" {
+			_, err := fs.Stat(fsys, name)
+
+			switch {
+			case errors.Is(err, fs.ErrNotExist) && path.Ext(name) == "":
+				// SPA fallback, serve the index from the root
+				r2 := r.Clone(r.Context())
+				r2.URL.Path = "/"
+				r = r2
+				name = ""
+			case err != nil:
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		if strings.HasPrefix(name, immutablePrefix) {
+			w.Header().Set("Cache-Control", immutableCacheControl)
+		} else {
+			w.Header().Set("Cache-Control", revalidateCacheControl)
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticHandler(t *testing.T) {
+	handler := staticHandler(fstest.MapFS{
+		"index.html":            {Data: []byte("index")},
+		"manifest.json":         {Data: []byte("manifest")},
+		"static/js/main.abc.js": {Data: []byte("main")},
+	})
+
+	for _, tc := range []struct {
+		Name         string
+		Path         string
+		Code         int
+		Body         string
+		CacheControl string
+	}{
+		{"index", "/", http.StatusOK, "index", revalidateCacheControl},
+		{"regular file", "/manifest.json", http.StatusOK, "manifest", revalidateCacheControl},
+		{"hashed file", "/static/js/main.abc.js", http.StatusOK, "main", immutableCacheControl},
+		{"UI route falls back to index", "/room/some-id", http.StatusOK, "index", revalidateCacheControl},
+		{"missing file", "/missing.js", http.StatusNotFound, "", ""},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", tc.Path, nil))
+			res := rec.Result()
+			body, _ := io.ReadAll(res.Body)
+
+			if res.StatusCode != tc.Code {
+				t.Fatalf("expected status %d, got %d", tc.Code, res.StatusCode)
+			}
+
+			if tc.Code != http.StatusOK {
+				return
+			}
+
+			if string(body) != tc.Body {
+				t.Errorf("expected body %q, got %q", tc.Body, string(body))
+			}
+
+			if cacheControl := res.Header.Get("Cache-Control"); cacheControl != tc.CacheControl {
+				t.Errorf("expected Cache-Control %q, got %q", tc.CacheControl, cacheControl)
+			}
+		})
+	}
+}
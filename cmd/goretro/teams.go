@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abustany/goretro/history"
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+const teamsPrefix = apiPrefix + "teams"
+
+type createTeamRequest struct {
+	Name string `json:"name"`
+}
+
+// teamsHandler serves the team API, used to create teams and to look back at
+// their completed retros. Cross origin requests are subject to the same policy
+// as the rest of the API served by connections.
+//
+// Routes:
+// - POST /api/teams with {"name": "..."} creates a team
+// - GET /api/teams/{id} returns a team
+// - GET /api/teams/{id}/retros lists the completed retros of a team, oldest first
+func teamsHandler(logger *slog.Logger, manager *retro.Manager, connections *sseconn.Handler) http.Handler {
+	router := mux.NewRouter().PathPrefix(teamsPrefix).Subrouter()
+
+	router.Methods("POST").Path("").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req createTeamRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		team, err := manager.CreateTeam(req.Name)
+		if err != nil {
+			writeTeamError(logger, w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Location", teamsPrefix+"/"+team.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(team)
+	})
+
+	router.Methods("GET").Path("/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		team, err := manager.Team(mux.Vars(r)["id"])
+		if err != nil {
+			writeTeamError(logger, w, err)
+			return
+		}
+
+		writeJSON(w, team)
+	})
+
+	router.Methods("GET").Path("/{id}/retros").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		retros, err := manager.TeamRetros(mux.Vars(r)["id"])
+		if err != nil {
+			writeTeamError(logger, w, err)
+			return
+		}
+
+		writeJSON(w, retros)
+	})
+
+	return connections.CheckOrigin(router, "GET", "POST")
+}
+
+func writeTeamError(logger *slog.Logger, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, retro.ErrInvalidTeamName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, history.ErrTeamNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		logger.Error("error handling team request", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/abustany/goretro/history"
+	"github.com/abustany/goretro/retro"
+	"github.com/abustany/goretro/sseconn"
+)
+
+func TestTeamsHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	connHandler := sseconn.NewHandler(apiPrefix, sseconn.Options{
+		Logger:             logger,
+		MaxProtocolVersion: retro.ProtocolVersion,
+		AllowedOrigins:     []string{"http://allowed.example"},
+	})
+	defer connHandler.Close()
+
+	manager, err := retro.NewManager(connHandler, retro.Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	handler := teamsHandler(logger, manager, connHandler)
+
+	serveFrom := func(origin, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		return serveFrom("", method, path, body)
+	}
+
+	t.Run("cross origin requests are checked", func(t *testing.T) {
+		if rec := serveFrom("http://evil.example", "POST", teamsPrefix, `{"name": "Team"}`); rec.Code != http.StatusForbidden {
+			t.Errorf("expected status 403 from another origin, got %d", rec.Code)
+		}
+
+		rec := serveFrom("http://allowed.example", "OPTIONS", teamsPrefix, "")
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("expected status 204 for a preflight request, got %d", rec.Code)
+		}
+
+		if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "http://allowed.example" {
+			t.Errorf("expected the allowed origin in the CORS headers, got %q", origin)
+		}
+	})
+
+	t.Run("teams need a name", func(t *testing.T) {
+		if rec := serve("POST", teamsPrefix, `{"name": ""}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("unknown teams are not found", func(t *testing.T) {
+		for _, path := range []string{teamsPrefix + "/unknown", teamsPrefix + "/unknown/retros"} {
+			if rec := serve("GET", path, ""); rec.Code != http.StatusNotFound {
+				t.Errorf("expected status 404 for %s, got %d", path, rec.Code)
+			}
+		}
+	})
+
+	rec := serve("POST", teamsPrefix, `{"name": "Team"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", rec.Code)
+	}
+
+	var team history.Team
+	if err := json.NewDecoder(rec.Body).Decode(&team); err != nil {
+		t.Fatalf("error decoding team: %s", err)
+	}
+
+	if team.Name != "Team" || team.ID == "" {
+		t.Fatalf("unexpected team %+v", team)
+	}
+
+	t.Run("teams can be looked up", func(t *testing.T) {
+		rec := serve("GET", teamsPrefix+"/"+team.ID, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+
+		var actual history.Team
+		if err := json.NewDecoder(rec.Body).Decode(&actual); err != nil {
+			t.Fatalf("error decoding team: %s", err)
+		}
+
+		if actual.ID != team.ID || actual.Name != team.Name {
+			t.Errorf("expected team %+v, got %+v", team, actual)
+		}
+	})
+
+	t.Run("new teams have no retros", func(t *testing.T) {
+		rec := serve("GET", teamsPrefix+"/"+team.ID+"/retros", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+
+		if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+			t.Errorf("expected no retros, got %s", body)
+		}
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	config, err := newTLSConfig("", "", true, "example.com:443")
+	if err != nil {
+		t.Fatalf("error generating TLS config: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+
+	if err := cert.VerifyHostname("example.com"); err != nil {
+		t.Errorf("certificate is not valid for the listen host: %s", err)
+	}
+
+	if err := cert.VerifyHostname("localhost"); err != nil {
+		t.Errorf("certificate is not valid for localhost: %s", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build embedui
+
+// Package debugui gives access to the debug UI files when the binary is built
+// with the embedui build tag.
+package debugui
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed index.html main.js
+var files embed.FS
+
+// FS returns the debug UI files, or nil if they were not embedded.
+func FS() fs.FS {
+	return files
+}
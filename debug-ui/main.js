@@ -17,19 +17,30 @@ function log(msg) {
 function main() {
     log('Starting up');
 
-    const clientId = generateID(16);
-    const secret = generateID(64)
-    log('Client ID is ' + clientId);
+    getCredentials().
+        then(({clientId, secret}) => {
+            log('Client ID is ' + clientId);
 
-    identifyButton.addEventListener('click', () => onIdentify(clientId, secret));
-    createRoomButton.addEventListener('click', () => onCreateRoom(clientId, secret));
-    joinRoomButton.addEventListener('click', () => onJoinRoom(clientId, secret));
+            identifyButton.addEventListener('click', () => onIdentify(clientId, secret));
+            createRoomButton.addEventListener('click', () => onCreateRoom(clientId, secret));
+            joinRoomButton.addEventListener('click', () => onJoinRoom(clientId, secret));
 
-    rawCommand({name: 'hello', clientId: clientId, secret: secret}).
-        then(res => connected(clientId, res.eventsUrl)).
+            return rawCommand({name: 'hello', clientId: clientId, secret: secret}).
+                then(res => connected(clientId, res.eventsUrl));
+        }).
         catch(err => log('Error while connecting: ' + err.message));
 }
 
+function getCredentials() {
+    return fetch('/api/credentials', {method: 'POST'}).then(res => {
+        if (res.status !== 200) {
+            throw new Error('Unexpected status code: ' + res.status);
+        }
+
+        return res.json()
+    });
+}
+
 function rawCommand(command) {
     return fetch('/api/command', {
         method: 'POST',
@@ -95,10 +106,4 @@ function onJoinRoom(clientId, secret) {
     dataCommand(clientId, secret, {name: 'join-room', roomId: roomNameInput.value});
 }
 
-function generateID(length) {
-    const data = new Uint8Array(length);
-    window.crypto.getRandomValues(data);
-    return btoa(String.fromCharCode.apply(null, data)).replace(/\+/g, '-').replace(/\//g, '_');
-}
-
 window.onload = main;
@@ -0,0 +1,10 @@
+//go:build !embedui
+
+package debugui
+
+import "io/fs"
+
+// FS returns the debug UI files, or nil if they were not embedded.
+func FS() fs.FS {
+	return nil
+}
@@ -1,9 +1,24 @@
 module github.com/abustany/goretro
 
-go 1.13
+go 1.21
 
 require (
-	github.com/google/go-cmp v0.4.0
+	github.com/alicebob/miniredis/v2 v2.31.1
+	github.com/coreos/go-oidc/v3 v3.9.0
+	github.com/go-jose/go-jose/v3 v3.0.1
+	github.com/google/go-cmp v0.5.9
 	github.com/gorilla/mux v1.7.4
-	gopkg.in/square/go-jose.v2 v2.5.0
+	github.com/redis/go-redis/v9 v9.5.1
+	golang.org/x/oauth2 v0.15.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -0,0 +1,75 @@
+// Package history stores the teams and the retros they completed, so that
+// teams can look back at their previous retros.
+package history
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrTeamNotFound  = errors.New("team not found")
+	ErrRetroNotFound = errors.New("retro not found")
+)
+
+type Store interface {
+	// CreateTeam saves a new team. Team IDs are chosen by the caller.
+	CreateTeam(team Team) error
+
+	// Team returns the team with the given ID, or ErrTeamNotFound.
+	Team(id string) (Team, error)
+
+	// SaveRetro appends a completed retro to the history of its team.
+	SaveRetro(retro Retro) error
+
+	// Retros returns the completed retros of a team, oldest first. It returns
+	// ErrTeamNotFound if the team does not exist.
+	Retros(teamID string) ([]Retro, error)
+
+	// Retro returns the completed retro with the given ID, or
+	// ErrRetroNotFound.
+	Retro(id string) (Retro, error)
+
+	Close() error
+}
+
+// Team is a group of people running retros together over time.
+type Team struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Retro is the record of a completed retro.
+type Retro struct {
+	ID           string       `json:"id"`
+	TeamID       string       `json:"teamId"`
+	Name         string       `json:"name"`
+	CreatedAt    time.Time    `json:"createdAt"`
+	ClosedAt     time.Time    `json:"closedAt"`
+	Participants []string     `json:"participants"` // names
+	Notes        []Note       `json:"notes"`
+	ActionItems  []ActionItem `json:"actionItems"`
+
+	// CheckIns summarizes the check-in phase of the retro, if it had one.
+	CheckIns *CheckInSummary `json:"checkIns,omitempty"`
+}
+
+// CheckInSummary aggregates the answers of the participants to the check-in,
+// without telling who answered what.
+type CheckInSummary struct {
+	Count        int         `json:"count"`
+	AverageScore float64     `json:"averageScore,omitempty"` // of the score answers
+	ScoreCounts  map[int]int `json:"scoreCounts"`            // number of answers by score
+	Words        []string    `json:"words"`                  // sorted
+}
+
+type Note struct {
+	Text string `json:"text"`
+	Mood int    `json:"mood"`
+}
+
+type ActionItem struct {
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+}
@@ -0,0 +1,125 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMemory(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemory()
+	})
+}
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	testStore(t, func(t *testing.T) Store {
+		server.FlushAll()
+
+		s, err := NewRedis(server.Addr())
+		if err != nil {
+			t.Fatalf("error creating Redis store: %s", err)
+		}
+
+		return s
+	})
+}
+
+func checkEqual(t *testing.T, expected, actual interface{}) {
+	t.Helper()
+
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatalf("values do not match\nexpected: %+v\nactual:   %+v\ndiff: %s", expected, actual, diff)
+	}
+}
+
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	// Redis only keeps the times with a nanosecond precision, without the
+	// monotonic clock reading
+	now := time.Now().UTC().Round(0)
+
+	t.Run("teams", func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+
+		if _, err := s.Team("missing"); err != ErrTeamNotFound {
+			t.Errorf("expected ErrTeamNotFound, got %v", err)
+		}
+
+		team := Team{ID: "team", Name: "Team", CreatedAt: now}
+		if err := s.CreateTeam(team); err != nil {
+			t.Fatalf("error creating team: %s", err)
+		}
+
+		actual, err := s.Team("team")
+		if err != nil {
+			t.Fatalf("error getting team: %s", err)
+		}
+
+		checkEqual(t, team, actual)
+	})
+
+	t.Run("retros", func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+
+		if _, err := s.Retros("missing"); err != ErrTeamNotFound {
+			t.Errorf("expected ErrTeamNotFound, got %v", err)
+		}
+
+		if err := s.SaveRetro(Retro{ID: "retro", TeamID: "missing"}); err != ErrTeamNotFound {
+			t.Errorf("expected ErrTeamNotFound, got %v", err)
+		}
+
+		if err := s.CreateTeam(Team{ID: "team", Name: "Team", CreatedAt: now}); err != nil {
+			t.Fatalf("error creating team: %s", err)
+		}
+
+		retros, err := s.Retros("team")
+		if err != nil {
+			t.Fatalf("error listing retros: %s", err)
+		}
+
+		checkEqual(t, []Retro{}, retros)
+
+		first := Retro{
+			ID:           "first",
+			TeamID:       "team",
+			Name:         "Sprint 1",
+			CreatedAt:    now,
+			ClosedAt:     now.Add(time.Hour),
+			Participants: []string{"Alice", "Bob"},
+			Notes:        []Note{{Text: "Good", Mood: 1}},
+			ActionItems:  []ActionItem{{Text: "Do better"}},
+		}
+		second := Retro{ID: "second", TeamID: "team", Name: "Sprint 2", CreatedAt: now, ClosedAt: now}
+
+		for _, retro := range []Retro{first, second} {
+			if err := s.SaveRetro(retro); err != nil {
+				t.Fatalf("error saving retro: %s", err)
+			}
+		}
+
+		retros, err = s.Retros("team")
+		if err != nil {
+			t.Fatalf("error listing retros: %s", err)
+		}
+
+		checkEqual(t, []Retro{first, second}, retros)
+
+		if _, err := s.Retro("missing"); err != ErrRetroNotFound {
+			t.Errorf("expected ErrRetroNotFound, got %v", err)
+		}
+
+		retro, err := s.Retro("first")
+		if err != nil {
+			t.Fatalf("error getting retro: %s", err)
+		}
+
+		checkEqual(t, first, retro)
+	})
+}
@@ -0,0 +1,82 @@
+package history
+
+import "sync"
+
+// Memory is a Store keeping the history in memory. The history is lost when
+// the process exits.
+type Memory struct {
+	lock   sync.RWMutex
+	teams  map[string]Team
+	retros map[string][]Retro // by team ID
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		teams:  map[string]Team{},
+		retros: map[string][]Retro{},
+	}
+}
+
+func (m *Memory) CreateTeam(team Team) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.teams[team.ID] = team
+
+	return nil
+}
+
+func (m *Memory) Team(id string) (Team, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	team, ok := m.teams[id]
+	if !ok {
+		return Team{}, ErrTeamNotFound
+	}
+
+	return team, nil
+}
+
+func (m *Memory) SaveRetro(retro Retro) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.teams[retro.TeamID]; !ok {
+		return ErrTeamNotFound
+	}
+
+	m.retros[retro.TeamID] = append(m.retros[retro.TeamID], retro)
+
+	return nil
+}
+
+func (m *Memory) Retros(teamID string) ([]Retro, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if _, ok := m.teams[teamID]; !ok {
+		return nil, ErrTeamNotFound
+	}
+
+	return append([]Retro{}, m.retros[teamID]...), nil
+}
+
+func (m *Memory) Retro(id string) (Retro, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, retros := range m.retros {
+		for _, retro := range retros {
+			if retro.ID == id {
+				return retro, nil
+			}
+		}
+	}
+
+	return Retro{}, ErrRetroNotFound
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix namespaces the keys used by goretro in Redis.
+const keyPrefix = "goretro:"
+
+// Redis is a Store backed by a Redis (or Redis compatible) server, shared by
+// all the replicas using it. Teams are stored as JSON strings, and the retros
+// of a team as a list of JSON strings. Each retro is also stored on its own,
+// to look it up by ID.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis connects to the Redis server at addr (host:port).
+func NewRedis(addr string) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to Redis at %s: %w", addr, err)
+	}
+
+	return &Redis{client: client}, nil
+}
+
+func teamKey(id string) string {
+	return keyPrefix + "team/" + id
+}
+
+func retrosKey(teamID string) string {
+	return keyPrefix + "team/" + teamID + "/retros"
+}
+
+func retroKey(id string) string {
+	return keyPrefix + "retro/" + id
+}
+
+func (r *Redis) CreateTeam(team Team) error {
+	data, err := json.Marshal(team)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Set(context.Background(), teamKey(team.ID), data, 0).Err()
+}
+
+func (r *Redis) Team(id string) (Team, error) {
+	data, err := r.client.Get(context.Background(), teamKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Team{}, ErrTeamNotFound
+	} else if err != nil {
+		return Team{}, err
+	}
+
+	var team Team
+	if err := json.Unmarshal(data, &team); err != nil {
+		return Team{}, fmt.Errorf("error decoding team %s: %w", id, err)
+	}
+
+	return team, nil
+}
+
+func (r *Redis) SaveRetro(retro Retro) error {
+	if _, err := r.Team(retro.TeamID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(retro)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.RPush(context.Background(), retrosKey(retro.TeamID), data)
+		pipe.Set(context.Background(), retroKey(retro.ID), data, 0)
+		return nil
+	})
+
+	return err
+}
+
+func (r *Redis) Retro(id string) (Retro, error) {
+	data, err := r.client.Get(context.Background(), retroKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Retro{}, ErrRetroNotFound
+	} else if err != nil {
+		return Retro{}, err
+	}
+
+	var retro Retro
+	if err := json.Unmarshal(data, &retro); err != nil {
+		return Retro{}, fmt.Errorf("error decoding retro %s: %w", id, err)
+	}
+
+	return retro, nil
+}
+
+func (r *Redis) Retros(teamID string) ([]Retro, error) {
+	if _, err := r.Team(teamID); err != nil {
+		return nil, err
+	}
+
+	items, err := r.client.LRange(context.Background(), retrosKey(teamID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	retros := make([]Retro, 0, len(items))
+
+	for _, item := range items {
+		var retro Retro
+		if err := json.Unmarshal([]byte(item), &retro); err != nil {
+			return nil, fmt.Errorf("error decoding retro of team %s: %w", teamID, err)
+		}
+
+		retros = append(retros, retro)
+	}
+
+	return retros, nil
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,38 @@
+package retro
+
+import "github.com/abustany/goretro/history"
+
+// ActionItem is something the team agreed to do after the retro.
+type ActionItem struct {
+	ID   uint   `json:"id"`
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+
+	// CarriedOver is set on the action items imported from a previous retro.
+	CarriedOver bool `json:"carriedOver,omitempty"`
+}
+
+// firstCarriedOverActionItemID is the ID of the first action item carried over
+// from a previous retro. The IDs of the action items created by clients must
+// stay below it, so that they never collide with the carried over ones.
+const firstCarriedOverActionItemID = 1 << 31
+
+// carryOverActionItems returns the action items of previous that are not
+// done yet.
+func carryOverActionItems(previous history.Retro) []ActionItem {
+	var actionItems []ActionItem
+
+	for _, a := range previous.ActionItems {
+		if a.Done {
+			continue
+		}
+
+		actionItems = append(actionItems, ActionItem{
+			ID:          firstCarriedOverActionItemID + uint(len(actionItems)),
+			Text:        a.Text,
+			CarriedOver: true,
+		})
+	}
+
+	return actionItems
+}
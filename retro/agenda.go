@@ -0,0 +1,167 @@
+package retro
+
+import (
+	"fmt"
+
+	"github.com/abustany/goretro/sseconn"
+)
+
+// phase describes what participants can do during a step of a retro.
+type phase struct {
+	name         string          // used in the agenda of create-room
+	commands     map[string]bool // commands only allowed during this phase
+	notesVisible bool            // whether participants see the notes of the others
+}
+
+var phases = map[State]phase{
+	WaitingForParticipants: {name: "waiting"},
+	CheckingIn: {
+		name:     "check-in",
+		commands: map[string]bool{checkInCommandName: true, revealCheckInsCommandName: true},
+	},
+	ReviewingActionItems: {
+		name:     "review",
+		commands: map[string]bool{saveActionItemCommandName: true},
+	},
+	Running: {
+		name:     "write",
+		commands: map[string]bool{saveNoteCommentName: true, setFinishedWritingName: true},
+	},
+	Grouping: {
+		name:         "group",
+		commands:     map[string]bool{groupNoteCommandName: true},
+		notesVisible: true,
+	},
+	Voting: {
+		name:         "vote",
+		commands:     map[string]bool{voteCommandName: true},
+		notesVisible: true,
+	},
+	Discussing: {name: "discuss", notesVisible: true}, // notes are read-only
+	ActionPoints: {
+		name:         "actions",
+		commands:     map[string]bool{saveActionItemCommandName: true},
+		notesVisible: true,
+	},
+	Closing: {
+		name:         "close",
+		commands:     map[string]bool{closeRoomCommandName: true},
+		notesVisible: true,
+	},
+}
+
+// defaultAgenda returns the agenda of the rooms created without one.
+func defaultAgenda(checkIn, carriedOverActionItems bool) []State {
+	var agenda []State
+
+	if checkIn {
+		agenda = append(agenda, CheckingIn)
+	}
+
+	if carriedOverActionItems {
+		agenda = append(agenda, ReviewingActionItems)
+	}
+
+	return append(agenda, Running, ActionPoints)
+}
+
+// parseAgenda converts the phase names of a create-room command into states.
+func parseAgenda(names []string) ([]State, error) {
+	agenda := make([]State, 0, len(names))
+	seen := map[State]bool{}
+
+	for _, name := range names {
+		state, ok := stateFromPhaseName(name)
+		if !ok || state == WaitingForParticipants {
+			return nil, validationError{message: fmt.Sprintf("unknown phase %q", name)}
+		}
+
+		if seen[state] {
+			return nil, validationError{message: fmt.Sprintf("phase %q is in the agenda twice", name)}
+		}
+
+		seen[state] = true
+		agenda = append(agenda, state)
+	}
+
+	return agenda, nil
+}
+
+func stateFromPhaseName(name string) (State, bool) {
+	for state, p := range phases {
+		if p.name == name {
+			return state, true
+		}
+	}
+
+	return 0, false
+}
+
+// setAgenda sets the phases of the retro. It must be called before the retro
+// starts.
+func (r *Retro) setAgenda(agenda []State) {
+	r.agenda = agenda
+
+	for _, state := range agenda {
+		if state == CheckingIn {
+			r.checkIns = map[sseconn.ClientID]CheckIn{}
+		}
+	}
+}
+
+// allowsLocked returns true if commandName can be used in the current phase.
+func (r *Retro) allowsLocked(commandName string) bool {
+	return phases[r.state].commands[commandName]
+}
+
+// allowsClosingLocked returns true if the retro can be closed in the current
+// phase. Retros whose agenda has a close phase can only be closed during it,
+// the others can be closed at any time.
+func (r *Retro) allowsClosingLocked() bool {
+	for _, state := range r.agenda {
+		if state == Closing {
+			return r.allowsLocked(closeRoomCommandName)
+		}
+	}
+
+	return true
+}
+
+// phaseIndexLocked returns the position of the current phase in the agenda,
+// or -1 if the retro did not start yet.
+func (r *Retro) phaseIndexLocked() int {
+	for i, state := range r.agenda {
+		if state == r.state {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// NextPhase moves the retro to the next phase of its agenda.
+func (r *Retro) NextPhase(clientID sseconn.ClientID) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	i := r.phaseIndexLocked()
+	if clientID != r.hostID || i+1 >= len(r.agenda) {
+		return nil
+	}
+
+	return r.setStateLocked(r.agenda[i+1])
+}
+
+// PreviousPhase moves the retro back to the previous phase of its agenda. A
+// retro never goes back to WaitingForParticipants.
+func (r *Retro) PreviousPhase(clientID sseconn.ClientID) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	i := r.phaseIndexLocked()
+	if clientID != r.hostID || i <= 0 {
+		return nil
+	}
+
+	return r.setStateLocked(r.agenda[i-1])
+}
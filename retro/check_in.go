@@ -0,0 +1,197 @@
+package retro
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/abustany/goretro/history"
+	"github.com/abustany/goretro/sseconn"
+)
+
+const (
+	minCheckInScore      = 1
+	maxCheckInScore      = 5
+	maxCheckInWordLength = 30
+)
+
+// CheckIn is the answer of a participant to the check-in: either a score or a
+// single word.
+type CheckIn struct {
+	Score int    `json:"score,omitempty"`
+	Word  string `json:"word,omitempty"`
+}
+
+func (c CheckIn) validate() error {
+	switch {
+	case c.Score != 0 && c.Word != "":
+		return validationError{message: "a check-in is either a score or a word"}
+	case c.Word != "":
+		if strings.IndexFunc(c.Word, unicode.IsSpace) >= 0 {
+			return validationError{message: "a check-in is a single word"}
+		}
+
+		return validateLength("check-in", c.Word, maxCheckInWordLength)
+	case c.Score < minCheckInScore || c.Score > maxCheckInScore:
+		return validationError{message: fmt.Sprintf("check-in scores are between %d and %d", minCheckInScore, maxCheckInScore)}
+	default:
+		return nil
+	}
+}
+
+// CheckInResults is the state of the check-in as seen by a participant. Until
+// the results are revealed, participants only see their own answer and who
+// answered.
+type CheckInResults struct {
+	Revealed bool
+	Answered []sseconn.ClientID
+	CheckIns map[sseconn.ClientID]CheckIn
+	Summary  *history.CheckInSummary // only once revealed
+}
+
+// MarshalJSON replaces client IDs with participant IDs, like SerializedRetro.
+func (c CheckInResults) MarshalJSON() ([]byte, error) {
+	answered := make([]ParticipantID, 0, len(c.Answered))
+	for _, clientID := range c.Answered {
+		answered = append(answered, ParticipantIDOf(clientID))
+	}
+
+	checkIns := make(map[ParticipantID]CheckIn, len(c.CheckIns))
+	for clientID, checkIn := range c.CheckIns {
+		checkIns[ParticipantIDOf(clientID)] = checkIn
+	}
+
+	return json.Marshal(struct {
+		Revealed bool                      `json:"revealed"`
+		Answered []ParticipantID           `json:"answered"`
+		CheckIns map[ParticipantID]CheckIn `json:"checkIns"`
+		Summary  *history.CheckInSummary   `json:"summary,omitempty"`
+	}{
+		Revealed: c.Revealed,
+		Answered: answered,
+		CheckIns: checkIns,
+		Summary:  c.Summary,
+	})
+}
+
+func summarizeCheckIns(checkIns map[sseconn.ClientID]CheckIn) history.CheckInSummary {
+	summary := history.CheckInSummary{
+		Count:       len(checkIns),
+		ScoreCounts: map[int]int{},
+		Words:       []string{},
+	}
+
+	total, scores := 0, 0
+
+	for _, c := range checkIns {
+		if c.Word != "" {
+			summary.Words = append(summary.Words, c.Word)
+			continue
+		}
+
+		summary.ScoreCounts[c.Score]++
+		total += c.Score
+		scores++
+	}
+
+	if scores > 0 {
+		summary.AverageScore = float64(total) / float64(scores)
+	}
+
+	sort.Strings(summary.Words)
+
+	return summary
+}
+
+// CheckIn records the check-in of a participant. The results are revealed
+// once all participants checked in.
+func (r *Retro) CheckIn(clientID sseconn.ClientID, checkIn CheckIn) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowsLocked(checkInCommandName) || !r.hasParticipantLocked(clientID) {
+		return nil
+	}
+
+	r.checkIns[clientID] = checkIn
+
+	if r.allCheckedInLocked() {
+		r.checkInsRevealed = true
+	}
+
+	return r.checkInEventsLocked()
+}
+
+// RevealCheckIns lets the host reveal the check-in results before everybody
+// answered.
+func (r *Retro) RevealCheckIns(clientID sseconn.ClientID) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowsLocked(revealCheckInsCommandName) || clientID != r.hostID || r.checkInsRevealed {
+		return nil
+	}
+
+	r.checkInsRevealed = true
+
+	return r.checkInEventsLocked()
+}
+
+func (r *Retro) allCheckedInLocked() bool {
+	for _, p := range r.participants {
+		if _, ok := r.checkIns[p.ClientID]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Retro) checkInEventsLocked() []Event {
+	events := make([]Event, 0, len(r.participants))
+
+	for _, p := range r.participants {
+		events = append(events, Event{
+			Recipient: p.ClientID,
+			Name:      checkInsUpdatedEventName,
+			Payload:   r.checkInResultsLocked(p.ClientID),
+		})
+	}
+
+	return events
+}
+
+// checkInResultsLocked returns the check-in results as seen by clientID, or
+// nil if the retro has no check-in phase.
+func (r *Retro) checkInResultsLocked(clientID sseconn.ClientID) *CheckInResults {
+	if r.checkIns == nil {
+		return nil
+	}
+
+	results := &CheckInResults{
+		Revealed: r.checkInsRevealed,
+		Answered: make([]sseconn.ClientID, 0, len(r.checkIns)),
+		CheckIns: map[sseconn.ClientID]CheckIn{},
+	}
+
+	for _, p := range r.participants {
+		if _, ok := r.checkIns[p.ClientID]; ok {
+			results.Answered = append(results.Answered, p.ClientID)
+		}
+	}
+
+	if r.checkInsRevealed {
+		for id, checkIn := range r.checkIns {
+			results.CheckIns[id] = checkIn
+		}
+
+		summary := summarizeCheckIns(r.checkIns)
+		results.Summary = &summary
+	} else if checkIn, ok := r.checkIns[clientID]; ok {
+		results.CheckIns[clientID] = checkIn
+	}
+
+	return results
+}
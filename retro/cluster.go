@@ -0,0 +1,291 @@
+package retro
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/abustany/goretro/broker"
+	"github.com/abustany/goretro/sseconn"
+)
+
+// Rooms are owned by the replica on which they were created. Clients connected
+// to another replica get their commands forwarded to the owner over the
+// broker, and the owner sends back the events for those clients to the
+// replica they are connected to.
+//
+// The owner refreshes its claim on its rooms every third of
+// Options.RoomClaimTTL, so that the rooms of a replica that stopped can be
+// created again once their claim expired.
+//
+// Broker subjects and keys:
+// - room/{ID}: key holding the replica ID of the owner of a room
+// - room.{ID}: subject on which commands for a room are forwarded
+// - replica.{ID}: subject on which events for the clients of a replica are sent
+
+const (
+	forwardedCommandKind = "command"
+	forwardedLeaveKind   = "leave"
+)
+
+// forwardedMessage is sent by a replica to the owner of a room on behalf of
+// one of its clients.
+type forwardedMessage struct {
+	Kind            string           `json:"kind"`
+	Replica         string           `json:"replica"`
+	ClientID        sseconn.ClientID `json:"clientId"`
+	Nickname        string           `json:"nickname,omitempty"`
+	ProtocolVersion int              `json:"protocolVersion,omitempty"`
+	Data            json.RawMessage  `json:"data,omitempty"`
+}
+
+// forwardedEvent is sent by the owner of a room to the replica of a client.
+type forwardedEvent struct {
+	ClientID sseconn.ClientID     `json:"clientId"`
+	Name     string               `json:"name"`
+	Payload  json.RawMessage      `json:"payload,omitempty"`
+	Version  sseconn.EventVersion `json:"version"`
+}
+
+func roomOwnerKey(roomID sseconn.ClientID) string {
+	return "room/" + roomID.String()
+}
+
+func roomSubject(roomID sseconn.ClientID) string {
+	return "room." + roomID.String()
+}
+
+func replicaSubject(replicaID string) string {
+	return "replica." + replicaID
+}
+
+// listenReplicaEvents dispatches the events sent by other replicas to the
+// local clients.
+func (m *Manager) listenReplicaEvents() error {
+	sub, err := m.broker.Subscribe(replicaSubject(m.replicaID))
+	if err != nil {
+		return fmt.Errorf("error subscribing to replica events: %w", err)
+	}
+
+	go func() {
+		for data := range sub.Messages() {
+			var ev forwardedEvent
+			if err := json.Unmarshal(data, &ev); err != nil {
+				m.logger.Warn("invalid forwarded event", "data", string(data), "error", err)
+				continue
+			}
+
+			var payload interface{}
+			if len(ev.Payload) > 0 {
+				payload = ev.Payload
+			}
+
+			if err := m.connManager.SendVersioned(ev.ClientID, ev.Name, payload, ev.Version); err != nil {
+				m.logger.Warn("error dispatching forwarded event", "client_id", ev.ClientID, "event", ev.Name, "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// hostRoom registers this replica as the owner of a room, and subscribes to
+// the commands forwarded by other replicas for it. The caller handles them
+// with serveForwardedMessages once the room is registered. It talks to the
+// broker, and must not be called with lock held.
+func (m *Manager) hostRoom(roomID sseconn.ClientID) (broker.Subscription, error) {
+	owner, err := m.broker.Claim(roomOwnerKey(roomID), m.replicaID, m.options.RoomClaimTTL)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming room: %w", err)
+	}
+
+	if owner != m.replicaID {
+		return nil, fmt.Errorf("room %s is already owned by replica %s", roomID, owner)
+	}
+
+	sub, err := m.broker.Subscribe(roomSubject(roomID))
+	if err != nil {
+		m.broker.Release(roomOwnerKey(roomID), m.replicaID)
+		return nil, fmt.Errorf("error subscribing to room: %w", err)
+	}
+
+	return sub, nil
+}
+
+// refreshRoomClaims keeps the claims of this replica on the rooms it hosts
+// alive.
+func (m *Manager) refreshRoomClaims() {
+	ticker := time.NewTicker(m.options.RoomClaimTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.lock.RLock()
+		roomIDs := make([]sseconn.ClientID, 0, len(m.retros))
+		for roomID := range m.retros {
+			roomIDs = append(roomIDs, roomID)
+		}
+		m.lock.RUnlock()
+
+		for _, roomID := range roomIDs {
+			m.refreshRoomClaim(roomID)
+		}
+	}
+}
+
+// refreshRoomClaim extends the claim on a hosted room, claiming it again if
+// the claim expired in the meantime, for example while the broker was
+// unreachable.
+func (m *Manager) refreshRoomClaim(roomID sseconn.ClientID) {
+	refreshed, err := m.broker.Refresh(roomOwnerKey(roomID), m.replicaID, m.options.RoomClaimTTL)
+	if err != nil {
+		m.logger.Warn("error refreshing room claim", "room_id", roomID, "error", err)
+		return
+	}
+
+	if refreshed {
+		return
+	}
+
+	owner, err := m.broker.Claim(roomOwnerKey(roomID), m.replicaID, m.options.RoomClaimTTL)
+	if err != nil {
+		m.logger.Warn("error claiming room again", "room_id", roomID, "error", err)
+	} else if owner != m.replicaID {
+		m.logger.Error("room claimed by another replica", "room_id", roomID, "owner", owner)
+	} else {
+		m.logger.Warn("claimed room again after its claim expired", "room_id", roomID)
+	}
+}
+
+// serveForwardedMessages handles the commands forwarded for a room until sub
+// is unsubscribed.
+func (m *Manager) serveForwardedMessages(roomID sseconn.ClientID, sub broker.Subscription) {
+	go func() {
+		for data := range sub.Messages() {
+			m.handleForwardedMessage(roomID, data)
+		}
+	}()
+}
+
+// unhostRoom stops handling the commands forwarded for a room, and releases
+// its ownership. Like hostRoom, it must not be called with lock held.
+func (m *Manager) unhostRoom(roomID sseconn.ClientID, sub broker.Subscription) {
+	if sub != nil {
+		sub.Unsubscribe()
+	}
+
+	if err := m.broker.Release(roomOwnerKey(roomID), m.replicaID); err != nil {
+		m.logger.Warn("error releasing room", "room_id", roomID, "error", err)
+	}
+}
+
+// remoteRoomOwner returns the replica owning a room that is not hosted
+// locally.
+func (m *Manager) remoteRoomOwner(roomID sseconn.ClientID) (string, error) {
+	owner, err := m.broker.Owner(roomOwnerKey(roomID))
+	if err != nil {
+		return "", fmt.Errorf("error looking up room owner: %w", err)
+	}
+
+	if owner == "" || owner == m.replicaID {
+		return "", ErrRoomNotFound
+	}
+
+	return owner, nil
+}
+
+func (m *Manager) forward(roomID sseconn.ClientID, msg forwardedMessage) error {
+	msg.Replica = m.replicaID
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshaling forwarded message: %w", err)
+	}
+
+	return m.broker.Publish(roomSubject(roomID), data)
+}
+
+func (m *Manager) handleForwardedMessage(roomID sseconn.ClientID, data []byte) {
+	var msg forwardedMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		m.logger.Warn("invalid forwarded message", "room_id", roomID, "data", string(data), "error", err)
+		return
+	}
+
+	logger := m.logger.With("client_id", msg.ClientID, "room_id", roomID, "replica", msg.Replica)
+
+	switch msg.Kind {
+	case forwardedCommandKind:
+		m.remoteLock.Lock()
+		m.remoteClients[msg.ClientID] = msg.Replica
+		m.remoteLock.Unlock()
+
+		m.lock.Lock()
+		clientInfo := m.clientInfo[msg.ClientID]
+		if msg.Nickname != "" {
+			clientInfo.name = msg.Nickname
+		}
+		clientInfo.protocolVersion = msg.ProtocolVersion
+		m.clientInfo[msg.ClientID] = clientInfo
+		m.lock.Unlock()
+
+		var cmd command
+		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+			logger.Warn("error unmarshaling forwarded command", "data", string(msg.Data), "error", err)
+			return
+		}
+
+		if cmd.Name == createRoomCommandName {
+			logger.Warn("rooms cannot be created remotely")
+			return
+		}
+
+		m.routeCommand(logger, msg.ClientID, cmd.Name, msg.Data)
+	case forwardedLeaveKind:
+		logger.Info("remote client left")
+		m.handleDisconnect(msg.ClientID)
+
+		m.remoteLock.Lock()
+		delete(m.remoteClients, msg.ClientID)
+		m.remoteLock.Unlock()
+	default:
+		logger.Warn("unknown forwarded message kind", "kind", msg.Kind)
+	}
+}
+
+// sendRemote sends an event to a client connected to another replica. It
+// returns false if the client is connected to this replica.
+func (m *Manager) sendRemote(ev Event) (bool, error) {
+	m.remoteLock.RLock()
+	replica, remote := m.remoteClients[ev.Recipient]
+	m.remoteLock.RUnlock()
+
+	if !remote {
+		return false, nil
+	}
+
+	fwd := forwardedEvent{
+		ClientID: ev.Recipient,
+		Name:     ev.Name,
+		Version:  sseconn.EventVersion{Version: ev.Version, Previous: ev.PreviousVersion},
+	}
+
+	if ev.Payload != nil {
+		payload, err := json.Marshal(ev.Payload)
+		if err != nil {
+			return true, fmt.Errorf("error marshaling event payload: %w", err)
+		}
+
+		fwd.Payload = payload
+	}
+
+	data, err := json.Marshal(fwd)
+	if err != nil {
+		return true, fmt.Errorf("error marshaling forwarded event: %w", err)
+	}
+
+	if err := m.broker.Publish(replicaSubject(replica), data); err != nil {
+		return true, fmt.Errorf("error publishing forwarded event: %w", err)
+	}
+
+	return true, nil
+}
@@ -9,6 +9,20 @@ const createRoomCommandName = `create-room`
 type createRoomCommand struct {
 	command
 	RoomName string `json:"roomName"`
+	TeamID   string `json:"teamId,omitempty"` // optional
+
+	// PreviousRetroID optionally references a completed retro of the team
+	// whose unresolved action items are carried over. If unset and TeamID is
+	// set, the last retro of the team is used.
+	PreviousRetroID string `json:"previousRetroId,omitempty"`
+
+	// Agenda optionally lists the phases of the retro, in order (see
+	// phases). The default agenda is a writing phase followed by an action
+	// points phase, preceded by a check-in if CheckIn is set, and by a review
+	// of the carried over action items if there are any. CheckIn cannot be
+	// set together with an agenda.
+	Agenda  []string `json:"agenda,omitempty"`
+	CheckIn bool     `json:"checkIn,omitempty"`
 }
 
 const joinRoomCommandName = `join-room`
@@ -27,6 +41,10 @@ type identifyCommand struct {
 
 const setStateCommandName = `set-state`
 
+const nextPhaseCommandName = `next-phase`
+
+const previousPhaseCommandName = `previous-phase`
+
 type setStateCommand struct {
 	command
 	State uint `json:"state"`
@@ -36,9 +54,10 @@ const saveNoteCommentName = `save-note`
 
 type saveNoteCommand struct {
 	command
-	ID   uint   `json:"noteId"`
-	Text string `json:"text"`
-	Mood uint   `json:"mood"`
+	ID       uint   `json:"noteId"`
+	Revision uint   `json:"revision"` // revision the note was edited from, 0 for new notes
+	Text     string `json:"text"`
+	Mood     uint   `json:"mood"`
 }
 
 const setFinishedWritingName = `set-finished-writing`
@@ -47,3 +66,66 @@ type setFinishedWritingCommand struct {
 	command
 	Finished bool `json:"finished"`
 }
+
+const saveActionItemCommandName = `save-action-item`
+
+type saveActionItemCommand struct {
+	command
+
+	// ID is chosen by the client when creating an action item, and must be
+	// below 2^31 (higher IDs are used by carried over action items).
+	ID   uint   `json:"actionItemId"`
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+}
+
+const groupNoteCommandName = `group-note`
+
+type groupNoteCommand struct {
+	command
+	AuthorID ParticipantID `json:"authorId"`
+	NoteID   uint          `json:"noteId"`
+	Group    uint          `json:"group"` // 0 to remove the note from its group
+}
+
+const voteCommandName = `vote`
+
+type voteCommand struct {
+	command
+	AuthorID ParticipantID `json:"authorId"`
+	NoteID   uint          `json:"noteId"`
+	Vote     bool          `json:"vote"` // false to remove the vote
+}
+
+const closeRoomCommandName = `close-room`
+
+const checkInCommandName = `check-in`
+
+type checkInCommand struct {
+	command
+	CheckIn
+}
+
+const revealCheckInsCommandName = `reveal-check-ins`
+
+// the resync command asks for the current state of the room, after missing
+// some events (see stampEvents).
+const resyncCommandName = `resync`
+
+var knownCommandNames = map[string]bool{
+	createRoomCommandName:     true,
+	joinRoomCommandName:       true,
+	identifyCommandName:       true,
+	setStateCommandName:       true,
+	nextPhaseCommandName:      true,
+	previousPhaseCommandName:  true,
+	saveNoteCommentName:       true,
+	setFinishedWritingName:    true,
+	saveActionItemCommandName: true,
+	groupNoteCommandName:      true,
+	voteCommandName:           true,
+	closeRoomCommandName:      true,
+	checkInCommandName:        true,
+	revealCheckInsCommandName: true,
+	resyncCommandName:         true,
+}
@@ -6,6 +6,10 @@ type Event struct {
 	Recipient sseconn.ClientID
 	Name      string // type of the event
 	Payload   interface{}
+
+	// set by Retro.stampEvents
+	Version         uint64
+	PreviousVersion uint64
 }
 
 const (
@@ -15,4 +19,11 @@ const (
 	currentStateEventName       = "current-state"
 	hostChangedEventName        = "host-changed"
 	stateChangedEventName       = "state-changed"
+	roomClosedEventName         = "room-closed"
+	commandErrorEventName       = "command-error"
+	actionItemSavedEventName    = "action-item-saved"
+	checkInsUpdatedEventName    = "check-ins-updated"
+	noteSavedEventName          = "note-saved"
+	noteConflictEventName       = "note-conflict"
+	voteSavedEventName          = "vote-saved"
 )
@@ -0,0 +1,35 @@
+package retro
+
+import "github.com/abustany/goretro/sseconn"
+
+// GroupNote puts a note in a group, along with the other notes talking about
+// the same thing. Group 0 holds the notes that are not grouped. Any
+// participant can group notes, and everybody is sent the grouped note.
+func (r *Retro) GroupNote(clientID sseconn.ClientID, authorID ParticipantID, noteID uint, group uint) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowsLocked(groupNoteCommandName) || !r.hasParticipantLocked(clientID) {
+		return nil
+	}
+
+	ref, i, ok := r.findNoteLocked(authorID, noteID)
+	if !ok {
+		return nil
+	}
+
+	r.notes[ref.authorID][i].Group = group
+	note := r.notes[ref.authorID][i]
+
+	events := make([]Event, 0, len(r.participants))
+
+	for _, p := range r.participants {
+		events = append(events, Event{
+			Recipient: p.ClientID,
+			Name:      noteSavedEventName,
+			Payload:   note,
+		})
+	}
+
+	return events
+}
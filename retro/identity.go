@@ -0,0 +1,47 @@
+package retro
+
+import (
+	"encoding/json"
+
+	"github.com/abustany/goretro/sseconn"
+)
+
+var errNotAuthenticated = validationError{message: "authentication required"}
+
+// verifiedIdentifyCommand returns an identify command setting the nickname of
+// clientID to the name of its verified identity, ignoring the nickname the
+// client asked for. Rewriting the command before it is handled or forwarded
+// means replicas hosting the room never need to know about identities.
+func (m *Manager) verifiedIdentifyCommand(clientID sseconn.ClientID) (json.RawMessage, error) {
+	identity, ok := m.connManager.Identity(clientID)
+	if !ok {
+		return nil, errNotAuthenticated
+	}
+
+	return json.Marshal(identifyCommand{
+		command:  command{Name: identifyCommandName},
+		Nickname: truncate(displayName(identity), m.options.MaxNicknameLength),
+	})
+}
+
+// displayName returns the most readable name of identity.
+func displayName(identity sseconn.Identity) string {
+	switch {
+	case identity.Name != "":
+		return identity.Name
+	case identity.Email != "":
+		return identity.Email
+	default:
+		return identity.Subject
+	}
+}
+
+// truncate returns the max first characters of s.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+
+	return string(runes[:max])
+}
@@ -4,38 +4,89 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
+	"time"
 
-	"log"
-
+	"github.com/abustany/goretro/broker"
+	"github.com/abustany/goretro/history"
 	"github.com/abustany/goretro/sseconn"
 )
 
+var (
+	ErrRoomNotFound        = errors.New("room not found")
+	ErrParticipantNotFound = errors.New("participant not found")
+)
+
+// Manager routes the commands of the clients to their room. Each room runs
+// its commands in its own goroutine (see room), and lock only protects the
+// routing tables: it is never held while running a command or dispatching
+// events.
 type Manager struct {
-	lock        sync.RWMutex
-	connManager ConnManager
-	retros      map[sseconn.ClientID]*Retro
-	clientInfo  map[sseconn.ClientID]clientInfo
+	logger            *slog.Logger
+	options           Options
+	lock              sync.RWMutex
+	connManager       ConnManager
+	broker            broker.Broker
+	replicaID         string
+	retros            map[sseconn.ClientID]*room
+	clientInfo        map[sseconn.ClientID]clientInfo
+	roomSubscriptions map[sseconn.ClientID]broker.Subscription
+
+	// clients connected to other replicas that joined rooms hosted here,
+	// mapped to the ID of their replica.
+	remoteLock    sync.RWMutex
+	remoteClients map[sseconn.ClientID]string
+
+	commandStats commandStatsRecorder
 }
 
 type ConnManager interface {
 	ListenConnections() <-chan sseconn.ClientID
 	Listen(clientID sseconn.ClientID) (<-chan json.RawMessage, error)
-	Send(clientID sseconn.ClientID, eventName string, payload interface{}) error
+	SendVersioned(clientID sseconn.ClientID, eventName string, payload interface{}, version sseconn.EventVersion) error
+	Identity(clientID sseconn.ClientID) (sseconn.Identity, bool)
+	ProtocolVersion(clientID sseconn.ClientID) (int, bool)
 }
 
 type clientInfo struct {
-	name  string
-	retro *Retro
+	name string
+	room *room
+
+	// ID of the room the client joined, if that room is hosted by another
+	// replica.
+	remoteRoomID sseconn.ClientID
+
+	// protocol version of a client connected to another replica, the version
+	// of local clients is known by the ConnManager.
+	protocolVersion int
 }
 
-func NewManager(connManager ConnManager) *Manager {
+// NewManager returns a Manager handling the connections of connManager.
+func NewManager(connManager ConnManager, options Options) (*Manager, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, fmt.Errorf("error applying default options: %w", err)
+	}
+
 	m := &Manager{
-		connManager: connManager,
-		retros:      make(map[sseconn.ClientID]*Retro),
-		clientInfo:  make(map[sseconn.ClientID]clientInfo),
+		logger:            options.Logger.With("replica", options.ReplicaID),
+		options:           options,
+		connManager:       connManager,
+		broker:            options.Broker,
+		replicaID:         options.ReplicaID,
+		retros:            make(map[sseconn.ClientID]*room),
+		clientInfo:        make(map[sseconn.ClientID]clientInfo),
+		roomSubscriptions: make(map[sseconn.ClientID]broker.Subscription),
+		remoteClients:     make(map[sseconn.ClientID]string),
 	}
 
+	if err := m.listenReplicaEvents(); err != nil {
+		return nil, err
+	}
+
+	go m.refreshRoomClaims()
+
 	newConns := connManager.ListenConnections()
 
 	go func() {
@@ -44,15 +95,16 @@ func NewManager(connManager ConnManager) *Manager {
 		}
 	}()
 
-	return m
+	return m, nil
 }
 
 func (m *Manager) handleNewConnection(clientID sseconn.ClientID) {
-	log.Printf("New connection with ID %s", clientID)
+	logger := m.logger.With("client_id", clientID)
+	logger.Info("new connection")
 
 	events, err := m.connManager.Listen(clientID)
 	if err != nil {
-		log.Printf("error listening on connection: %s", err)
+		logger.Error("error listening on connection", "error", err)
 	}
 
 	go func(clientID sseconn.ClientID) {
@@ -60,7 +112,7 @@ func (m *Manager) handleNewConnection(clientID sseconn.ClientID) {
 			m.handleConnectionData(clientID, event)
 		}
 
-		log.Printf("Client disconnected: %s", clientID)
+		logger.Info("client disconnected")
 		m.handleDisconnect(clientID)
 	}(clientID)
 }
@@ -75,29 +127,150 @@ func (m *Manager) handleDisconnect(clientID sseconn.ClientID) {
 		return
 	}
 
-	if clientInfo.retro != nil {
-		m.dispatchEvents(clientInfo.retro.RemoveParticipant(clientID))
+	m.leaveRoom(clientID, clientInfo)
+}
+
+func (m *Manager) leaveRemoteRoom(clientID, roomID sseconn.ClientID) {
+	if err := m.forward(roomID, forwardedMessage{Kind: forwardedLeaveKind, ClientID: clientID}); err != nil {
+		m.logger.Warn("error leaving remote room", "client_id", clientID, "room_id", roomID, "error", err)
 	}
 }
 
 func (m *Manager) handleConnectionData(clientID sseconn.ClientID, data json.RawMessage) {
-	if err := m.handleCommand(clientID, data); err != nil {
-		log.Printf("invalid command from client %s: %s (%s)", clientID.String(), string(data), err)
+	var cmd command
+
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		m.clientLogger(clientID).Warn("error unmarshaling command", "data", string(data), "error", err)
+		return
+	}
+
+	protocolVersion := m.protocolVersion(clientID)
+
+	if err := checkProtocolVersion(protocolVersion); err != nil {
+		m.commandStats.record(cmd.Name, err, 0)
+		m.commandFailed(m.clientLogger(clientID), clientID, cmd.Name, data, err)
+		return
 	}
+
+	if cmd.Name == identifyCommandName && m.options.VerifiedNames {
+		verifiedData, err := m.verifiedIdentifyCommand(clientID)
+		if err != nil {
+			m.commandStats.record(cmd.Name, err, 0)
+			m.commandFailed(m.clientLogger(clientID), clientID, cmd.Name, data, err)
+			return
+		}
+
+		data = verifiedData
+	}
+
+	m.lock.RLock()
+	clientInfo := m.clientInfo[clientID]
+	m.lock.RUnlock()
+
+	if !clientInfo.remoteRoomID.IsZero() && cmd.Name != createRoomCommandName && cmd.Name != joinRoomCommandName {
+		// the room of the client is hosted by another replica, which handles
+		// the command. We still keep track of the nickname locally in case the
+		// client moves to another room.
+		if cmd.Name == identifyCommandName {
+			m.runCommand(m.clientLogger(clientID), clientID, nil, cmd.Name, data)
+		}
+
+		msg := forwardedMessage{Kind: forwardedCommandKind, ClientID: clientID, ProtocolVersion: protocolVersion, Data: data}
+		if err := m.forward(clientInfo.remoteRoomID, msg); err != nil {
+			m.clientLogger(clientID).Warn("error forwarding command", "command", cmd.Name, "error", err)
+		}
+
+		return
+	}
+
+	m.routeCommand(m.clientLogger(clientID), clientID, cmd.Name, data)
 }
 
-func (m *Manager) handleCommand(clientID sseconn.ClientID, data json.RawMessage) error {
+// routeCommand runs a command in the room of the client. The commands of
+// clients that are not in a room run right away. Creating and joining rooms
+// run outside of the room too, but only once the commands the client queued in
+// its room before have run, so that the commands of a client run in the order
+// it sent them.
+func (m *Manager) routeCommand(logger *slog.Logger, clientID sseconn.ClientID, name string, data json.RawMessage) {
+	m.lock.RLock()
+	r := m.clientInfo[clientID].room
+	m.lock.RUnlock()
+
+	if r != nil {
+		if name != createRoomCommandName && name != joinRoomCommandName {
+			if r.enqueue(func() { m.runCommand(logger, clientID, r, name, data) }) {
+				return
+			}
+		} else {
+			// a stopped room has no commands left to wait for
+			r.call(func() error { return nil })
+		}
+	}
+
+	m.runCommand(logger, clientID, nil, name, data)
+}
+
+// runCommand handles a command sent from room, which is nil if the client is
+// not in a room, and records its outcome.
+func (m *Manager) runCommand(logger *slog.Logger, clientID sseconn.ClientID, r *room, name string, data json.RawMessage) {
+	start := time.Now()
+	err := m.handleCommand(clientID, r, name, data)
+	duration := time.Since(start)
+	m.commandStats.record(name, err, duration)
+
+	if err != nil {
+		m.commandFailed(logger, clientID, name, data, err)
+		return
+	}
+
+	logger.Debug("handled command", "command", name, "duration", duration)
+}
+
+// commandFailed logs a command error, and reports validation errors to the
+// client that sent the command.
+func (m *Manager) commandFailed(logger *slog.Logger, clientID sseconn.ClientID, name string, data json.RawMessage, err error) {
+	logger.Warn("invalid command", "command", name, "data", string(data), "error", err)
+
+	var validationErr validationError
+	if errors.As(err, &validationErr) {
+		m.dispatchEvents([]Event{{
+			Recipient: clientID,
+			Name:      commandErrorEventName,
+			Payload:   commandError{Command: name, Message: validationErr.Error()},
+		}})
+	}
+}
+
+// clientLogger returns a logger tagged with the client ID, and with the room
+// ID if the client is in a room.
+func (m *Manager) clientLogger(clientID sseconn.ClientID) *slog.Logger {
+	logger := m.logger.With("client_id", clientID)
+
+	m.lock.RLock()
+	clientInfo := m.clientInfo[clientID]
+	m.lock.RUnlock()
+
+	if clientInfo.room != nil {
+		logger = logger.With("room_id", clientInfo.room.retro.id)
+	} else if !clientInfo.remoteRoomID.IsZero() {
+		logger = logger.With("room_id", clientInfo.remoteRoomID)
+	}
+
+	return logger
+}
+
+func (m *Manager) handleCommand(clientID sseconn.ClientID, r *room, name string, data json.RawMessage) error {
 	var (
-		cmd    command
 		events []Event
 		err    error
+		retro  *Retro
 	)
 
-	if err := json.Unmarshal(data, &cmd); err != nil {
-		return fmt.Errorf("error unmarshaling command: %w", err)
+	if r != nil {
+		retro = r.retro
 	}
 
-	switch cmd.Name {
+	switch name {
 	case createRoomCommandName:
 		var createRoomCommand createRoomCommand
 		if err := json.Unmarshal(data, &createRoomCommand); err != nil {
@@ -118,37 +291,79 @@ func (m *Manager) handleCommand(clientID sseconn.ClientID, data json.RawMessage)
 			return fmt.Errorf("error decoding command: %w", err)
 		}
 
-		events, err = m.handleIdentifyCommand(clientID, identifyCommand)
+		events, err = m.handleIdentifyCommand(clientID, retro, identifyCommand)
 	case setStateCommandName:
 		var setStateCommand setStateCommand
 		if err := json.Unmarshal(data, &setStateCommand); err != nil {
 			return fmt.Errorf("error decoding command: %w", err)
 		}
 
-		events, err = m.handlesetStateCommand(clientID, setStateCommand)
+		events, err = m.handlesetStateCommand(clientID, retro, setStateCommand)
+	case nextPhaseCommandName:
+		events, err = m.handleChangePhaseCommand(clientID, retro, (*Retro).NextPhase)
+	case previousPhaseCommandName:
+		events, err = m.handleChangePhaseCommand(clientID, retro, (*Retro).PreviousPhase)
 	case saveNoteCommentName:
 		var saveNoteCommand saveNoteCommand
 		if err := json.Unmarshal(data, &saveNoteCommand); err != nil {
 			return fmt.Errorf("error decoding command: %w", err)
 		}
 
-		events, err = m.handleSaveNoteCommand(clientID, saveNoteCommand)
+		events, err = m.handleSaveNoteCommand(clientID, retro, saveNoteCommand)
 	case setFinishedWritingName:
 		var setFinishedWritingCommand setFinishedWritingCommand
 		if err := json.Unmarshal(data, &setFinishedWritingCommand); err != nil {
 			return fmt.Errorf("error decoding command: %w", err)
 		}
 
-		events, err = m.handleSetFinishedWritingCommand(clientID, setFinishedWritingCommand)
+		events, err = m.handleSetFinishedWritingCommand(clientID, retro, setFinishedWritingCommand)
+	case saveActionItemCommandName:
+		var saveActionItemCommand saveActionItemCommand
+		if err := json.Unmarshal(data, &saveActionItemCommand); err != nil {
+			return fmt.Errorf("error decoding command: %w", err)
+		}
+
+		events, err = m.handleSaveActionItemCommand(clientID, retro, saveActionItemCommand)
+	case groupNoteCommandName:
+		var groupNoteCommand groupNoteCommand
+		if err := json.Unmarshal(data, &groupNoteCommand); err != nil {
+			return fmt.Errorf("error decoding command: %w", err)
+		}
+
+		events, err = m.handleGroupNoteCommand(clientID, retro, groupNoteCommand)
+	case voteCommandName:
+		var voteCommand voteCommand
+		if err := json.Unmarshal(data, &voteCommand); err != nil {
+			return fmt.Errorf("error decoding command: %w", err)
+		}
+
+		events, err = m.handleVoteCommand(clientID, retro, voteCommand)
+	case closeRoomCommandName:
+		err = m.handleCloseRoomCommand(clientID, r)
+	case checkInCommandName:
+		var checkInCommand checkInCommand
+		if err := json.Unmarshal(data, &checkInCommand); err != nil {
+			return fmt.Errorf("error decoding command: %w", err)
+		}
+
+		events, err = m.handleCheckInCommand(clientID, retro, checkInCommand)
+	case revealCheckInsCommandName:
+		events, err = m.handleRevealCheckInsCommand(clientID, retro)
+	case resyncCommandName:
+		events, err = m.handleResyncCommand(clientID, retro)
 	default:
-		return fmt.Errorf("unknown command %s", cmd.Name)
+		return fmt.Errorf("unknown command %s", name)
 	}
 
 	if err != nil {
-		return fmt.Errorf("error handling command %s: %w", cmd.Name, err)
+		return fmt.Errorf("error handling command %s: %w", name, err)
 	}
 
-	m.dispatchEvents(events)
+	if retro != nil {
+		m.dispatchRoomEvents(retro, events)
+	} else {
+		m.dispatchEvents(events)
+	}
 
 	return nil
 }
@@ -158,19 +373,92 @@ func (m *Manager) handleCreateRoomCommand(clientID sseconn.ClientID, cmd createR
 		return nil, fmt.Errorf("empty room name")
 	}
 
+	if err := validateLength("room name", cmd.RoomName, m.options.MaxRoomNameLength); err != nil {
+		return nil, err
+	}
+
+	if cmd.CheckIn && len(cmd.Agenda) > 0 {
+		return nil, validationError{message: "checkIn cannot be used with an agenda, add a check-in phase to the agenda instead"}
+	}
+
+	agenda, err := parseAgenda(cmd.Agenda)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := m.previousRetro(cmd)
+	if err != nil {
+		return nil, err
+	}
+
 	roomID, err := sseconn.NewClientID()
 	if err != nil {
 		return nil, fmt.Errorf("error generating room ID: %w", err)
 	}
 
 	retro := NewRetro(roomID, cmd.RoomName)
+	retro.teamID = cmd.TeamID
+	retro.actionItems = carryOverActionItems(previous)
+
+	if len(agenda) == 0 {
+		agenda = defaultAgenda(cmd.CheckIn, len(retro.actionItems) > 0)
+	}
+
+	retro.setAgenda(agenda)
+
+	sub, err := m.hostRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	r := startRoom(retro)
 
 	m.lock.Lock()
-	defer m.lock.Unlock()
+	m.retros[roomID] = r
+	m.roomSubscriptions[roomID] = sub
+	m.lock.Unlock()
+
+	m.serveForwardedMessages(roomID, sub)
+
+	m.joinRoom(r, clientID)
+
+	return nil, nil
+}
+
+// previousRetro returns the retro whose action items are carried over to the
+// room created by cmd, if any. It also checks that the team of the room exists.
+func (m *Manager) previousRetro(cmd createRoomCommand) (history.Retro, error) {
+	var teamRetros []history.Retro
+
+	if cmd.TeamID != "" {
+		var err error
+		if teamRetros, err = m.options.History.Retros(cmd.TeamID); errors.Is(err, history.ErrTeamNotFound) {
+			return history.Retro{}, validationError{message: "unknown team"}
+		} else if err != nil {
+			return history.Retro{}, fmt.Errorf("error looking up team: %w", err)
+		}
+	}
+
+	if cmd.PreviousRetroID != "" {
+		previous, err := m.options.History.Retro(cmd.PreviousRetroID)
+		if errors.Is(err, history.ErrRetroNotFound) {
+			return history.Retro{}, validationError{message: "unknown previous retro"}
+		} else if err != nil {
+			return history.Retro{}, fmt.Errorf("error looking up previous retro: %w", err)
+		}
+
+		if previous.TeamID != cmd.TeamID {
+			return history.Retro{}, validationError{message: "previous retro belongs to another team"}
+		}
 
-	m.retros[roomID] = retro
+		return previous, nil
+	}
 
-	return m.joinRoomLocked(retro, clientID)
+	if len(teamRetros) == 0 {
+		return history.Retro{}, nil
+	}
+
+	return teamRetros[len(teamRetros)-1], nil
 }
 
 func (m *Manager) handleJoinRoomCommand(clientID sseconn.ClientID, cmd joinRoomCommand) ([]Event, error) {
@@ -179,97 +467,389 @@ func (m *Manager) handleJoinRoomCommand(clientID sseconn.ClientID, cmd joinRoomC
 		return nil, fmt.Errorf("invalid room ID: %s", roomID)
 	}
 
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	r := m.lookupRoom(roomID)
+	if r == nil {
+		return m.joinRemoteRoom(roomID, clientID)
+	}
 
-	retro := m.retros[roomID]
+	m.joinRoom(r, clientID)
 
-	if retro == nil {
-		return nil, fmt.Errorf("invalid room ID: %s", roomID)
+	return nil, nil
+}
+
+func (m *Manager) joinRemoteRoom(roomID, clientID sseconn.ClientID) ([]Event, error) {
+	if _, err := m.remoteRoomOwner(roomID); err != nil {
+		if errors.Is(err, ErrRoomNotFound) {
+			return nil, fmt.Errorf("invalid room ID: %s", roomID)
+		}
+
+		return nil, err
 	}
 
-	return m.joinRoomLocked(retro, clientID)
+	m.lock.Lock()
+	clientInfo := m.clientInfo[clientID]
+	previous := clientInfo
+	clientInfo.room = nil
+	clientInfo.remoteRoomID = roomID
+	m.clientInfo[clientID] = clientInfo
+	m.lock.Unlock()
+
+	if previous.remoteRoomID != roomID {
+		m.leaveRoom(clientID, previous)
+	}
+
+	data, err := json.Marshal(joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: roomID.String()})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling join command: %w", err)
+	}
+
+	msg := forwardedMessage{Kind: forwardedCommandKind, ClientID: clientID, Nickname: clientInfo.name, ProtocolVersion: m.protocolVersion(clientID), Data: data}
+	if err := m.forward(roomID, msg); err != nil {
+		return nil, fmt.Errorf("error forwarding join command: %w", err)
+	}
+
+	return nil, nil
 }
 
-func (m *Manager) joinRoomLocked(retro *Retro, clientID sseconn.ClientID) ([]Event, error) {
-	clientInfo := m.clientInfo[clientID]
+// leaveRoom removes the client from the room it was in according to info, if
+// any.
+func (m *Manager) leaveRoom(clientID sseconn.ClientID, info clientInfo) {
+	if r := info.room; r != nil {
+		r.enqueue(func() {
+			m.dispatchRoomEvents(r.retro, r.retro.RemoveParticipant(clientID))
+		})
+	}
 
-	if clientInfo.retro != nil {
-		m.dispatchEvents(clientInfo.retro.RemoveParticipant(clientID))
+	if !info.remoteRoomID.IsZero() {
+		m.leaveRemoteRoom(clientID, info.remoteRoomID)
 	}
+}
 
-	clientInfo.retro = retro
+func (m *Manager) joinRoom(r *room, clientID sseconn.ClientID) {
+	m.lock.Lock()
+	clientInfo := m.clientInfo[clientID]
+	previous := clientInfo
+	clientInfo.room = r
+	clientInfo.remoteRoomID = sseconn.ClientID{}
 	m.clientInfo[clientID] = clientInfo
+	m.lock.Unlock()
+
+	// another tab of the client joining the room it is already in only needs
+	// the state of the room
+	if previous.room != r {
+		m.leaveRoom(clientID, previous)
+	}
 
-	return retro.AddParticipant(Participant{ClientID: clientID, Name: clientInfo.name}), nil
+	participant := Participant{ClientID: clientID, Name: clientInfo.name}
+	r.enqueue(func() {
+		m.dispatchRoomEvents(r.retro, r.retro.AddParticipant(participant))
+	})
 }
 
-func (m *Manager) handleIdentifyCommand(clientID sseconn.ClientID, cmd identifyCommand) ([]Event, error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+func (m *Manager) handleIdentifyCommand(clientID sseconn.ClientID, retro *Retro, cmd identifyCommand) ([]Event, error) {
+	if err := validateLength("nickname", cmd.Nickname, m.options.MaxNicknameLength); err != nil {
+		return nil, err
+	}
 
+	m.lock.Lock()
 	clientInfo := m.clientInfo[clientID]
 	clientInfo.name = cmd.Nickname
 	m.clientInfo[clientID] = clientInfo
+	m.lock.Unlock()
 
-	if clientInfo.retro == nil {
+	if retro == nil {
 		return nil, nil
 	}
 
-	return clientInfo.retro.UpdateParticipant(Participant{ClientID: clientID, Name: cmd.Nickname}), nil
+	return retro.UpdateParticipant(Participant{ClientID: clientID, Name: cmd.Nickname}), nil
 }
 
-func (m *Manager) handlesetStateCommand(clientID sseconn.ClientID, cmd setStateCommand) ([]Event, error) {
+func (m *Manager) handlesetStateCommand(clientID sseconn.ClientID, retro *Retro, cmd setStateCommand) ([]Event, error) {
 	state, err := stateFromInt(cmd.State)
 	if err != nil {
 		return nil, fmt.Errorf("error validating state: %w", err)
 	}
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	if retro == nil {
+		return nil, nil
+	}
 
-	clientInfo := m.clientInfo[clientID]
+	return retro.SetState(clientID, state), nil
+}
 
-	if clientInfo.retro == nil {
+func (m *Manager) handleChangePhaseCommand(clientID sseconn.ClientID, retro *Retro, changePhase func(*Retro, sseconn.ClientID) []Event) ([]Event, error) {
+	if retro == nil {
 		return nil, nil
 	}
 
-	return clientInfo.retro.SetState(clientID, state), nil
+	return changePhase(retro, clientID), nil
 }
 
-func (m *Manager) handleSaveNoteCommand(clientID sseconn.ClientID, cmd saveNoteCommand) ([]Event, error) {
+func (m *Manager) handleSaveNoteCommand(clientID sseconn.ClientID, retro *Retro, cmd saveNoteCommand) ([]Event, error) {
 	mood, err := moodFromInt(cmd.Mood)
 	if err != nil {
 		return nil, fmt.Errorf("error validating mood: %w", err)
 	}
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	if err := validateLength("note", cmd.Text, m.options.MaxNoteLength); err != nil {
+		return nil, err
+	}
 
-	clientInfo := m.clientInfo[clientID]
-	if clientInfo.retro == nil {
+	if retro == nil {
+		return nil, errors.New("client is not in any room")
+	}
+
+	// the commands of a room run one at a time, so no other note can be saved
+	// between the check and the save.
+	if !retro.canSaveNote(clientID, cmd.ID, m.options.MaxNotesPerParticipant) {
+		return nil, validationError{message: fmt.Sprintf("too many notes (maximum is %d)", m.options.MaxNotesPerParticipant)}
+	}
+
+	if m.protocolVersion(clientID) < noteRevisionsProtocol {
+		// older clients don't know about revisions, let them overwrite their
+		// notes as they used to
+		cmd.Revision = retro.noteRevision(clientID, cmd.ID)
+	}
+
+	return retro.SaveNote(clientID, cmd.ID, cmd.Revision, cmd.Text, mood), nil
+}
+
+func (m *Manager) handleSetFinishedWritingCommand(clientID sseconn.ClientID, retro *Retro, cmd setFinishedWritingCommand) ([]Event, error) {
+	if retro == nil {
 		return nil, errors.New("client is not in any room")
 	}
 
-	return clientInfo.retro.SaveNote(clientID, cmd.ID, cmd.Text, mood), nil
+	return retro.SetFinishedWriting(clientID, cmd.Finished), nil
 }
 
-func (m *Manager) handleSetFinishedWritingCommand(clientID sseconn.ClientID, cmd setFinishedWritingCommand) ([]Event, error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+func (m *Manager) handleSaveActionItemCommand(clientID sseconn.ClientID, retro *Retro, cmd saveActionItemCommand) ([]Event, error) {
+	if err := validateLength("action item", cmd.Text, m.options.MaxNoteLength); err != nil {
+		return nil, err
+	}
 
-	clientInfo := m.clientInfo[clientID]
-	if clientInfo.retro == nil {
+	if retro == nil {
 		return nil, errors.New("client is not in any room")
 	}
 
-	return clientInfo.retro.SetFinishedWriting(clientID, cmd.Finished), nil
+	return retro.SaveActionItem(clientID, cmd.ID, cmd.Text, cmd.Done), nil
+}
+
+func (m *Manager) handleGroupNoteCommand(clientID sseconn.ClientID, retro *Retro, cmd groupNoteCommand) ([]Event, error) {
+	if retro == nil {
+		return nil, errors.New("client is not in any room")
+	}
+
+	return retro.GroupNote(clientID, cmd.AuthorID, cmd.NoteID, cmd.Group), nil
+}
+
+func (m *Manager) handleVoteCommand(clientID sseconn.ClientID, retro *Retro, cmd voteCommand) ([]Event, error) {
+	if retro == nil {
+		return nil, errors.New("client is not in any room")
+	}
+
+	// the commands of a room run one at a time, so no other vote can be saved
+	// between the check and the vote.
+	if cmd.Vote && !retro.canVote(clientID, cmd.AuthorID, cmd.NoteID, m.options.MaxVotesPerParticipant) {
+		return nil, validationError{message: fmt.Sprintf("too many votes (maximum is %d)", m.options.MaxVotesPerParticipant)}
+	}
+
+	return retro.Vote(clientID, cmd.AuthorID, cmd.NoteID, cmd.Vote), nil
+}
+
+func (m *Manager) handleCheckInCommand(clientID sseconn.ClientID, retro *Retro, cmd checkInCommand) ([]Event, error) {
+	if err := cmd.CheckIn.validate(); err != nil {
+		return nil, err
+	}
+
+	if retro == nil {
+		return nil, errors.New("client is not in any room")
+	}
+
+	return retro.CheckIn(clientID, cmd.CheckIn), nil
+}
+
+func (m *Manager) handleRevealCheckInsCommand(clientID sseconn.ClientID, retro *Retro) ([]Event, error) {
+	if retro == nil {
+		return nil, errors.New("client is not in any room")
+	}
+
+	return retro.RevealCheckIns(clientID), nil
+}
+
+func (m *Manager) handleResyncCommand(clientID sseconn.ClientID, retro *Retro) ([]Event, error) {
+	if retro == nil {
+		return nil, errors.New("client is not in any room")
+	}
+
+	return retro.Resync(clientID), nil
+}
+
+// handleCloseRoomCommand lets the host close the room once the retro is over.
+// It runs in the goroutine of the room.
+func (m *Manager) handleCloseRoomCommand(clientID sseconn.ClientID, r *room) error {
+	if r == nil {
+		return errors.New("client is not in any room")
+	}
+
+	if !r.retro.canClose(clientID) {
+		return nil
+	}
+
+	return m.closeRoom(r)
+}
+
+// Rooms returns a summary of all the rooms currently managed.
+func (m *Manager) Rooms() []RoomInfo {
+	m.lock.RLock()
+	retros := make([]*Retro, 0, len(m.retros))
+	for _, r := range m.retros {
+		retros = append(retros, r.retro)
+	}
+	m.lock.RUnlock()
+
+	rooms := make([]RoomInfo, 0, len(retros))
+	for _, r := range retros {
+		rooms = append(rooms, r.Info())
+	}
+
+	return rooms
+}
+
+// Room returns the complete state of a room.
+func (m *Manager) Room(roomID sseconn.ClientID) (SerializedRetro, error) {
+	r := m.lookupRoom(roomID)
+	if r == nil {
+		return SerializedRetro{}, ErrRoomNotFound
+	}
+
+	return r.retro.Serialize(), nil
+}
+
+// CloseRoom removes a room and all its participants. Participants are notified
+// that the room was closed.
+func (m *Manager) CloseRoom(roomID sseconn.ClientID) error {
+	r := m.lookupRoom(roomID)
+	if r == nil {
+		return ErrRoomNotFound
+	}
+
+	return r.call(func() error { return m.closeRoom(r) })
+}
+
+// closeRoom closes a room from its own goroutine.
+func (m *Manager) closeRoom(r *room) error {
+	retro := r.retro
+	roomID := retro.id
+
+	m.lock.Lock()
+
+	if m.retros[roomID] != r {
+		m.lock.Unlock()
+		return ErrRoomNotFound
+	}
+
+	delete(m.retros, roomID)
+	sub := m.roomSubscriptions[roomID]
+	delete(m.roomSubscriptions, roomID)
+
+	for clientID, clientInfo := range m.clientInfo {
+		if clientInfo.room == r {
+			clientInfo.room = nil
+			m.clientInfo[clientID] = clientInfo
+		}
+	}
+
+	m.lock.Unlock()
+
+	m.unhostRoom(roomID, sub)
+	r.stop()
+	m.logger.Info("room closed", "room_id", roomID)
+
+	if retro.teamID != "" {
+		if err := m.options.History.SaveRetro(retro.historyRecord(time.Now())); err != nil {
+			m.logger.Error("error saving retro to the team history", "room_id", roomID, "team_id", retro.teamID, "error", err)
+		}
+	}
+
+	events := retro.Close()
+	m.dispatchRoomEvents(retro, events)
+
+	m.remoteLock.Lock()
+	for _, ev := range events {
+		delete(m.remoteClients, ev.Recipient)
+	}
+	m.remoteLock.Unlock()
+
+	return nil
+}
+
+// TransferHost makes the participant with the given public ID the host of a
+// room.
+func (m *Manager) TransferHost(roomID sseconn.ClientID, participantID ParticipantID) error {
+	r := m.lookupRoom(roomID)
+	if r == nil {
+		return ErrRoomNotFound
+	}
+
+	return r.call(func() error {
+		clientID, ok := r.retro.clientIDOf(participantID)
+		if !ok {
+			return ErrParticipantNotFound
+		}
+
+		events, err := r.retro.SetHost(clientID)
+		if err != nil {
+			return err
+		}
+
+		m.logger.Info("host transferred", "room_id", roomID, "client_id", clientID)
+		m.dispatchRoomEvents(r.retro, events)
+
+		return nil
+	})
+}
+
+// ParticipantClientID returns the client ID of a participant of a room hosted
+// by this replica.
+func (m *Manager) ParticipantClientID(roomID sseconn.ClientID, participantID ParticipantID) (sseconn.ClientID, error) {
+	r := m.lookupRoom(roomID)
+	if r == nil {
+		return sseconn.ClientID{}, ErrRoomNotFound
+	}
+
+	clientID, ok := r.retro.clientIDOf(participantID)
+	if !ok {
+		return sseconn.ClientID{}, ErrParticipantNotFound
+	}
+
+	return clientID, nil
+}
+
+func (m *Manager) lookupRoom(roomID sseconn.ClientID) *room {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.retros[roomID]
+}
+
+// dispatchRoomEvents stamps the events of a room with its next version, and
+// dispatches them. It runs in the goroutine of the room, so that events are
+// dispatched in the order of their versions.
+func (m *Manager) dispatchRoomEvents(retro *Retro, events []Event) {
+	m.dispatchEvents(retro.stampEvents(events))
 }
 
 func (m *Manager) dispatchEvents(events []Event) {
 	for _, ev := range events {
-		if err := m.connManager.Send(ev.Recipient, ev.Name, ev.Payload); err != nil {
-			log.Printf("error dispatching event to %s: %s", ev.Recipient, err)
+		ev.Payload = payloadForProtocol(ev.Payload, m.protocolVersion(ev.Recipient))
+
+		remote, err := m.sendRemote(ev)
+		if !remote {
+			err = m.connManager.SendVersioned(ev.Recipient, ev.Name, ev.Payload, sseconn.EventVersion{Version: ev.Version, Previous: ev.PreviousVersion})
+		}
+
+		if err != nil {
+			m.logger.Warn("error dispatching event", "client_id", ev.Recipient, "event", ev.Name, "error", err)
 		}
 	}
 }
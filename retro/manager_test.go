@@ -0,0 +1,1087 @@
+package retro
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/abustany/goretro/broker"
+	"github.com/abustany/goretro/history"
+	"github.com/abustany/goretro/sseconn"
+)
+
+type sentEvent struct {
+	Name    string
+	Payload interface{}
+	Version sseconn.EventVersion
+}
+
+// fakeConnManager implements ConnManager for the tests. Clients are connected
+// with connect, send commands with send and events are received with
+// expectEvent.
+type fakeConnManager struct {
+	connections chan sseconn.ClientID
+
+	lock       sync.Mutex
+	listeners  map[sseconn.ClientID]chan json.RawMessage
+	events     map[sseconn.ClientID]chan sentEvent
+	identities map[sseconn.ClientID]sseconn.Identity
+	versions   map[sseconn.ClientID]int
+}
+
+func newFakeConnManager() *fakeConnManager {
+	return &fakeConnManager{
+		connections: make(chan sseconn.ClientID),
+		listeners:   map[sseconn.ClientID]chan json.RawMessage{},
+		events:      map[sseconn.ClientID]chan sentEvent{},
+		identities:  map[sseconn.ClientID]sseconn.Identity{},
+		versions:    map[sseconn.ClientID]int{},
+	}
+}
+
+func (f *fakeConnManager) ListenConnections() <-chan sseconn.ClientID {
+	return f.connections
+}
+
+func (f *fakeConnManager) Listen(clientID sseconn.ClientID) (<-chan json.RawMessage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.listeners[clientID], nil
+}
+
+func (f *fakeConnManager) SendVersioned(clientID sseconn.ClientID, eventName string, payload interface{}, version sseconn.EventVersion) error {
+	f.lock.Lock()
+	events := f.events[clientID]
+	f.lock.Unlock()
+
+	events <- sentEvent{Name: eventName, Payload: payload, Version: version}
+	return nil
+}
+
+func (f *fakeConnManager) Identity(clientID sseconn.ClientID) (sseconn.Identity, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	identity, ok := f.identities[clientID]
+	return identity, ok
+}
+
+func (f *fakeConnManager) ProtocolVersion(clientID sseconn.ClientID) (int, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	version, ok := f.versions[clientID]
+	return version, ok
+}
+
+func (f *fakeConnManager) connect(t testing.TB) sseconn.ClientID {
+	return f.connectAs(t, nil)
+}
+
+// connectAs connects a client with a verified identity, or an anonymous
+// client if identity is nil.
+func (f *fakeConnManager) connectAs(t testing.TB, identity *sseconn.Identity) sseconn.ClientID {
+	return f.connectWithVersion(t, identity, ProtocolVersion)
+}
+
+// connectWithVersion connects a client speaking the given protocol version.
+func (f *fakeConnManager) connectWithVersion(t testing.TB, identity *sseconn.Identity, protocolVersion int) sseconn.ClientID {
+	clientID := newClientID(t)
+
+	f.lock.Lock()
+	if identity != nil {
+		f.identities[clientID] = *identity
+	}
+	f.versions[clientID] = protocolVersion
+	f.listeners[clientID] = make(chan json.RawMessage)
+	f.events[clientID] = make(chan sentEvent, 100)
+	f.lock.Unlock()
+
+	f.connections <- clientID
+
+	return clientID
+}
+
+func (f *fakeConnManager) disconnect(clientID sseconn.ClientID) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	close(f.listeners[clientID])
+}
+
+func (f *fakeConnManager) send(t testing.TB, clientID sseconn.ClientID, cmd interface{}) {
+	t.Helper()
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("error marshaling command: %s", err)
+	}
+
+	f.lock.Lock()
+	listener := f.listeners[clientID]
+	f.lock.Unlock()
+
+	listener <- data
+}
+
+// expectEvent waits for an event and returns its payload, marshaled to JSON so
+// that local and forwarded events can be compared.
+func (f *fakeConnManager) expectEvent(t testing.TB, clientID sseconn.ClientID, name string) string {
+	t.Helper()
+
+	payload, err := json.Marshal(f.receiveEvent(t, clientID, name).Payload)
+	if err != nil {
+		t.Fatalf("error marshaling payload: %s", err)
+	}
+
+	return string(payload)
+}
+
+// receiveEvent waits for an event and returns it.
+func (f *fakeConnManager) receiveEvent(t testing.TB, clientID sseconn.ClientID, name string) sentEvent {
+	t.Helper()
+
+	f.lock.Lock()
+	events := f.events[clientID]
+	f.lock.Unlock()
+
+	select {
+	case ev := <-events:
+		if ev.Name != name {
+			t.Fatalf("expected event %q, got %q (%+v)", name, ev.Name, ev.Payload)
+		}
+
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for event %q", name)
+		return sentEvent{}
+	}
+}
+
+func newTestManager(t *testing.T, connManager ConnManager, b broker.Broker, replicaID string) *Manager {
+	m, err := NewManager(connManager, Options{
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Broker:    b,
+		ReplicaID: replicaID,
+	})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	return m
+}
+
+func TestRoomAcrossReplicas(t *testing.T) {
+	t.Run("memory broker", func(t *testing.T) {
+		b := broker.NewMemory()
+		defer b.Close()
+
+		testRoomAcrossReplicas(t, b)
+	})
+
+	t.Run("Redis broker", func(t *testing.T) {
+		server := miniredis.RunT(t)
+
+		b, err := broker.NewRedis(server.Addr())
+		if err != nil {
+			t.Fatalf("error creating Redis broker: %s", err)
+		}
+
+		defer b.Close()
+
+		testRoomAcrossReplicas(t, b)
+	})
+}
+
+func testRoomAcrossReplicas(t *testing.T, b broker.Broker) {
+	connsA, connsB := newFakeConnManager(), newFakeConnManager()
+	newTestManager(t, connsA, b, "A")
+	managerB := newTestManager(t, connsB, b, "B")
+
+	// the host is connected to B, which hosts the room
+	host := connsB.connect(t)
+	connsB.send(t, host, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Host"})
+	connsB.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+	connsB.expectEvent(t, host, currentStateEventName)
+
+	rooms := managerB.Rooms()
+	if len(rooms) != 1 {
+		t.Fatalf("expected 1 room on B, got %d", len(rooms))
+	}
+
+	roomID := rooms[0].ID
+
+	// the guest is connected to A
+	guest := connsA.connect(t)
+	connsA.send(t, guest, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Guest"})
+	connsA.send(t, guest, joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: roomID.String()})
+
+	guestParticipant := Participant{ClientID: guest, Name: "Guest"}
+	checkEqual(t, mustMarshal(t, guestParticipant), connsB.expectEvent(t, host, participantAddedEventName))
+
+	var state struct {
+		ID           sseconn.ClientID
+		HostID       ParticipantID
+		SelfID       ParticipantID
+		Participants json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(connsA.expectEvent(t, guest, currentStateEventName)), &state); err != nil {
+		t.Fatalf("error unmarshaling state: %s", err)
+	}
+
+	checkEqual(t, roomID, state.ID)
+	checkEqual(t, ParticipantIDOf(host), state.HostID)
+	checkEqual(t, ParticipantIDOf(guest), state.SelfID)
+	checkEqual(t, mustMarshal(t, []Participant{{ClientID: host, Name: "Host"}, guestParticipant}), string(state.Participants))
+
+	// commands from the guest reach the room
+	connsA.send(t, guest, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Renamed"})
+	checkEqual(t, mustMarshal(t, Participant{ClientID: guest, Name: "Renamed"}), connsB.expectEvent(t, host, participantUpdatedEventName))
+
+	// and events from the room reach the guest
+	connsB.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Running)})
+	checkEqual(t, mustMarshal(t, Running), connsB.expectEvent(t, host, stateChangedEventName))
+	checkEqual(t, mustMarshal(t, Running), connsA.expectEvent(t, guest, stateChangedEventName))
+
+	// the guest disconnecting from A leaves the room on B
+	connsA.disconnect(guest)
+	checkEqual(t, mustMarshal(t, Participant{ClientID: guest}), connsB.expectEvent(t, host, participantRemovedEventName))
+}
+
+func TestStats(t *testing.T) {
+	conns := newFakeConnManager()
+	m := newTestManager(t, conns, nil, "")
+
+	host := conns.connect(t)
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+	conns.expectEvent(t, host, currentStateEventName)
+
+	roomID := m.Rooms()[0].ID
+
+	guest := conns.connect(t)
+	conns.send(t, guest, joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: roomID.String()})
+	conns.expectEvent(t, guest, currentStateEventName)
+	conns.expectEvent(t, host, participantAddedEventName)
+
+	conns.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Running)})
+	conns.expectEvent(t, host, stateChangedEventName)
+
+	other := conns.connect(t)
+	conns.send(t, other, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Other", TeamID: "unknown"})
+	conns.expectEvent(t, other, commandErrorEventName)
+	conns.send(t, other, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Other"})
+	conns.expectEvent(t, other, currentStateEventName)
+
+	stats := m.Stats()
+
+	checkEqual(t, 1, stats.RoomsByState[WaitingForParticipants])
+	checkEqual(t, 1, stats.RoomsByState[Running])
+	checkEqual(t, 0, stats.RoomsByState[ActionPoints])
+	checkEqual(t, 3, stats.Participants)
+
+	counts := map[string]uint64{}
+	for _, c := range stats.Commands {
+		counts[c.Name+"/"+c.Outcome] = c.Count
+	}
+
+	checkEqual(t, map[string]uint64{
+		createRoomCommandName + "/" + CommandOutcomeOK:    2,
+		createRoomCommandName + "/" + CommandOutcomeError: 1,
+		joinRoomCommandName + "/" + CommandOutcomeOK:      1,
+		setStateCommandName + "/" + CommandOutcomeOK:      1,
+	}, counts)
+}
+
+func TestCommandOrder(t *testing.T) {
+	conns := newFakeConnManager()
+	m := newTestManager(t, conns, nil, "")
+
+	client := conns.connect(t)
+	conns.send(t, client, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Before"})
+	conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "First"})
+	conns.expectEvent(t, client, currentStateEventName)
+
+	// keeps the room busy, so that the rename is still queued when the client
+	// creates another room
+	busy := make(chan struct{})
+	m.lookupRoom(m.Rooms()[0].ID).enqueue(func() { <-busy })
+
+	conns.send(t, client, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "After"})
+	conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Second"})
+	close(busy)
+
+	var state struct {
+		Name         string
+		Participants json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(conns.expectEvent(t, client, currentStateEventName)), &state); err != nil {
+		t.Fatalf("error unmarshaling state: %s", err)
+	}
+
+	checkEqual(t, "Second", state.Name)
+	checkEqual(t, mustMarshal(t, []Participant{{ClientID: client, Name: "After"}}), string(state.Participants))
+}
+
+func TestRoomClaims(t *testing.T) {
+	b := broker.NewMemory()
+	defer b.Close()
+
+	conns := newFakeConnManager()
+	m := newTestManager(t, conns, b, "A")
+
+	host := conns.connect(t)
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+	conns.expectEvent(t, host, currentStateEventName)
+
+	roomID := m.Rooms()[0].ID
+
+	checkOwner := func(t *testing.T, expected string) {
+		t.Helper()
+
+		owner, err := b.Owner(roomOwnerKey(roomID))
+		if err != nil {
+			t.Fatalf("error looking up owner: %s", err)
+		}
+
+		checkEqual(t, expected, owner)
+	}
+
+	checkOwner(t, "A")
+
+	// as if the claim expired while the broker was unreachable
+	if err := b.Release(roomOwnerKey(roomID), "A"); err != nil {
+		t.Fatalf("error releasing room: %s", err)
+	}
+
+	m.refreshRoomClaim(roomID)
+	checkOwner(t, "A")
+
+	if err := m.CloseRoom(roomID); err != nil {
+		t.Fatalf("error closing room: %s", err)
+	}
+
+	checkOwner(t, "")
+}
+
+// lockCheckingBroker fails the test when the broker is used while the lock of
+// the Manager is held.
+type lockCheckingBroker struct {
+	broker.Broker
+	t       *testing.T
+	manager *Manager
+}
+
+func (b *lockCheckingBroker) checkUnlocked(call string) {
+	if !b.manager.lock.TryLock() {
+		b.t.Errorf("%s called with the manager lock held", call)
+		return
+	}
+
+	b.manager.lock.Unlock()
+}
+
+func (b *lockCheckingBroker) Subscribe(subject string) (broker.Subscription, error) {
+	if b.manager != nil {
+		b.checkUnlocked("Subscribe")
+	}
+
+	return b.Broker.Subscribe(subject)
+}
+
+func (b *lockCheckingBroker) Claim(key, owner string, ttl time.Duration) (string, error) {
+	b.checkUnlocked("Claim")
+	return b.Broker.Claim(key, owner, ttl)
+}
+
+func (b *lockCheckingBroker) Release(key, owner string) error {
+	b.checkUnlocked("Release")
+	return b.Broker.Release(key, owner)
+}
+
+func TestBrokerCallsOutsideLock(t *testing.T) {
+	memory := broker.NewMemory()
+	defer memory.Close()
+
+	b := &lockCheckingBroker{Broker: memory, t: t}
+	conns := newFakeConnManager()
+	m := newTestManager(t, conns, b, "A")
+	b.manager = m
+
+	host := conns.connect(t)
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+	conns.expectEvent(t, host, currentStateEventName)
+
+	if err := m.CloseRoom(m.Rooms()[0].ID); err != nil {
+		t.Fatalf("error closing room: %s", err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("error marshaling: %s", err)
+	}
+
+	return string(data)
+}
+
+func TestCommandLimits(t *testing.T) {
+	conns := newFakeConnManager()
+	_, err := NewManager(conns, Options{
+		Logger:                 slog.New(slog.NewTextHandler(io.Discard, nil)),
+		MaxNoteLength:          5,
+		MaxNotesPerParticipant: 1,
+		MaxRoomNameLength:      5,
+		MaxNicknameLength:      5,
+	})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	client := conns.connect(t)
+
+	t.Run("long nicknames are rejected", func(t *testing.T) {
+		conns.send(t, client, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Too long"})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: identifyCommandName, Message: "nickname is too long (8 characters, maximum is 5)"}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+
+	t.Run("long room names are rejected", func(t *testing.T) {
+		conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Too long"})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: createRoomCommandName, Message: "room name is too long (8 characters, maximum is 5)"}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+
+	conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+	conns.expectEvent(t, client, currentStateEventName)
+	conns.send(t, client, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Running)})
+	conns.expectEvent(t, client, stateChangedEventName)
+
+	saveNote := func(id, revision uint, text string) saveNoteCommand {
+		return saveNoteCommand{command: command{Name: saveNoteCommentName}, ID: id, Revision: revision, Text: text, Mood: uint(PositiveMood)}
+	}
+
+	t.Run("long notes are rejected", func(t *testing.T) {
+		conns.send(t, client, saveNote(0, 0, "Too long"))
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: saveNoteCommentName, Message: "note is too long (8 characters, maximum is 5)"}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+
+	t.Run("participants cannot write too many notes", func(t *testing.T) {
+		conns.send(t, client, saveNote(0, 0, "Hello"))
+		conns.expectEvent(t, client, noteSavedEventName)
+		// updating an existing note is still possible
+		conns.send(t, client, saveNote(0, 1, "World"))
+		conns.expectEvent(t, client, noteSavedEventName)
+		conns.send(t, client, saveNote(1, 0, "Again"))
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: saveNoteCommentName, Message: "too many notes (maximum is 1)"}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+}
+
+func TestNoteConflicts(t *testing.T) {
+	conns := newFakeConnManager()
+	_, err := NewManager(conns, Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	client := conns.connect(t)
+	conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+	conns.expectEvent(t, client, currentStateEventName)
+	conns.send(t, client, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Running)})
+	conns.expectEvent(t, client, stateChangedEventName)
+
+	saveNote := func(revision uint, text string) saveNoteCommand {
+		return saveNoteCommand{command: command{Name: saveNoteCommentName}, ID: 0, Revision: revision, Text: text, Mood: uint(PositiveMood)}
+	}
+
+	current := Note{ID: 0, Revision: 2, AuthorID: client, Text: "Second tab", Mood: PositiveMood}
+
+	conns.send(t, client, saveNote(0, "First tab"))
+	conns.expectEvent(t, client, noteSavedEventName)
+	conns.send(t, client, saveNote(1, "Second tab"))
+	checkEqual(t, mustMarshal(t, current), conns.expectEvent(t, client, noteSavedEventName))
+
+	t.Run("stale updates are rejected with the current note", func(t *testing.T) {
+		conns.send(t, client, saveNote(1, "First tab again"))
+		checkEqual(t, mustMarshal(t, current), conns.expectEvent(t, client, noteConflictEventName))
+	})
+
+	t.Run("retried creations are rejected with the current note", func(t *testing.T) {
+		conns.send(t, client, saveNote(0, "First tab"))
+		checkEqual(t, mustMarshal(t, current), conns.expectEvent(t, client, noteConflictEventName))
+	})
+}
+
+func TestProtocolVersions(t *testing.T) {
+	conns := newFakeConnManager()
+	_, err := NewManager(conns, Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	t.Run("clients speaking unsupported versions are rejected", func(t *testing.T) {
+		client := conns.connectWithVersion(t, nil, ProtocolVersion+1)
+		conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: createRoomCommandName, Message: fmt.Sprintf("unsupported protocol version %d (supported versions are 0 to %d)", ProtocolVersion+1, ProtocolVersion)}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+
+	t.Run("unversioned clients overwrite their notes", func(t *testing.T) {
+		client := conns.connectWithVersion(t, nil, unversionedProtocol)
+		conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+		conns.expectEvent(t, client, currentStateEventName)
+		conns.send(t, client, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Running)})
+		conns.expectEvent(t, client, stateChangedEventName)
+
+		for i, text := range []string{"First", "Second"} {
+			conns.send(t, client, saveNoteCommand{command: command{Name: saveNoteCommentName}, ID: 0, Text: text, Mood: uint(PositiveMood)})
+
+			expected := Note{ID: 0, Revision: uint(i + 1), AuthorID: client, Text: text, Mood: PositiveMood}
+			checkEqual(t, mustMarshal(t, expected), conns.expectEvent(t, client, noteSavedEventName))
+		}
+	})
+
+	t.Run("older clients read participant IDs from clientId", func(t *testing.T) {
+		host := conns.connect(t)
+		conns.send(t, host, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Host"})
+		conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+
+		var roomState struct {
+			ID string
+		}
+		if err := json.Unmarshal([]byte(conns.expectEvent(t, host, currentStateEventName)), &roomState); err != nil {
+			t.Fatalf("error unmarshaling state: %s", err)
+		}
+
+		guest := conns.connectWithVersion(t, nil, noteRevisionsProtocol)
+		conns.send(t, guest, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Guest"})
+		conns.send(t, guest, joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: roomState.ID})
+
+		type participant struct {
+			ParticipantID ParticipantID `json:"participantId"`
+			ClientID      ParticipantID `json:"clientId"`
+		}
+
+		var guestState struct {
+			Participants []participant
+		}
+		if err := json.Unmarshal([]byte(conns.expectEvent(t, guest, currentStateEventName)), &guestState); err != nil {
+			t.Fatalf("error unmarshaling state: %s", err)
+		}
+
+		checkEqual(t, []participant{{ClientID: ParticipantIDOf(host)}, {ClientID: ParticipantIDOf(guest)}}, guestState.Participants)
+
+		var added participant
+		if err := json.Unmarshal([]byte(conns.expectEvent(t, host, participantAddedEventName)), &added); err != nil {
+			t.Fatalf("error unmarshaling participant: %s", err)
+		}
+
+		checkEqual(t, participant{ParticipantID: ParticipantIDOf(guest)}, added)
+	})
+}
+
+func TestVerifiedNames(t *testing.T) {
+	conns := newFakeConnManager()
+	_, err := NewManager(conns, Options{
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		VerifiedNames: true,
+	})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	t.Run("the verified name replaces the nickname", func(t *testing.T) {
+		client := conns.connectAs(t, &sseconn.Identity{Subject: "alice", Name: "Alice Liddell", Email: "alice@example.com"})
+		conns.send(t, client, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Mallory"})
+		conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+
+		var state struct {
+			Participants []struct {
+				Name string
+			}
+		}
+		if err := json.Unmarshal([]byte(conns.expectEvent(t, client, currentStateEventName)), &state); err != nil {
+			t.Fatalf("error unmarshaling state: %s", err)
+		}
+
+		checkEqual(t, 1, len(state.Participants))
+		checkEqual(t, "Alice Liddell", state.Participants[0].Name)
+	})
+
+	t.Run("the email is used for identities without a name", func(t *testing.T) {
+		client := conns.connectAs(t, &sseconn.Identity{Subject: "bob", Email: "bob@example.com"})
+		conns.send(t, client, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Mallory"})
+		conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+
+		var state struct {
+			Participants []struct {
+				Name string
+			}
+		}
+		if err := json.Unmarshal([]byte(conns.expectEvent(t, client, currentStateEventName)), &state); err != nil {
+			t.Fatalf("error unmarshaling state: %s", err)
+		}
+
+		checkEqual(t, "bob@example.com", state.Participants[0].Name)
+	})
+
+	t.Run("anonymous clients cannot identify", func(t *testing.T) {
+		client := conns.connect(t)
+		conns.send(t, client, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Mallory"})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: identifyCommandName, Message: "authentication required"}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+}
+
+func TestTeamHistory(t *testing.T) {
+	conns := newFakeConnManager()
+	m, err := NewManager(conns, Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	team, err := m.CreateTeam("Team")
+	if err != nil {
+		t.Fatalf("error creating team: %s", err)
+	}
+
+	host, guest := conns.connect(t), conns.connect(t)
+	conns.send(t, host, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Host"})
+	conns.send(t, guest, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Guest"})
+
+	t.Run("rooms cannot be created for unknown teams", func(t *testing.T) {
+		conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", TeamID: "unknown"})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: createRoomCommandName, Message: "unknown team"}),
+			conns.expectEvent(t, host, commandErrorEventName),
+		)
+	})
+
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", TeamID: team.ID})
+	conns.expectEvent(t, host, currentStateEventName)
+	roomID := m.Rooms()[0].ID
+
+	conns.send(t, guest, joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: roomID.String()})
+	conns.expectEvent(t, host, participantAddedEventName)
+	conns.expectEvent(t, guest, currentStateEventName)
+
+	conns.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Running)})
+	conns.expectEvent(t, host, stateChangedEventName)
+	conns.expectEvent(t, guest, stateChangedEventName)
+
+	conns.send(t, guest, saveNoteCommand{command: command{Name: saveNoteCommentName}, ID: 0, Text: "Good", Mood: uint(PositiveMood)})
+	conns.expectEvent(t, guest, noteSavedEventName)
+
+	conns.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(ActionPoints)})
+	for _, clientID := range []sseconn.ClientID{host, guest} {
+		conns.expectEvent(t, clientID, stateChangedEventName)
+		conns.expectEvent(t, clientID, currentStateEventName)
+	}
+
+	conns.send(t, guest, saveActionItemCommand{command: command{Name: saveActionItemCommandName}, ID: 0, Text: "Keep going"})
+	conns.expectEvent(t, host, actionItemSavedEventName)
+	conns.expectEvent(t, guest, actionItemSavedEventName)
+
+	t.Run("only the host can close the room", func(t *testing.T) {
+		conns.send(t, guest, command{Name: closeRoomCommandName})
+		// the next command is only handled after close-room
+		conns.send(t, guest, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Guest"})
+		conns.expectEvent(t, host, participantUpdatedEventName)
+		checkEqual(t, 1, len(m.Rooms()))
+	})
+
+	t.Run("closing the room saves it in the team history", func(t *testing.T) {
+		conns.send(t, host, command{Name: closeRoomCommandName})
+		conns.expectEvent(t, host, roomClosedEventName)
+		conns.expectEvent(t, guest, roomClosedEventName)
+
+		retros, err := m.TeamRetros(team.ID)
+		if err != nil {
+			t.Fatalf("error listing team retros: %s", err)
+		}
+
+		checkEqual(t, 1, len(retros))
+		checkEqual(t, roomID.String(), retros[0].ID)
+		checkEqual(t, team.ID, retros[0].TeamID)
+		checkEqual(t, []string{"Host", "Guest"}, retros[0].Participants)
+		checkEqual(t, []history.Note{{Text: "Good", Mood: int(PositiveMood)}}, retros[0].Notes)
+		checkEqual(t, []history.ActionItem{{Text: "Keep going"}}, retros[0].ActionItems)
+	})
+}
+
+func TestCarryOverActionItems(t *testing.T) {
+	store := history.NewMemory()
+	conns := newFakeConnManager()
+	m, err := NewManager(conns, Options{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		History: store,
+	})
+	if err != nil {
+		t.Fatalf("error creating manager: %s", err)
+	}
+
+	team, err := m.CreateTeam("Team")
+	if err != nil {
+		t.Fatalf("error creating team: %s", err)
+	}
+
+	otherTeam, err := m.CreateTeam("Other team")
+	if err != nil {
+		t.Fatalf("error creating team: %s", err)
+	}
+
+	for _, previous := range []history.Retro{
+		{ID: "first", TeamID: team.ID, ActionItems: []history.ActionItem{{Text: "From the first retro"}}},
+		{ID: "second", TeamID: team.ID, ActionItems: []history.ActionItem{{Text: "Done", Done: true}, {Text: "Not done"}}},
+		{ID: "other", TeamID: otherTeam.ID, ActionItems: []history.ActionItem{{Text: "Secret"}}},
+	} {
+		if err := store.SaveRetro(previous); err != nil {
+			t.Fatalf("error saving retro: %s", err)
+		}
+	}
+
+	client := conns.connect(t)
+
+	createRoom := func(t *testing.T, cmd createRoomCommand) []ActionItem {
+		t.Helper()
+
+		cmd.command = command{Name: createRoomCommandName}
+		cmd.RoomName = "Retro"
+		conns.send(t, client, cmd)
+
+		var state struct {
+			ActionItems []ActionItem
+		}
+		if err := json.Unmarshal([]byte(conns.expectEvent(t, client, currentStateEventName)), &state); err != nil {
+			t.Fatalf("error unmarshaling state: %s", err)
+		}
+
+		return state.ActionItems
+	}
+
+	t.Run("the last retro of the team is used by default", func(t *testing.T) {
+		checkEqual(
+			t,
+			[]ActionItem{{ID: firstCarriedOverActionItemID, Text: "Not done", CarriedOver: true}},
+			createRoom(t, createRoomCommand{TeamID: team.ID}),
+		)
+	})
+
+	t.Run("a previous retro can be referenced by ID", func(t *testing.T) {
+		checkEqual(
+			t,
+			[]ActionItem{{ID: firstCarriedOverActionItemID, Text: "From the first retro", CarriedOver: true}},
+			createRoom(t, createRoomCommand{TeamID: team.ID, PreviousRetroID: "first"}),
+		)
+	})
+
+	t.Run("rooms without team start without action items", func(t *testing.T) {
+		checkEqual(t, []ActionItem{}, createRoom(t, createRoomCommand{}))
+	})
+
+	t.Run("unknown previous retros are rejected", func(t *testing.T) {
+		conns.send(t, client, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", PreviousRetroID: "unknown"})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: createRoomCommandName, Message: "unknown previous retro"}),
+			conns.expectEvent(t, client, commandErrorEventName),
+		)
+	})
+
+	t.Run("previous retros of other teams are rejected", func(t *testing.T) {
+		for _, cmd := range []createRoomCommand{
+			{TeamID: team.ID, PreviousRetroID: "other"},
+			{PreviousRetroID: "first"},
+		} {
+			cmd.command = command{Name: createRoomCommandName}
+			cmd.RoomName = "Retro"
+			conns.send(t, client, cmd)
+			checkEqual(
+				t,
+				mustMarshal(t, commandError{Command: createRoomCommandName, Message: "previous retro belongs to another team"}),
+				conns.expectEvent(t, client, commandErrorEventName),
+			)
+		}
+	})
+}
+
+func TestCheckInCommands(t *testing.T) {
+	conns := newFakeConnManager()
+	newTestManager(t, conns, nil, "")
+
+	host := conns.connect(t)
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", CheckIn: true})
+
+	var state struct {
+		CheckIns json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(conns.expectEvent(t, host, currentStateEventName)), &state); err != nil {
+		t.Fatalf("error unmarshaling state: %s", err)
+	}
+
+	checkEqual(t, `{"revealed":false,"answered":[],"checkIns":{}}`, string(state.CheckIns))
+
+	conns.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(CheckingIn)})
+	conns.expectEvent(t, host, stateChangedEventName)
+
+	t.Run("invalid check-ins are rejected", func(t *testing.T) {
+		conns.send(t, host, checkInCommand{command: command{Name: checkInCommandName}, CheckIn: CheckIn{Score: 10}})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: checkInCommandName, Message: "check-in scores are between 1 and 5"}),
+			conns.expectEvent(t, host, commandErrorEventName),
+		)
+	})
+
+	t.Run("check-ins are revealed with their summary", func(t *testing.T) {
+		conns.send(t, host, checkInCommand{command: command{Name: checkInCommandName}, CheckIn: CheckIn{Score: 5}})
+
+		hostID := ParticipantIDOf(host)
+		checkEqual(
+			t,
+			`{"revealed":true,"answered":["`+string(hostID)+`"],"checkIns":{"`+string(hostID)+`":{"score":5}},"summary":{"count":1,"averageScore":5,"scoreCounts":{"5":1},"words":[]}}`,
+			conns.expectEvent(t, host, checkInsUpdatedEventName),
+		)
+	})
+}
+
+func TestAgendaCommands(t *testing.T) {
+	conns := newFakeConnManager()
+	newTestManager(t, conns, nil, "")
+
+	host := conns.connect(t)
+
+	t.Run("unknown phases are rejected", func(t *testing.T) {
+		conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", Agenda: []string{"write", "party"}})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: createRoomCommandName, Message: `unknown phase "party"`}),
+			conns.expectEvent(t, host, commandErrorEventName),
+		)
+	})
+
+	t.Run("checkIn cannot be used with an agenda", func(t *testing.T) {
+		conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", Agenda: []string{"write"}, CheckIn: true})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: createRoomCommandName, Message: "checkIn cannot be used with an agenda, add a check-in phase to the agenda instead"}),
+			conns.expectEvent(t, host, commandErrorEventName),
+		)
+	})
+
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro", Agenda: []string{"write", "vote", "close"}})
+
+	var state struct {
+		Agenda []State
+	}
+	if err := json.Unmarshal([]byte(conns.expectEvent(t, host, currentStateEventName)), &state); err != nil {
+		t.Fatalf("error unmarshaling state: %s", err)
+	}
+
+	checkEqual(t, []State{Running, Voting, Closing}, state.Agenda)
+
+	t.Run("phases follow the agenda", func(t *testing.T) {
+		conns.send(t, host, command{Name: nextPhaseCommandName})
+		checkEqual(t, mustMarshal(t, Running), conns.expectEvent(t, host, stateChangedEventName))
+
+		conns.send(t, host, command{Name: nextPhaseCommandName})
+		checkEqual(t, mustMarshal(t, Voting), conns.expectEvent(t, host, stateChangedEventName))
+		conns.expectEvent(t, host, currentStateEventName)
+
+		conns.send(t, host, command{Name: previousPhaseCommandName})
+		checkEqual(t, mustMarshal(t, Running), conns.expectEvent(t, host, stateChangedEventName))
+	})
+
+	t.Run("set-state cannot skip phases", func(t *testing.T) {
+		conns.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Closing)})
+		conns.send(t, host, setStateCommand{command: command{Name: setStateCommandName}, State: uint(Voting)})
+		checkEqual(t, mustMarshal(t, Voting), conns.expectEvent(t, host, stateChangedEventName))
+		conns.expectEvent(t, host, currentStateEventName)
+	})
+
+	t.Run("the number of votes is limited", func(t *testing.T) {
+		conns.send(t, host, command{Name: previousPhaseCommandName})
+		conns.expectEvent(t, host, stateChangedEventName)
+
+		for i := uint(0); i <= DefaultMaxVotesPerParticipant; i++ {
+			conns.send(t, host, saveNoteCommand{command: command{Name: saveNoteCommentName}, ID: i, Text: "Note", Mood: uint(PositiveMood)})
+			conns.expectEvent(t, host, noteSavedEventName)
+		}
+
+		conns.send(t, host, command{Name: nextPhaseCommandName})
+		conns.expectEvent(t, host, stateChangedEventName)
+		conns.expectEvent(t, host, currentStateEventName)
+
+		for i := uint(0); i < DefaultMaxVotesPerParticipant; i++ {
+			conns.send(t, host, voteCommand{command: command{Name: voteCommandName}, AuthorID: ParticipantIDOf(host), NoteID: i, Vote: true})
+			checkEqual(
+				t,
+				mustMarshal(t, NoteVotes{AuthorID: host, NoteID: i, Count: 1}),
+				conns.expectEvent(t, host, voteSavedEventName),
+			)
+		}
+
+		conns.send(t, host, voteCommand{command: command{Name: voteCommandName}, AuthorID: ParticipantIDOf(host), NoteID: DefaultMaxVotesPerParticipant, Vote: true})
+		checkEqual(
+			t,
+			mustMarshal(t, commandError{Command: voteCommandName, Message: "too many votes (maximum is 3)"}),
+			conns.expectEvent(t, host, commandErrorEventName),
+		)
+	})
+
+	t.Run("the room can only be closed during the close phase", func(t *testing.T) {
+		conns.send(t, host, command{Name: closeRoomCommandName})
+		conns.send(t, host, command{Name: nextPhaseCommandName})
+		checkEqual(t, mustMarshal(t, Closing), conns.expectEvent(t, host, stateChangedEventName))
+		conns.expectEvent(t, host, currentStateEventName) // with the votes of everybody
+
+		conns.send(t, host, command{Name: closeRoomCommandName})
+		conns.expectEvent(t, host, roomClosedEventName)
+	})
+}
+
+func TestEventVersions(t *testing.T) {
+	conns := newFakeConnManager()
+	newTestManager(t, conns, nil, "")
+
+	host := conns.connect(t)
+	conns.send(t, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+
+	ev := conns.receiveEvent(t, host, currentStateEventName)
+	checkEqual(t, sseconn.EventVersion{Version: 1}, ev.Version)
+
+	state := ev.Payload.(SerializedRetro)
+	checkEqual(t, uint64(1), state.Version)
+
+	guest := conns.connect(t)
+	conns.send(t, guest, joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: state.ID.String()})
+
+	checkEqual(t, sseconn.EventVersion{Version: 2, Previous: 1}, conns.receiveEvent(t, host, participantAddedEventName).Version)
+	checkEqual(t, sseconn.EventVersion{Version: 2}, conns.receiveEvent(t, guest, currentStateEventName).Version)
+
+	t.Run("clients can resync", func(t *testing.T) {
+		conns.send(t, guest, command{Name: resyncCommandName})
+
+		ev := conns.receiveEvent(t, guest, currentStateEventName)
+		checkEqual(t, sseconn.EventVersion{Version: 3, Previous: 2}, ev.Version)
+		checkEqual(t, uint64(3), ev.Payload.(SerializedRetro).Version)
+	})
+
+	t.Run("events follow the version of the room", func(t *testing.T) {
+		conns.send(t, guest, identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Guest"})
+		checkEqual(t, sseconn.EventVersion{Version: 4, Previous: 2}, conns.receiveEvent(t, host, participantUpdatedEventName).Version)
+	})
+}
+
+func BenchmarkRooms(b *testing.B) {
+	for _, rooms := range []int{1, 100, 500} {
+		b.Run(fmt.Sprintf("%d rooms", rooms), func(b *testing.B) {
+			benchmarkRooms(b, rooms)
+		})
+	}
+}
+
+// benchmarkRooms measures the throughput of the Manager when commands are
+// spread across concurrent rooms. In each room, a host keeps renaming
+// themselves and a guest receives the updates.
+func benchmarkRooms(b *testing.B, roomCount int) {
+	conns := newFakeConnManager()
+	if _, err := NewManager(conns, Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}); err != nil {
+		b.Fatalf("error creating manager: %s", err)
+	}
+
+	type benchRoom struct {
+		host, guest sseconn.ClientID
+	}
+
+	rooms := make([]benchRoom, roomCount)
+
+	for i := range rooms {
+		host := conns.connect(b)
+		conns.send(b, host, createRoomCommand{command: command{Name: createRoomCommandName}, RoomName: "Retro"})
+
+		var state struct {
+			ID sseconn.ClientID
+		}
+		if err := json.Unmarshal([]byte(conns.expectEvent(b, host, currentStateEventName)), &state); err != nil {
+			b.Fatalf("error unmarshaling state: %s", err)
+		}
+
+		guest := conns.connect(b)
+		conns.send(b, guest, joinRoomCommand{command: command{Name: joinRoomCommandName}, RoomID: state.ID.String()})
+		conns.expectEvent(b, guest, currentStateEventName)
+		conns.expectEvent(b, host, participantAddedEventName)
+
+		rooms[i] = benchRoom{host: host, guest: guest}
+	}
+
+	identify, err := json.Marshal(identifyCommand{command: command{Name: identifyCommandName}, Nickname: "Host"})
+	if err != nil {
+		b.Fatalf("error marshaling command: %s", err)
+	}
+
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+
+	for i, r := range rooms {
+		commands := b.N / roomCount
+		if i < b.N%roomCount {
+			commands++
+		}
+
+		conns.lock.Lock()
+		listener, events := conns.listeners[r.host], conns.events[r.guest]
+		conns.lock.Unlock()
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < commands; j++ {
+				listener <- identify
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < commands; j++ {
+				<-events
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -1,10 +1,59 @@
 package retro
 
-import "github.com/abustany/goretro/sseconn"
+import (
+	"encoding/json"
+
+	"github.com/abustany/goretro/sseconn"
+)
 
 type Note struct {
 	ID       uint             `json:"id"`
+	Revision uint             `json:"revision"` // incremented on each save
 	AuthorID sseconn.ClientID `json:"authorId"`
 	Text     string           `json:"text"`
 	Mood     Mood             `json:"mood"`
+	Group    uint             `json:"group,omitempty"` // set during the group phase, 0 if not grouped
+}
+
+func (n Note) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID       uint          `json:"id"`
+		Revision uint          `json:"revision"`
+		AuthorID ParticipantID `json:"authorId"`
+		Text     string        `json:"text"`
+		Mood     Mood          `json:"mood"`
+		Group    uint          `json:"group,omitempty"`
+	}{
+		ID:       n.ID,
+		Revision: n.Revision,
+		AuthorID: ParticipantIDOf(n.AuthorID),
+		Text:     n.Text,
+		Mood:     n.Mood,
+		Group:    n.Group,
+	})
+}
+
+// noteRef identifies a note amongst the notes of all participants.
+type noteRef struct {
+	authorID sseconn.ClientID
+	noteID   uint
+}
+
+// findNoteLocked looks up a note by the participant ID of its author, since
+// participants don't know the client IDs of the others. It returns the note
+// and its position in the notes of its author.
+func (r *Retro) findNoteLocked(authorID ParticipantID, noteID uint) (noteRef, int, bool) {
+	for clientID, notes := range r.notes {
+		if ParticipantIDOf(clientID) != authorID {
+			continue
+		}
+
+		for i, n := range notes {
+			if n.ID == noteID {
+				return noteRef{authorID: clientID, noteID: noteID}, i, true
+			}
+		}
+	}
+
+	return noteRef{}, 0, false
 }
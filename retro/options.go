@@ -0,0 +1,116 @@
+package retro
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/abustany/goretro/broker"
+	"github.com/abustany/goretro/history"
+)
+
+const (
+	DefaultMaxNoteLength          = 2000
+	DefaultMaxNotesPerParticipant = 100
+	DefaultMaxVotesPerParticipant = 3
+	DefaultMaxRoomNameLength      = 100
+	DefaultMaxNicknameLength      = 50
+	DefaultRoomClaimTTL           = 30 * time.Second
+)
+
+// Options configures a Manager. Zero values are replaced by their defaults.
+type Options struct {
+	// Logger receives the log messages of the Manager. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+
+	// Broker connects the Manager to the other replicas of the cluster.
+	// Defaults to an in-process broker, suitable for a single replica.
+	Broker broker.Broker
+
+	// History stores the teams and their completed retros. Defaults to an
+	// in-memory store.
+	History history.Store
+
+	// ReplicaID identifies this Manager amongst the replicas sharing the same
+	// Broker. Defaults to a random ID.
+	ReplicaID string
+
+	// RoomClaimTTL is how long the claim of this replica on a room it hosts
+	// survives without being refreshed, for example after the replica
+	// stopped. Other replicas can only create a room with the same ID once
+	// the claim expired.
+	RoomClaimTTL time.Duration
+
+	// MaxNoteLength is the maximum number of characters in a note.
+	MaxNoteLength int
+
+	// MaxNotesPerParticipant is the maximum number of notes a participant can
+	// write in a retro.
+	MaxNotesPerParticipant int
+
+	// MaxVotesPerParticipant is the maximum number of notes a participant can
+	// vote for during the vote phase of a retro.
+	MaxVotesPerParticipant int
+
+	// MaxRoomNameLength is the maximum number of characters in a room name.
+	MaxRoomNameLength int
+
+	// MaxNicknameLength is the maximum number of characters in a nickname.
+	MaxNicknameLength int
+
+	// VerifiedNames replaces the nicknames chosen by participants with the
+	// name of the identity verified by the authentication layer (see
+	// sseconn.Identity). Clients without a verified identity cannot identify.
+	VerifiedNames bool
+}
+
+func (o Options) withDefaults() (Options, error) {
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	if o.Broker == nil {
+		o.Broker = broker.NewMemory()
+	}
+
+	if o.History == nil {
+		o.History = history.NewMemory()
+	}
+
+	if o.RoomClaimTTL <= 0 {
+		o.RoomClaimTTL = DefaultRoomClaimTTL
+	}
+
+	if o.MaxNoteLength <= 0 {
+		o.MaxNoteLength = DefaultMaxNoteLength
+	}
+
+	if o.MaxNotesPerParticipant <= 0 {
+		o.MaxNotesPerParticipant = DefaultMaxNotesPerParticipant
+	}
+
+	if o.MaxVotesPerParticipant <= 0 {
+		o.MaxVotesPerParticipant = DefaultMaxVotesPerParticipant
+	}
+
+	if o.MaxRoomNameLength <= 0 {
+		o.MaxRoomNameLength = DefaultMaxRoomNameLength
+	}
+
+	if o.MaxNicknameLength <= 0 {
+		o.MaxNicknameLength = DefaultMaxNicknameLength
+	}
+
+	if o.ReplicaID == "" {
+		var id [8]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return o, err
+		}
+
+		o.ReplicaID = hex.EncodeToString(id[:])
+	}
+
+	return o, nil
+}
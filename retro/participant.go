@@ -1,9 +1,43 @@
 package retro
 
-import "github.com/abustany/goretro/sseconn"
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/abustany/goretro/sseconn"
+)
 
 type Participant struct {
 	ClientID        sseconn.ClientID `json:"clientId"`
 	Name            string           `json:"name"`
 	FinishedWriting bool             `json:"finishedWriting,omitempty"`
 }
+
+// ParticipantID identifies a participant towards the other participants.
+// Client IDs are private to each client, so everything sent to clients refers
+// to participants by their ParticipantID instead.
+type ParticipantID string
+
+// participantIDLength is the number of bytes of the client ID hash kept in a
+// ParticipantID.
+const participantIDLength = 16
+
+// ParticipantIDOf returns the public ID of a client. It is the same on all
+// replicas.
+func ParticipantIDOf(clientID sseconn.ClientID) ParticipantID {
+	sum := sha256.Sum256(clientID[:])
+	return ParticipantID(base64.RawURLEncoding.EncodeToString(sum[:participantIDLength]))
+}
+
+func (p Participant) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ParticipantID   ParticipantID `json:"participantId"`
+		Name            string        `json:"name"`
+		FinishedWriting bool          `json:"finishedWriting,omitempty"`
+	}{
+		ParticipantID:   ParticipantIDOf(p.ClientID),
+		Name:            p.Name,
+		FinishedWriting: p.FinishedWriting,
+	})
+}
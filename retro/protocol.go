@@ -0,0 +1,114 @@
+package retro
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/abustany/goretro/sseconn"
+)
+
+// Versions of the protocol spoken between the clients and the Manager. They
+// are negotiated by the hello command of sseconn, configured with
+// MinProtocolVersion and ProtocolVersion.
+const (
+	// clients that predate protocol versions send none. Their notes have no
+	// revisions: saving a note overwrites it.
+	unversionedProtocol = 0
+
+	// save-note carries the revision the note was edited from, and stale
+	// edits are rejected (see Retro.SaveNote).
+	noteRevisionsProtocol = 1
+
+	// participants are identified by their participantId field, which older
+	// clients receive as clientId (see payloadForProtocol).
+	participantIDsProtocol = 2
+)
+
+const (
+	// MinProtocolVersion is the oldest protocol version the Manager supports.
+	MinProtocolVersion = unversionedProtocol
+
+	// ProtocolVersion is the newest protocol version the Manager supports.
+	ProtocolVersion = participantIDsProtocol
+)
+
+// protocolVersion returns the protocol version spoken by clientID, which can
+// be connected to this replica or to another one.
+func (m *Manager) protocolVersion(clientID sseconn.ClientID) int {
+	if version, ok := m.connManager.ProtocolVersion(clientID); ok {
+		return version
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.clientInfo[clientID].protocolVersion
+}
+
+func checkProtocolVersion(version int) error {
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return validationError{message: fmt.Sprintf("unsupported protocol version %d (supported versions are %d to %d)", version, MinProtocolVersion, ProtocolVersion)}
+	}
+
+	return nil
+}
+
+// payloadForProtocol returns the payload of an event as clients speaking the
+// given protocol version expect it.
+func payloadForProtocol(payload interface{}, version int) interface{} {
+	if version >= participantIDsProtocol {
+		return payload
+	}
+
+	switch p := payload.(type) {
+	case Participant:
+		return legacyParticipant(p)
+	case SerializedRetro:
+		return legacySerializedRetro(p)
+	default:
+		return payload
+	}
+}
+
+// legacyParticipant marshals a Participant for clients older than
+// participantIDsProtocol, which read its participant ID from clientId.
+type legacyParticipant Participant
+
+func (p legacyParticipant) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ClientID        ParticipantID `json:"clientId"`
+		Name            string        `json:"name"`
+		FinishedWriting bool          `json:"finishedWriting,omitempty"`
+	}{
+		ClientID:        ParticipantIDOf(p.ClientID),
+		Name:            p.Name,
+		FinishedWriting: p.FinishedWriting,
+	})
+}
+
+// legacySerializedRetro marshals a SerializedRetro for clients older than
+// participantIDsProtocol.
+type legacySerializedRetro SerializedRetro
+
+func (s legacySerializedRetro) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(SerializedRetro(s))
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	participants := make([]legacyParticipant, len(s.Participants))
+	for i, p := range s.Participants {
+		participants[i] = legacyParticipant(p)
+	}
+
+	if fields["participants"], err = json.Marshal(participants); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
@@ -1,8 +1,13 @@
 package retro
 
 import (
+	"bytes"
+	"encoding/json"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/abustany/goretro/history"
 	"github.com/abustany/goretro/sseconn"
 )
 
@@ -10,30 +15,148 @@ type Retro struct {
 	sync.Mutex
 	id           sseconn.ClientID
 	name         string
+	teamID       string // optional
+	createdAt    time.Time
 	state        State
+	agenda       []State          // phases of the retro, in order
 	hostID       sseconn.ClientID // ID of the room "admin"
 	participants []Participant
 	notes        map[sseconn.ClientID][]Note
+	actionItems  []ActionItem
+	votes        map[sseconn.ClientID]map[noteRef]bool // notes each participant voted for
+
+	checkIns         map[sseconn.ClientID]CheckIn // nil if the retro has no check-in phase
+	checkInsRevealed bool
+
+	version      uint64                      // incremented by stampEvents
+	sentVersions map[sseconn.ClientID]uint64 // version of the last event sent to each participant
 }
 
 type SerializedRetro struct {
 	ID           sseconn.ClientID            `json:"id"`
 	Name         string                      `json:"name"`
 	State        State                       `json:"state"`
+	Agenda       []State                     `json:"agenda"`
 	HostID       sseconn.ClientID            `json:"hostId"`
 	Participants []Participant               `json:"participants"`
 	Notes        map[sseconn.ClientID][]Note `json:"notes"`
+	TeamID       string                      `json:"teamId,omitempty"`
+	ActionItems  []ActionItem                `json:"actionItems"`
+	CheckIns     *CheckInResults             `json:"checkIns,omitempty"`
+	Votes        []NoteVotes                 `json:"votes,omitempty"`
+	Version      uint64                      `json:"version"`
+
+	// SelfID is the client the retro was serialized for, if any. It lets
+	// clients recognize themselves amongst the participants.
+	SelfID sseconn.ClientID `json:"selfId"`
+}
+
+// MarshalJSON replaces all client IDs with participant IDs, so that clients
+// never learn the client IDs of the other participants.
+func (s SerializedRetro) MarshalJSON() ([]byte, error) {
+	notes := make(map[ParticipantID][]Note, len(s.Notes))
+	for clientID, clientNotes := range s.Notes {
+		notes[ParticipantIDOf(clientID)] = clientNotes
+	}
+
+	var selfID ParticipantID
+	if !s.SelfID.IsZero() {
+		selfID = ParticipantIDOf(s.SelfID)
+	}
+
+	actionItems := s.ActionItems
+	if actionItems == nil {
+		actionItems = []ActionItem{}
+	}
+
+	return json.Marshal(struct {
+		ID           sseconn.ClientID         `json:"id"`
+		Name         string                   `json:"name"`
+		State        State                    `json:"state"`
+		Agenda       []State                  `json:"agenda"`
+		HostID       ParticipantID            `json:"hostId"`
+		Participants []Participant            `json:"participants"`
+		Notes        map[ParticipantID][]Note `json:"notes"`
+		TeamID       string                   `json:"teamId,omitempty"`
+		ActionItems  []ActionItem             `json:"actionItems"`
+		CheckIns     *CheckInResults          `json:"checkIns,omitempty"`
+		Votes        []NoteVotes              `json:"votes,omitempty"`
+		Version      uint64                   `json:"version"`
+		SelfID       ParticipantID            `json:"selfId,omitempty"`
+	}{
+		ID:           s.ID,
+		Name:         s.Name,
+		State:        s.State,
+		Agenda:       s.Agenda,
+		HostID:       ParticipantIDOf(s.HostID),
+		Participants: s.Participants,
+		Notes:        notes,
+		TeamID:       s.TeamID,
+		ActionItems:  actionItems,
+		CheckIns:     s.CheckIns,
+		Votes:        s.Votes,
+		Version:      s.Version,
+		SelfID:       selfID,
+	})
 }
 
 func NewRetro(id sseconn.ClientID, name string) *Retro {
 	return &Retro{
-		id:    id,
-		state: WaitingForParticipants,
-		name:  name,
-		notes: make(map[sseconn.ClientID][]Note),
+		id:           id,
+		state:        WaitingForParticipants,
+		agenda:       defaultAgenda(false, false),
+		name:         name,
+		createdAt:    time.Now(),
+		notes:        make(map[sseconn.ClientID][]Note),
+		votes:        make(map[sseconn.ClientID]map[noteRef]bool),
+		sentVersions: make(map[sseconn.ClientID]uint64),
 	}
 }
 
+// RoomInfo is a summary of a retro, meant for administration purposes.
+type RoomInfo struct {
+	ID           sseconn.ClientID `json:"id"`
+	Name         string           `json:"name"`
+	TeamID       string           `json:"teamId,omitempty"`
+	State        State            `json:"state"`
+	HostID       ParticipantID    `json:"hostId"`
+	HostName     string           `json:"hostName"`
+	Participants int              `json:"participants"`
+	CreatedAt    time.Time        `json:"createdAt"`
+}
+
+func (r *Retro) Info() RoomInfo {
+	r.Lock()
+	defer r.Unlock()
+
+	info := RoomInfo{
+		ID:           r.id,
+		Name:         r.name,
+		TeamID:       r.teamID,
+		State:        r.state,
+		HostID:       ParticipantIDOf(r.hostID),
+		Participants: len(r.participants),
+		CreatedAt:    r.createdAt,
+	}
+
+	for _, p := range r.participants {
+		if p.ClientID == r.hostID {
+			info.HostName = p.Name
+			break
+		}
+	}
+
+	return info
+}
+
+// Serialize returns the complete state of the retro, including all notes.
+func (r *Retro) Serialize() SerializedRetro {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.serializeLocked()
+}
+
 func (r *Retro) AddParticipant(newParticipant Participant) []Event {
 	r.Lock()
 	defer r.Unlock()
@@ -69,18 +192,10 @@ func (r *Retro) AddParticipant(newParticipant Participant) []Event {
 		r.hostID = newParticipant.ClientID
 	}
 
-	var payload interface{}
-
-	if r.state != ActionPoints {
-		payload = r.serializeForClientLocked(newParticipant.ClientID)
-	} else {
-		payload = r.serializeLocked()
-	}
-
 	events = append(events, Event{
 		Recipient: newParticipant.ClientID,
 		Name:      currentStateEventName,
-		Payload:   payload,
+		Payload:   r.serializeForClientLocked(newParticipant.ClientID),
 	})
 
 	return events
@@ -113,6 +228,12 @@ func (r *Retro) RemoveParticipant(clientID sseconn.ClientID) []Event {
 	}
 
 	r.participants = newParticipants
+	delete(r.sentVersions, clientID)
+
+	if r.state == CheckingIn && !r.checkInsRevealed && r.allCheckedInLocked() {
+		r.checkInsRevealed = true
+		events = append(events, r.checkInEventsLocked()...)
+	}
 
 	if r.hostID == clientID && len(r.participants) > 0 {
 		r.hostID = r.participants[0].ClientID
@@ -121,7 +242,7 @@ func (r *Retro) RemoveParticipant(clientID sseconn.ClientID) []Event {
 			events = append(events, Event{
 				Recipient: p.ClientID,
 				Name:      hostChangedEventName,
-				Payload:   r.hostID,
+				Payload:   ParticipantIDOf(r.hostID),
 			})
 		}
 	}
@@ -159,14 +280,34 @@ func (r *Retro) UpdateParticipant(updatedParticipant Participant) []Event {
 	return events
 }
 
+// SetState moves the retro to the phase right before or right after the
+// current one in its agenda, like NextPhase and PreviousPhase do.
 func (r *Retro) SetState(clientID sseconn.ClientID, state State) []Event {
 	r.Lock()
 	defer r.Unlock()
 
-	if clientID != r.hostID || state == WaitingForParticipants {
+	if clientID != r.hostID {
 		return nil
 	}
 
+	i := r.phaseIndexLocked()
+
+	if (i+1 < len(r.agenda) && r.agenda[i+1] == state) || (i > 0 && r.agenda[i-1] == state) {
+		return r.setStateLocked(state)
+	}
+
+	return nil
+}
+
+func (r *Retro) setStateLocked(state State) []Event {
+	notesWereVisible := phases[r.state].notesVisible
+	votesWereHidden := r.votesHiddenLocked()
+
+	if r.state == CheckingIn {
+		// everybody sees the check-in results once the check-in is over
+		r.checkInsRevealed = true
+	}
+
 	r.state = state
 
 	events := make([]Event, 0, len(r.participants))
@@ -179,14 +320,14 @@ func (r *Retro) SetState(clientID sseconn.ClientID, state State) []Event {
 		})
 	}
 
-	if state == ActionPoints {
-		serializedRetro := r.serializeLocked()
-
+	// participants already have the notes they saw in the previous phases, but
+	// not the votes of the others
+	if (phases[state].notesVisible && !notesWereVisible) || (votesWereHidden && !r.votesHiddenLocked()) {
 		for _, p := range r.participants {
 			events = append(events, Event{
 				Recipient: p.ClientID,
 				Name:      currentStateEventName,
-				Payload:   serializedRetro,
+				Payload:   r.serializeForClientLocked(p.ClientID),
 			})
 		}
 	}
@@ -194,16 +335,105 @@ func (r *Retro) SetState(clientID sseconn.ClientID, state State) []Event {
 	return events
 }
 
-func (r *Retro) SaveNote(clientID sseconn.ClientID, ID uint, text string, mood Mood) []Event {
+// SetHost makes clientID the host of the retro, regardless of who the current
+// host is. It returns ErrParticipantNotFound if clientID is not part of the
+// retro.
+func (r *Retro) SetHost(clientID sseconn.ClientID) ([]Event, error) {
 	r.Lock()
 	defer r.Unlock()
 
-	if r.state != Running {
+	found := false
+	for _, p := range r.participants {
+		if p.ClientID == clientID {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, ErrParticipantNotFound
+	}
+
+	if r.hostID == clientID {
+		return nil, nil
+	}
+
+	r.hostID = clientID
+
+	events := make([]Event, 0, len(r.participants))
+
+	for _, p := range r.participants {
+		events = append(events, Event{
+			Recipient: p.ClientID,
+			Name:      hostChangedEventName,
+			Payload:   ParticipantIDOf(r.hostID),
+		})
+	}
+
+	return events, nil
+}
+
+// canClose returns true if clientID can close the retro in the current phase
+// (see allowsClosingLocked). Only the host can close the retro.
+func (r *Retro) canClose(clientID sseconn.ClientID) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.hostID == clientID && r.allowsClosingLocked()
+}
+
+// clientIDOf returns the client ID of the participant with the given public
+// ID.
+func (r *Retro) clientIDOf(participantID ParticipantID) (sseconn.ClientID, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, p := range r.participants {
+		if ParticipantIDOf(p.ClientID) == participantID {
+			return p.ClientID, true
+		}
+	}
+
+	return sseconn.ClientID{}, false
+}
+
+// Close removes all participants from the retro, and notifies them that the
+// room was closed.
+func (r *Retro) Close() []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	events := make([]Event, 0, len(r.participants))
+
+	for _, p := range r.participants {
+		events = append(events, Event{
+			Recipient: p.ClientID,
+			Name:      roomClosedEventName,
+			Payload:   r.id,
+		})
+	}
+
+	r.participants = nil
+
+	return events
+}
+
+// SaveNote creates or updates a note of clientID. Updates must carry the
+// revision of the note they were made from: a stale update is rejected with a
+// note-conflict event carrying the current note, so that the author does not
+// overwrite changes made from another tab. The author is sent the saved note,
+// with its new revision.
+func (r *Retro) SaveNote(clientID sseconn.ClientID, ID uint, revision uint, text string, mood Mood) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowsLocked(saveNoteCommentName) {
 		return nil
 	}
 
 	note := Note{
 		ID:       ID,
+		Revision: 1,
 		AuthorID: clientID,
 		Text:     text,
 		Mood:     mood,
@@ -215,27 +445,178 @@ func (r *Retro) SaveNote(clientID sseconn.ClientID, ID uint, text string, mood M
 	)
 
 	for i, n := range notes {
+		if n.ID != ID {
+			continue
+		}
+
+		if n.Revision != revision {
+			return []Event{{
+				Recipient: clientID,
+				Name:      noteConflictEventName,
+				Payload:   n,
+			}}
+		}
+
+		note.Revision = n.Revision + 1
+		note.Group = n.Group
+		notes[i] = note
+		found = true
+		break
+	}
+
+	if !found {
+		notes = append(notes, note)
+	}
+
+	r.notes[clientID] = notes
+
+	return []Event{{
+		Recipient: clientID,
+		Name:      noteSavedEventName,
+		Payload:   note,
+	}}
+}
+
+// noteRevision returns the revision of a note of clientID, or 0 if it does not
+// exist.
+func (r *Retro) noteRevision(clientID sseconn.ClientID, ID uint) uint {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, n := range r.notes[clientID] {
+		if n.ID == ID {
+			return n.Revision
+		}
+	}
+
+	return 0
+}
+
+// canSaveNote returns false if saving the note would give clientID more than
+// maxNotes notes.
+func (r *Retro) canSaveNote(clientID sseconn.ClientID, ID uint, maxNotes int) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	notes := r.notes[clientID]
+
+	for _, n := range notes {
 		if n.ID == ID {
-			notes[i] = note
+			return true
+		}
+	}
+
+	return len(notes) < maxNotes
+}
+
+// SaveActionItem creates or updates an action item. Action items can only be
+// written by participants, in the phases that allow it (see phases).
+func (r *Retro) SaveActionItem(clientID sseconn.ClientID, ID uint, text string, done bool) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowsLocked(saveActionItemCommandName) || !r.hasParticipantLocked(clientID) {
+		return nil
+	}
+
+	actionItem := ActionItem{ID: ID, Text: text, Done: done}
+	found := false
+
+	for i, a := range r.actionItems {
+		if a.ID == ID {
+			actionItem.CarriedOver = a.CarriedOver
+			r.actionItems[i] = actionItem
 			found = true
 			break
 		}
 	}
 
 	if !found {
-		notes = append(notes, note)
+		if ID >= firstCarriedOverActionItemID {
+			return nil
+		}
+
+		r.actionItems = append(r.actionItems, actionItem)
 	}
 
-	r.notes[clientID] = notes
+	events := make([]Event, 0, len(r.participants))
 
-	return nil
+	for _, p := range r.participants {
+		events = append(events, Event{
+			Recipient: p.ClientID,
+			Name:      actionItemSavedEventName,
+			Payload:   actionItem,
+		})
+	}
+
+	return events
+}
+
+func (r *Retro) hasParticipantLocked(clientID sseconn.ClientID) bool {
+	for _, p := range r.participants {
+		if p.ClientID == clientID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// historyRecord returns the record of the retro kept in the history of its
+// team once the retro is closed.
+func (r *Retro) historyRecord(closedAt time.Time) history.Retro {
+	r.Lock()
+	defer r.Unlock()
+
+	record := history.Retro{
+		ID:           r.id.String(),
+		TeamID:       r.teamID,
+		Name:         r.name,
+		CreatedAt:    r.createdAt,
+		ClosedAt:     closedAt,
+		Participants: make([]string, 0, len(r.participants)),
+		Notes:        []history.Note{},
+		ActionItems:  make([]history.ActionItem, 0, len(r.actionItems)),
+	}
+
+	for _, p := range r.participants {
+		record.Participants = append(record.Participants, p.Name)
+	}
+
+	// notes of participants who left are kept too, sorted by author to get a
+	// stable order
+	authors := make([]sseconn.ClientID, 0, len(r.notes))
+	for clientID := range r.notes {
+		authors = append(authors, clientID)
+	}
+
+	sort.Slice(authors, func(i, j int) bool {
+		return bytes.Compare(authors[i][:], authors[j][:]) < 0
+	})
+
+	for _, clientID := range authors {
+		for _, n := range r.notes[clientID] {
+			record.Notes = append(record.Notes, history.Note{Text: n.Text, Mood: int(n.Mood)})
+		}
+	}
+
+	for _, a := range r.actionItems {
+		record.ActionItems = append(record.ActionItems, history.ActionItem{Text: a.Text, Done: a.Done})
+	}
+
+	if r.checkIns != nil {
+		summary := summarizeCheckIns(r.checkIns)
+		record.CheckIns = &summary
+	}
+
+	return record
 }
 
 func (r *Retro) SetFinishedWriting(clientID sseconn.ClientID, finished bool) []Event {
 	r.Lock()
 	defer r.Unlock()
 
-	if r.state != Running || clientID == r.hostID {
+	if !r.allowsLocked(setFinishedWritingName) || clientID == r.hostID {
 		return nil
 	}
 
@@ -262,19 +643,32 @@ func (r *Retro) SetFinishedWriting(clientID sseconn.ClientID, finished bool) []E
 	return events
 }
 
+// serializeForClientLocked returns the state of the retro as seen by
+// clientID, which depends on whether notes are visible in the current phase.
 func (r *Retro) serializeForClientLocked(clientID sseconn.ClientID) SerializedRetro {
+	if phases[r.state].notesVisible {
+		serialized := r.serializeLocked()
+		serialized.SelfID = clientID
+		serialized.Votes = r.votesLocked(clientID)
+
+		return serialized
+	}
+
 	includeFinishedWriting := clientID == r.hostID
 	clientNotes := r.notes[clientID]
 
-	if len(clientNotes) == 0 {
-		return r.serializeLockedHelper(map[sseconn.ClientID][]Note{}, includeFinishedWriting)
-	}
+	notes := map[sseconn.ClientID][]Note{}
 
-	notes := map[sseconn.ClientID][]Note{
-		clientID: append([]Note{}, clientNotes...),
+	if len(clientNotes) > 0 {
+		notes[clientID] = append([]Note{}, clientNotes...)
 	}
 
-	return r.serializeLockedHelper(notes, includeFinishedWriting)
+	serialized := r.serializeLockedHelper(notes, includeFinishedWriting)
+	serialized.SelfID = clientID
+	serialized.CheckIns = r.checkInResultsLocked(clientID)
+	serialized.Votes = r.votesLocked(clientID)
+
+	return serialized
 }
 
 func (r *Retro) serializeLocked() SerializedRetro {
@@ -300,8 +694,14 @@ func (r *Retro) serializeLockedHelper(notes map[sseconn.ClientID][]Note, include
 		ID:           r.id,
 		Name:         r.name,
 		State:        r.state,
+		Agenda:       append([]State(nil), r.agenda...),
 		HostID:       r.hostID,
 		Participants: participants,
 		Notes:        notes,
+		TeamID:       r.teamID,
+		ActionItems:  append([]ActionItem(nil), r.actionItems...),
+		CheckIns:     r.checkInResultsLocked(sseconn.ClientID{}),
+		Votes:        r.votesLocked(sseconn.ClientID{}),
+		Version:      r.version,
 	}
 }
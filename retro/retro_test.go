@@ -1,15 +1,19 @@
 package retro
 
 import (
+	"encoding/json"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 
+	"github.com/abustany/goretro/history"
 	"github.com/abustany/goretro/sseconn"
 )
 
-func newClientID(t *testing.T) sseconn.ClientID {
+func newClientID(t testing.TB) sseconn.ClientID {
 	clientID, err := sseconn.NewClientID()
 	if err != nil {
 		t.Fatalf("error generating second client ID: " + err.Error())
@@ -31,6 +35,12 @@ func makeRetro(t *testing.T) *Retro {
 	return NewRetro(retroID, retroName)
 }
 
+// forClient returns the state of the retro as serialized for clientID.
+func forClient(s SerializedRetro, clientID sseconn.ClientID) SerializedRetro {
+	s.SelfID = clientID
+	return s
+}
+
 func checkEqual(t *testing.T, expected, actual interface{}) {
 	t.Helper()
 
@@ -44,10 +54,11 @@ func TestAddParticipant(t *testing.T) {
 	p1, p2 := makePartipant(t, 0), makePartipant(t, 1)
 
 	serializedRetro := SerializedRetro{
-		ID:    r.id,
-		Name:  r.name,
-		State: WaitingForParticipants,
-		Notes: map[sseconn.ClientID][]Note{},
+		ID:     r.id,
+		Name:   r.name,
+		State:  WaitingForParticipants,
+		Agenda: []State{Running, ActionPoints},
+		Notes:  map[sseconn.ClientID][]Note{},
 	}
 
 	t.Run("first participant becomes the host", func(t *testing.T) {
@@ -58,7 +69,7 @@ func TestAddParticipant(t *testing.T) {
 			{
 				Recipient: p1.ClientID,
 				Name:      currentStateEventName,
-				Payload:   serializedRetro,
+				Payload:   forClient(serializedRetro, p1.ClientID),
 			},
 		}
 		checkEqual(t, expectedEvents, r.AddParticipant(p1))
@@ -78,7 +89,7 @@ func TestAddParticipant(t *testing.T) {
 			{
 				Recipient: p2.ClientID,
 				Name:      currentStateEventName,
-				Payload:   serializedRetro,
+				Payload:   forClient(serializedRetro, p2.ClientID),
 			},
 		}
 		checkEqual(t, expectedEvents, r.AddParticipant(p2))
@@ -91,7 +102,7 @@ func TestAddParticipant(t *testing.T) {
 			{
 				Recipient: p2.ClientID,
 				Name:      currentStateEventName,
-				Payload:   serializedRetro,
+				Payload:   forClient(serializedRetro, p2.ClientID),
 			},
 		}
 		checkEqual(t, expectedEvents, r.AddParticipant(p2))
@@ -139,7 +150,7 @@ func TestRemoveParticipant(t *testing.T) {
 			{
 				Recipient: p3.ClientID,
 				Name:      hostChangedEventName,
-				Payload:   p3.ClientID,
+				Payload:   ParticipantIDOf(p3.ClientID),
 			},
 		}
 		checkEqual(t, expectedEvents, r.RemoveParticipant(p1.ClientID))
@@ -226,6 +237,7 @@ func TestSetState(t *testing.T) {
 		ID:           r.id,
 		Name:         r.name,
 		State:        ActionPoints,
+		Agenda:       []State{Running, ActionPoints},
 		HostID:       p1.ClientID,
 		Participants: []Participant{p1, p2, p3},
 		Notes:        map[sseconn.ClientID][]Note{},
@@ -250,17 +262,17 @@ func TestSetState(t *testing.T) {
 		{
 			Recipient: p1.ClientID,
 			Name:      currentStateEventName,
-			Payload:   serializedRetro,
+			Payload:   forClient(serializedRetro, p1.ClientID),
 		},
 		{
 			Recipient: p2.ClientID,
 			Name:      currentStateEventName,
-			Payload:   serializedRetro,
+			Payload:   forClient(serializedRetro, p2.ClientID),
 		},
 		{
 			Recipient: p3.ClientID,
 			Name:      currentStateEventName,
-			Payload:   serializedRetro,
+			Payload:   forClient(serializedRetro, p3.ClientID),
 		},
 	}
 
@@ -305,8 +317,12 @@ func TestSaveNote(t *testing.T) {
 	p1 := makePartipant(t, 0)
 	r.AddParticipant(p1)
 
+	noteSaved := func(note Note) []Event {
+		return []Event{{Recipient: p1.ClientID, Name: noteSavedEventName, Payload: note}}
+	}
+
 	t.Run("Saving notes is not possible in WaitingForParticipants state", func(t *testing.T) {
-		checkEqual(t, []Event(nil), r.SaveNote(p1.ClientID, 0, "Hello", PositiveMood))
+		checkEqual(t, []Event(nil), r.SaveNote(p1.ClientID, 0, 0, "Hello", PositiveMood))
 		checkEqual(t, map[sseconn.ClientID][]Note{}, r.notes)
 	})
 
@@ -315,23 +331,50 @@ func TestSaveNote(t *testing.T) {
 	expectedNotes := []Note{}
 
 	t.Run("Saving a new note", func(t *testing.T) {
-		expectedNotes = append(expectedNotes, Note{ID: 0, AuthorID: p1.ClientID, Text: "Hello", Mood: PositiveMood})
-		checkEqual(t, []Event(nil), r.SaveNote(p1.ClientID, 0, "Hello", PositiveMood))
+		expectedNotes = append(expectedNotes, Note{ID: 0, Revision: 1, AuthorID: p1.ClientID, Text: "Hello", Mood: PositiveMood})
+		checkEqual(t, noteSaved(expectedNotes[0]), r.SaveNote(p1.ClientID, 0, 0, "Hello", PositiveMood))
 		checkEqual(t, map[sseconn.ClientID][]Note{p1.ClientID: expectedNotes}, r.notes)
 	})
 
 	t.Run("Saving a second note", func(t *testing.T) {
-		expectedNotes = append(expectedNotes, Note{ID: 1, AuthorID: p1.ClientID, Text: "World", Mood: NegativeMood})
-		checkEqual(t, []Event(nil), r.SaveNote(p1.ClientID, 1, "World", NegativeMood))
+		expectedNotes = append(expectedNotes, Note{ID: 1, Revision: 1, AuthorID: p1.ClientID, Text: "World", Mood: NegativeMood})
+		checkEqual(t, noteSaved(expectedNotes[1]), r.SaveNote(p1.ClientID, 1, 0, "World", NegativeMood))
 		checkEqual(t, map[sseconn.ClientID][]Note{p1.ClientID: expectedNotes}, r.notes)
 	})
 
 	t.Run("Overwriting a note", func(t *testing.T) {
+		expectedNotes[0].Revision = 2
 		expectedNotes[0].Text = "Wat"
 		expectedNotes[0].Mood = ConfusedMood
-		checkEqual(t, []Event(nil), r.SaveNote(p1.ClientID, 0, "Wat", ConfusedMood))
+		checkEqual(t, noteSaved(expectedNotes[0]), r.SaveNote(p1.ClientID, 0, 1, "Wat", ConfusedMood))
+		checkEqual(t, map[sseconn.ClientID][]Note{p1.ClientID: expectedNotes}, r.notes)
+	})
+
+	noteConflict := []Event{{Recipient: p1.ClientID, Name: noteConflictEventName, Payload: expectedNotes[0]}}
+
+	t.Run("Overwriting a note from a stale revision", func(t *testing.T) {
+		checkEqual(t, noteConflict, r.SaveNote(p1.ClientID, 0, 1, "Stale", PositiveMood))
 		checkEqual(t, map[sseconn.ClientID][]Note{p1.ClientID: expectedNotes}, r.notes)
 	})
+
+	t.Run("Overwriting a note from a future revision", func(t *testing.T) {
+		checkEqual(t, noteConflict, r.SaveNote(p1.ClientID, 0, 3, "Future", PositiveMood))
+		checkEqual(t, map[sseconn.ClientID][]Note{p1.ClientID: expectedNotes}, r.notes)
+	})
+
+	t.Run("Creating a note that already exists", func(t *testing.T) {
+		checkEqual(t, noteConflict, r.SaveNote(p1.ClientID, 0, 0, "Retried", PositiveMood))
+		checkEqual(t, map[sseconn.ClientID][]Note{p1.ClientID: expectedNotes}, r.notes)
+	})
+
+	t.Run("Notes of other participants don't conflict", func(t *testing.T) {
+		p2 := makePartipant(t, 1)
+		r.AddParticipant(p2)
+
+		expected := Note{ID: 0, Revision: 1, AuthorID: p2.ClientID, Text: "Mine", Mood: PositiveMood}
+		checkEqual(t, []Event{{Recipient: p2.ClientID, Name: noteSavedEventName, Payload: expected}}, r.SaveNote(p2.ClientID, 0, 0, "Mine", PositiveMood))
+		checkEqual(t, expectedNotes, r.notes[p1.ClientID])
+	})
 }
 
 func TestSetFinishedWriting(t *testing.T) {
@@ -369,6 +412,7 @@ func TestSetFinishedWriting(t *testing.T) {
 			ID:     r.id,
 			Name:   r.name,
 			State:  Running,
+			Agenda: []State{Running, ActionPoints},
 			HostID: host.ClientID,
 			Participants: []Participant{
 				host,
@@ -383,7 +427,7 @@ func TestSetFinishedWriting(t *testing.T) {
 			[]Event{
 				{Recipient: host.ClientID, Name: participantAddedEventName, Payload: newJoiner},
 				{Recipient: other.ClientID, Name: participantAddedEventName, Payload: newJoiner},
-				{Recipient: newJoiner.ClientID, Name: currentStateEventName, Payload: serializedRetro},
+				{Recipient: newJoiner.ClientID, Name: currentStateEventName, Payload: forClient(serializedRetro, newJoiner.ClientID)},
 			},
 			r.AddParticipant(newJoiner),
 		)
@@ -394,6 +438,7 @@ func TestSetFinishedWriting(t *testing.T) {
 			ID:     r.id,
 			Name:   r.name,
 			State:  Running,
+			Agenda: []State{Running, ActionPoints},
 			HostID: host.ClientID,
 			Participants: []Participant{
 				host,
@@ -407,9 +452,458 @@ func TestSetFinishedWriting(t *testing.T) {
 		checkEqual(
 			t,
 			[]Event{
-				{Recipient: host.ClientID, Name: currentStateEventName, Payload: serializedRetro},
+				{Recipient: host.ClientID, Name: currentStateEventName, Payload: forClient(serializedRetro, host.ClientID)},
 			},
 			r.AddParticipant(host),
 		)
 	})
 }
+
+func TestSetHost(t *testing.T) {
+	r := makeRetro(t)
+	p1, p2 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(p1)
+	r.AddParticipant(p2)
+
+	t.Run("transferring to a non existing participant fails", func(t *testing.T) {
+		if _, err := r.SetHost(newClientID(t)); err != ErrParticipantNotFound {
+			t.Errorf("expected ErrParticipantNotFound, got %v", err)
+		}
+
+		checkEqual(t, p1.ClientID, r.hostID)
+	})
+
+	t.Run("transferring the host notifies all participants", func(t *testing.T) {
+		events, err := r.SetHost(p2.ClientID)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expectedEvents := []Event{
+			{Recipient: p1.ClientID, Name: hostChangedEventName, Payload: ParticipantIDOf(p2.ClientID)},
+			{Recipient: p2.ClientID, Name: hostChangedEventName, Payload: ParticipantIDOf(p2.ClientID)},
+		}
+		checkEqual(t, expectedEvents, events)
+		checkEqual(t, p2.ClientID, r.hostID)
+	})
+}
+
+func TestClose(t *testing.T) {
+	r := makeRetro(t)
+	p1, p2 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(p1)
+	r.AddParticipant(p2)
+
+	expectedEvents := []Event{
+		{Recipient: p1.ClientID, Name: roomClosedEventName, Payload: r.id},
+		{Recipient: p2.ClientID, Name: roomClosedEventName, Payload: r.id},
+	}
+	checkEqual(t, expectedEvents, r.Close())
+	checkEqual(t, []Participant(nil), r.participants)
+}
+
+func TestSerializedRetroHidesClientIDs(t *testing.T) {
+	r := makeRetro(t)
+	p1, p2 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(p1)
+	r.AddParticipant(p2)
+	r.SetState(p1.ClientID, Running)
+	r.SaveNote(p1.ClientID, 1, 0, "Note", PositiveMood)
+	r.SaveNote(p2.ClientID, 1, 0, "Other note", NegativeMood)
+
+	events := r.SetState(p1.ClientID, ActionPoints)
+	data, err := json.Marshal(events[len(events)-1].Payload)
+	if err != nil {
+		t.Fatalf("error marshaling state: %s", err)
+	}
+
+	for _, p := range []Participant{p1, p2} {
+		if strings.Contains(string(data), p.ClientID.String()) {
+			t.Errorf("client ID of %s found in serialized retro: %s", p.Name, data)
+		}
+
+		if !strings.Contains(string(data), string(ParticipantIDOf(p.ClientID))) {
+			t.Errorf("participant ID of %s not found in serialized retro: %s", p.Name, data)
+		}
+	}
+}
+
+func TestSaveActionItem(t *testing.T) {
+	r := makeRetro(t)
+	p1, p2 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(p1)
+	r.AddParticipant(p2)
+
+	t.Run("action items can only be saved when reviewing", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.SaveActionItem(p1.ClientID, 0, "Do it", false))
+	})
+
+	r.SetState(p1.ClientID, Running)
+	r.SetState(p1.ClientID, ActionPoints)
+
+	t.Run("saving an action item notifies all participants", func(t *testing.T) {
+		actionItem := ActionItem{ID: 0, Text: "Do it", Done: false}
+		expectedEvents := []Event{
+			{Recipient: p1.ClientID, Name: actionItemSavedEventName, Payload: actionItem},
+			{Recipient: p2.ClientID, Name: actionItemSavedEventName, Payload: actionItem},
+		}
+		checkEqual(t, expectedEvents, r.SaveActionItem(p2.ClientID, 0, "Do it", false))
+	})
+
+	t.Run("saving an existing action item updates it", func(t *testing.T) {
+		r.SaveActionItem(p1.ClientID, 0, "Done it", true)
+		checkEqual(t, []ActionItem{{ID: 0, Text: "Done it", Done: true}}, r.actionItems)
+	})
+
+	t.Run("non participants cannot save action items", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.SaveActionItem(newClientID(t), 1, "Intruder", false))
+	})
+}
+
+func TestReviewCarriedOverActionItems(t *testing.T) {
+	r := makeRetro(t)
+	r.actionItems = carryOverActionItems(history.Retro{
+		ActionItems: []history.ActionItem{
+			{Text: "Done already", Done: true},
+			{Text: "Still to do"},
+		},
+	})
+
+	checkEqual(t, []ActionItem{{ID: firstCarriedOverActionItemID, Text: "Still to do", CarriedOver: true}}, r.actionItems)
+	r.setAgenda(defaultAgenda(false, true))
+
+	host := makePartipant(t, 0)
+	r.AddParticipant(host)
+	r.SetState(host.ClientID, ReviewingActionItems)
+
+	t.Run("carried over action items can be resolved during the review", func(t *testing.T) {
+		actionItem := ActionItem{ID: firstCarriedOverActionItemID, Text: "Still to do", Done: true, CarriedOver: true}
+		checkEqual(
+			t,
+			[]Event{{Recipient: host.ClientID, Name: actionItemSavedEventName, Payload: actionItem}},
+			r.SaveActionItem(host.ClientID, firstCarriedOverActionItemID, "Still to do", true),
+		)
+	})
+
+	t.Run("new action items do not replace carried over ones", func(t *testing.T) {
+		actionItem := ActionItem{ID: 0, Text: "New"}
+		checkEqual(
+			t,
+			[]Event{{Recipient: host.ClientID, Name: actionItemSavedEventName, Payload: actionItem}},
+			r.SaveActionItem(host.ClientID, 0, "New", false),
+		)
+		checkEqual(t, 2, len(r.actionItems))
+	})
+
+	t.Run("new action items cannot use the IDs of carried over ones", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.SaveActionItem(host.ClientID, firstCarriedOverActionItemID+1, "Sneaky", false))
+	})
+}
+
+func TestCheckIn(t *testing.T) {
+	r := makeRetro(t)
+	r.setAgenda([]State{CheckingIn, Running, ActionPoints})
+	host, p1, p2 := makePartipant(t, 0), makePartipant(t, 1), makePartipant(t, 2)
+	r.AddParticipant(host)
+	r.AddParticipant(p1)
+	r.AddParticipant(p2)
+
+	t.Run("check-ins are only accepted during the check-in", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.CheckIn(p1.ClientID, CheckIn{Score: 3}))
+	})
+
+	r.SetState(host.ClientID, CheckingIn)
+
+	t.Run("check-ins are hidden until everybody answered", func(t *testing.T) {
+		events := r.CheckIn(p1.ClientID, CheckIn{Score: 4})
+
+		hidden := &CheckInResults{
+			Answered: []sseconn.ClientID{p1.ClientID},
+			CheckIns: map[sseconn.ClientID]CheckIn{},
+		}
+		own := &CheckInResults{
+			Answered: []sseconn.ClientID{p1.ClientID},
+			CheckIns: map[sseconn.ClientID]CheckIn{p1.ClientID: {Score: 4}},
+		}
+		expectedEvents := []Event{
+			{Recipient: host.ClientID, Name: checkInsUpdatedEventName, Payload: hidden},
+			{Recipient: p1.ClientID, Name: checkInsUpdatedEventName, Payload: own},
+			{Recipient: p2.ClientID, Name: checkInsUpdatedEventName, Payload: hidden},
+		}
+		checkEqual(t, expectedEvents, events)
+		checkEqual(t, hidden, r.Serialize().CheckIns)
+	})
+
+	t.Run("only the host can reveal the check-ins", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.RevealCheckIns(p1.ClientID))
+	})
+
+	t.Run("check-ins are revealed once everybody answered", func(t *testing.T) {
+		r.CheckIn(host.ClientID, CheckIn{Score: 2})
+		events := r.CheckIn(p2.ClientID, CheckIn{Word: "sleepy"})
+
+		revealed := &CheckInResults{
+			Revealed: true,
+			Answered: []sseconn.ClientID{host.ClientID, p1.ClientID, p2.ClientID},
+			CheckIns: map[sseconn.ClientID]CheckIn{
+				host.ClientID: {Score: 2},
+				p1.ClientID:   {Score: 4},
+				p2.ClientID:   {Word: "sleepy"},
+			},
+			Summary: &history.CheckInSummary{
+				Count:        3,
+				AverageScore: 3,
+				ScoreCounts:  map[int]int{2: 1, 4: 1},
+				Words:        []string{"sleepy"},
+			},
+		}
+		checkEqual(t, revealed, events[1].Payload)
+		checkEqual(t, revealed.Summary, r.historyRecord(time.Now()).CheckIns)
+	})
+}
+
+func TestRevealCheckIns(t *testing.T) {
+	r := makeRetro(t)
+	r.setAgenda([]State{CheckingIn, Running, ActionPoints})
+	host, p1 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(host)
+	r.AddParticipant(p1)
+	r.SetState(host.ClientID, CheckingIn)
+	r.CheckIn(p1.ClientID, CheckIn{Word: "great"})
+
+	events := r.RevealCheckIns(host.ClientID)
+	checkEqual(t, 2, len(events))
+	checkEqual(t, true, events[0].Payload.(*CheckInResults).Revealed)
+	checkEqual(t, map[sseconn.ClientID]CheckIn{p1.ClientID: {Word: "great"}}, events[0].Payload.(*CheckInResults).CheckIns)
+}
+
+func TestCheckInValidation(t *testing.T) {
+	for _, checkIn := range []CheckIn{{}, {Score: 6}, {Score: -1}, {Score: 3, Word: "both"}, {Word: "two words"}} {
+		if err := checkIn.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", checkIn)
+		}
+	}
+
+	for _, checkIn := range []CheckIn{{Score: 1}, {Score: 5}, {Word: "tired"}} {
+		if err := checkIn.validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %s", checkIn, err)
+		}
+	}
+}
+
+func TestAgenda(t *testing.T) {
+	r := makeRetro(t)
+	r.setAgenda([]State{Running, Grouping, Closing})
+	host, p1 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(host)
+	r.AddParticipant(p1)
+
+	stateChanged := func(state State) []Event {
+		return []Event{
+			{Recipient: host.ClientID, Name: stateChangedEventName, Payload: state},
+			{Recipient: p1.ClientID, Name: stateChangedEventName, Payload: state},
+		}
+	}
+
+	t.Run("only the host can change the phase", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.NextPhase(p1.ClientID))
+		checkEqual(t, WaitingForParticipants, r.state)
+	})
+
+	t.Run("the retro starts with the first phase of the agenda", func(t *testing.T) {
+		checkEqual(t, stateChanged(Running), r.NextPhase(host.ClientID))
+	})
+
+	t.Run("the first phase has no previous phase", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.PreviousPhase(host.ClientID))
+		checkEqual(t, Running, r.state)
+	})
+
+	t.Run("phases outside of the agenda are rejected", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.SetState(host.ClientID, ActionPoints))
+		checkEqual(t, Running, r.state)
+	})
+
+	r.SaveNote(p1.ClientID, 0, 0, "Hello", PositiveMood)
+
+	t.Run("notes are sent to everybody once they are visible", func(t *testing.T) {
+		events := r.NextPhase(host.ClientID)
+		checkEqual(t, 4, len(events))
+		checkEqual(t, Grouping, r.state)
+
+		for _, e := range events[2:] {
+			checkEqual(t, currentStateEventName, e.Name)
+			checkEqual(t, []Note{{ID: 0, Revision: 1, AuthorID: p1.ClientID, Text: "Hello", Mood: PositiveMood}}, e.Payload.(SerializedRetro).Notes[p1.ClientID])
+		}
+	})
+
+	t.Run("phases only allow their own commands", func(t *testing.T) {
+		r.SaveNote(p1.ClientID, 0, 1, "Changed", PositiveMood)
+		checkEqual(t, "Hello", r.notes[p1.ClientID][0].Text)
+		checkEqual(t, []Event(nil), r.SaveActionItem(p1.ClientID, 0, "Do it", false))
+	})
+
+	t.Run("the host can go back to the previous phase", func(t *testing.T) {
+		checkEqual(t, stateChanged(Running), r.PreviousPhase(host.ClientID))
+	})
+
+	t.Run("SetState cannot skip phases", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.SetState(host.ClientID, Closing))
+		checkEqual(t, Running, r.state)
+	})
+
+	t.Run("the last phase has no next phase", func(t *testing.T) {
+		r.SetState(host.ClientID, Grouping)
+		r.SetState(host.ClientID, Closing)
+		checkEqual(t, []Event(nil), r.NextPhase(host.ClientID))
+		checkEqual(t, Closing, r.state)
+	})
+}
+
+func TestGroupNote(t *testing.T) {
+	r := makeRetro(t)
+	r.setAgenda([]State{Running, Grouping, Discussing})
+	host, p1 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(host)
+	r.AddParticipant(p1)
+	r.NextPhase(host.ClientID)
+	r.SaveNote(p1.ClientID, 0, 0, "Hello", PositiveMood)
+
+	t.Run("notes can only be grouped during the group phase", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.GroupNote(host.ClientID, ParticipantIDOf(p1.ClientID), 0, 1))
+	})
+
+	r.NextPhase(host.ClientID)
+
+	t.Run("grouping a note notifies all participants", func(t *testing.T) {
+		note := Note{ID: 0, Revision: 1, AuthorID: p1.ClientID, Text: "Hello", Mood: PositiveMood, Group: 1}
+		checkEqual(
+			t,
+			[]Event{
+				{Recipient: host.ClientID, Name: noteSavedEventName, Payload: note},
+				{Recipient: p1.ClientID, Name: noteSavedEventName, Payload: note},
+			},
+			r.GroupNote(host.ClientID, ParticipantIDOf(p1.ClientID), 0, 1),
+		)
+	})
+
+	t.Run("unknown notes cannot be grouped", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.GroupNote(host.ClientID, ParticipantIDOf(host.ClientID), 0, 1))
+		checkEqual(t, []Event(nil), r.GroupNote(host.ClientID, ParticipantIDOf(p1.ClientID), 1, 1))
+	})
+
+	t.Run("non participants cannot group notes", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.GroupNote(newClientID(t), ParticipantIDOf(p1.ClientID), 0, 2))
+	})
+
+	t.Run("groups are kept when going back to writing", func(t *testing.T) {
+		r.PreviousPhase(host.ClientID)
+		r.SaveNote(p1.ClientID, 0, 1, "Changed", PositiveMood)
+		checkEqual(t, uint(1), r.notes[p1.ClientID][0].Group)
+	})
+
+	r.NextPhase(host.ClientID)
+	r.NextPhase(host.ClientID)
+
+	t.Run("notes are read-only during the discussion", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.SaveNote(p1.ClientID, 0, 2, "Again", PositiveMood))
+		checkEqual(t, []Event(nil), r.GroupNote(host.ClientID, ParticipantIDOf(p1.ClientID), 0, 2))
+	})
+}
+
+func TestVote(t *testing.T) {
+	r := makeRetro(t)
+	r.setAgenda([]State{Running, Voting, Discussing})
+	host, p1 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(host)
+	r.AddParticipant(p1)
+	r.NextPhase(host.ClientID)
+	r.SaveNote(p1.ClientID, 0, 0, "Hello", PositiveMood)
+	r.SaveNote(p1.ClientID, 1, 0, "World", PositiveMood)
+
+	t.Run("votes are only accepted during the vote phase", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.Vote(host.ClientID, ParticipantIDOf(p1.ClientID), 0, true))
+	})
+
+	r.NextPhase(host.ClientID)
+
+	t.Run("votes are only sent to the voter", func(t *testing.T) {
+		checkEqual(
+			t,
+			[]Event{{Recipient: host.ClientID, Name: voteSavedEventName, Payload: NoteVotes{AuthorID: p1.ClientID, NoteID: 0, Count: 1}}},
+			r.Vote(host.ClientID, ParticipantIDOf(p1.ClientID), 0, true),
+		)
+		r.Vote(p1.ClientID, ParticipantIDOf(p1.ClientID), 0, true)
+		r.Vote(p1.ClientID, ParticipantIDOf(p1.ClientID), 1, true)
+	})
+
+	t.Run("votes can be removed", func(t *testing.T) {
+		checkEqual(
+			t,
+			[]Event{{Recipient: p1.ClientID, Name: voteSavedEventName, Payload: NoteVotes{AuthorID: p1.ClientID, NoteID: 1, Count: 0}}},
+			r.Vote(p1.ClientID, ParticipantIDOf(p1.ClientID), 1, false),
+		)
+	})
+
+	t.Run("unknown notes cannot be voted for", func(t *testing.T) {
+		checkEqual(t, []Event(nil), r.Vote(host.ClientID, ParticipantIDOf(p1.ClientID), 2, true))
+	})
+
+	t.Run("participants only see their own votes during the vote", func(t *testing.T) {
+		events := r.AddParticipant(p1) // sends the state of the retro again
+		checkEqual(t, []NoteVotes{{AuthorID: p1.ClientID, NoteID: 0, Count: 1}}, events[0].Payload.(SerializedRetro).Votes)
+	})
+
+	t.Run("the number of votes is limited", func(t *testing.T) {
+		checkEqual(t, false, r.canVote(host.ClientID, ParticipantIDOf(p1.ClientID), 1, 1))
+		checkEqual(t, true, r.canVote(host.ClientID, ParticipantIDOf(p1.ClientID), 0, 1))
+	})
+
+	t.Run("votes are revealed once the vote is over", func(t *testing.T) {
+		events := r.NextPhase(host.ClientID)
+		checkEqual(t, 4, len(events))
+
+		for _, e := range events[2:] {
+			checkEqual(t, currentStateEventName, e.Name)
+			checkEqual(t, []NoteVotes{{AuthorID: p1.ClientID, NoteID: 0, Count: 2}}, e.Payload.(SerializedRetro).Votes)
+		}
+	})
+}
+
+func TestClosePhase(t *testing.T) {
+	r := makeRetro(t)
+	host, p1 := makePartipant(t, 0), makePartipant(t, 1)
+	r.AddParticipant(host)
+	r.AddParticipant(p1)
+
+	t.Run("rooms without a close phase can be closed at any time", func(t *testing.T) {
+		checkEqual(t, true, r.canClose(host.ClientID))
+		checkEqual(t, false, r.canClose(p1.ClientID))
+	})
+
+	r.setAgenda([]State{Running, Closing})
+
+	t.Run("rooms with a close phase can only be closed during it", func(t *testing.T) {
+		r.NextPhase(host.ClientID)
+		checkEqual(t, false, r.canClose(host.ClientID))
+
+		r.NextPhase(host.ClientID)
+		checkEqual(t, true, r.canClose(host.ClientID))
+		checkEqual(t, false, r.canClose(p1.ClientID))
+	})
+}
+
+func TestParseAgenda(t *testing.T) {
+	agenda, err := parseAgenda([]string{"check-in", "write", "group", "vote", "discuss", "actions", "close"})
+	if err != nil {
+		t.Fatalf("error parsing agenda: %s", err)
+	}
+
+	checkEqual(t, []State{CheckingIn, Running, Grouping, Voting, Discussing, ActionPoints, Closing}, agenda)
+
+	for _, names := range [][]string{{"write", "sing"}, {"write", "write"}, {"waiting"}} {
+		if _, err := parseAgenda(names); err == nil {
+			t.Errorf("expected agenda %v to be invalid", names)
+		}
+	}
+}
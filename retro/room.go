@@ -0,0 +1,91 @@
+package retro
+
+import "sync"
+
+// roomQueueSize is the number of commands that can be waiting for a room
+// before the clients sending them block.
+const roomQueueSize = 256
+
+// room runs the commands of a Retro one at a time, in its own goroutine, so
+// that a busy room does not slow down the others. The Manager only routes
+// commands to the room of their sender.
+type room struct {
+	retro    *Retro
+	commands chan func()
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func startRoom(retro *Retro) *room {
+	r := &room{
+		retro:    retro,
+		commands: make(chan func(), roomQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r
+}
+
+func (r *room) run() {
+	for {
+		select {
+		case cmd := <-r.commands:
+			select {
+			case <-r.done:
+				return
+			default:
+				cmd()
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// enqueue queues cmd to be run by the room. It returns false if the room was
+// stopped.
+func (r *room) enqueue(cmd func()) bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+
+	select {
+	case r.commands <- cmd:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// call runs cmd in the room and waits for its result. It must not be called
+// from the goroutine of the room.
+func (r *room) call(cmd func() error) error {
+	res := make(chan error, 1)
+
+	if !r.enqueue(func() { res <- cmd() }) {
+		return ErrRoomNotFound
+	}
+
+	select {
+	case err := <-res:
+		return err
+	case <-r.done:
+		// the command might have stopped the room itself
+		select {
+		case err := <-res:
+			return err
+		default:
+			return ErrRoomNotFound
+		}
+	}
+}
+
+// stop makes the room stop running commands. The commands still queued are
+// dropped.
+func (r *room) stop() {
+	r.stopOnce.Do(func() { close(r.done) })
+}
@@ -8,11 +8,52 @@ const (
 	WaitingForParticipants State = iota + 1
 	Running
 	ActionPoints
+
+	// ReviewingActionItems comes before Running in retros that carried over
+	// the unresolved action items of a previous retro, to check on them.
+	ReviewingActionItems
+
+	// CheckingIn is the optional first step of a retro, where participants
+	// tell how they feel with a score or a word.
+	CheckingIn
+
+	// Grouping, Voting, Discussing and Closing are only part of the retros
+	// whose agenda includes them.
+	Grouping
+	Voting
+	Discussing
+	Closing
 )
 
+func (s State) String() string {
+	switch s {
+	case WaitingForParticipants:
+		return "waiting-for-participants"
+	case Running:
+		return "running"
+	case ActionPoints:
+		return "action-points"
+	case ReviewingActionItems:
+		return "reviewing-action-items"
+	case CheckingIn:
+		return "checking-in"
+	case Grouping:
+		return "grouping"
+	case Voting:
+		return "voting"
+	case Discussing:
+		return "discussing"
+	case Closing:
+		return "closing"
+	default:
+		return "unknown"
+	}
+}
+
 func stateFromInt(i uint) (State, error) {
 	switch i {
-	case uint(WaitingForParticipants), uint(Running), uint(ActionPoints):
+	case uint(WaitingForParticipants), uint(Running), uint(ActionPoints), uint(ReviewingActionItems), uint(CheckingIn),
+		uint(Grouping), uint(Voting), uint(Discussing), uint(Closing):
 		return State(i), nil
 	default:
 		return 0, fmt.Errorf("invalid value: %d", i)
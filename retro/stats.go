@@ -0,0 +1,107 @@
+package retro
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CommandOutcomeOK    = "ok"
+	CommandOutcomeError = "error"
+)
+
+// CommandStats aggregates the executions of a given command with a given
+// outcome.
+type CommandStats struct {
+	Name          string
+	Outcome       string // CommandOutcomeOK or CommandOutcomeError
+	Count         uint64
+	TotalDuration time.Duration
+}
+
+// Stats is a point in time snapshot of the Manager's rooms and counters.
+type Stats struct {
+	RoomsByState map[State]int
+	Participants int
+	Commands     []CommandStats
+}
+
+type commandStatsKey struct {
+	name    string
+	outcome string
+}
+
+type commandStatsRecorder struct {
+	lock  sync.Mutex
+	stats map[commandStatsKey]*CommandStats
+}
+
+func (r *commandStatsRecorder) record(name string, err error, duration time.Duration) {
+	if !knownCommandNames[name] {
+		// don't let clients create arbitrary label values
+		name = "unknown"
+	}
+
+	key := commandStatsKey{name: name, outcome: CommandOutcomeOK}
+	if err != nil {
+		key.outcome = CommandOutcomeError
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stats == nil {
+		r.stats = make(map[commandStatsKey]*CommandStats)
+	}
+
+	s := r.stats[key]
+	if s == nil {
+		s = &CommandStats{Name: key.name, Outcome: key.outcome}
+		r.stats[key] = s
+	}
+
+	s.Count++
+	s.TotalDuration += duration
+}
+
+func (r *commandStatsRecorder) snapshot() []CommandStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := make([]CommandStats, 0, len(r.stats))
+	for _, s := range r.stats {
+		res = append(res, *s)
+	}
+
+	return res
+}
+
+func (m *Manager) Stats() Stats {
+	stats := Stats{
+		RoomsByState: map[State]int{},
+		Commands:     m.commandStats.snapshot(),
+	}
+
+	for _, state := range []State{
+		WaitingForParticipants, CheckingIn, ReviewingActionItems, Running,
+		Grouping, Voting, Discussing, ActionPoints, Closing,
+	} {
+		stats.RoomsByState[state] = 0
+	}
+
+	m.lock.RLock()
+	retros := make([]*Retro, 0, len(m.retros))
+	for _, r := range m.retros {
+		retros = append(retros, r.retro)
+	}
+	m.lock.RUnlock()
+
+	for _, r := range retros {
+		r.Lock()
+		stats.RoomsByState[r.state]++
+		stats.Participants += len(r.participants)
+		r.Unlock()
+	}
+
+	return stats
+}
@@ -0,0 +1,51 @@
+package retro
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/abustany/goretro/history"
+	"github.com/abustany/goretro/sseconn"
+)
+
+var ErrInvalidTeamName = errors.New("invalid team name")
+
+// CreateTeam creates a new team. Rooms created for the team are added to its
+// history when they are closed.
+func (m *Manager) CreateTeam(name string) (history.Team, error) {
+	if name == "" {
+		return history.Team{}, fmt.Errorf("%w: empty name", ErrInvalidTeamName)
+	}
+
+	if err := validateLength("team name", name, m.options.MaxRoomNameLength); err != nil {
+		return history.Team{}, fmt.Errorf("%w: %s", ErrInvalidTeamName, err)
+	}
+
+	// team IDs are as hard to guess as room IDs, since knowing a team ID is
+	// enough to read its history
+	id, err := sseconn.NewClientID()
+	if err != nil {
+		return history.Team{}, fmt.Errorf("error generating team ID: %w", err)
+	}
+
+	team := history.Team{ID: id.String(), Name: name, CreatedAt: time.Now()}
+
+	if err := m.options.History.CreateTeam(team); err != nil {
+		return history.Team{}, fmt.Errorf("error saving team: %w", err)
+	}
+
+	m.logger.Info("team created", "team_id", team.ID)
+
+	return team, nil
+}
+
+// Team returns a team, or history.ErrTeamNotFound.
+func (m *Manager) Team(id string) (history.Team, error) {
+	return m.options.History.Team(id)
+}
+
+// TeamRetros returns the completed retros of a team, oldest first.
+func (m *Manager) TeamRetros(teamID string) ([]history.Retro, error) {
+	return m.options.History.Retros(teamID)
+}
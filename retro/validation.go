@@ -0,0 +1,30 @@
+package retro
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// validationError is returned for commands that are well formed but break one
+// of the limits of the Manager. The client that sent the command gets a
+// command-error event with the error message.
+type validationError struct {
+	message string
+}
+
+func (e validationError) Error() string {
+	return e.message
+}
+
+type commandError struct {
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+func validateLength(what, value string, max int) error {
+	if n := utf8.RuneCountInString(value); n > max {
+		return validationError{message: fmt.Sprintf("%s is too long (%d characters, maximum is %d)", what, n, max)}
+	}
+
+	return nil
+}
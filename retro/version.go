@@ -0,0 +1,55 @@
+package retro
+
+import "github.com/abustany/goretro/sseconn"
+
+// The events of a room are stamped with the version of the room after the
+// change that produced them, and with the version of the previous event sent
+// to the same participant. A client receiving an event whose previous version
+// is not the last version it knows missed some events, and sends the resync
+// command to get the state of the room again.
+
+// stampEvents stamps events with the next version of the retro. The state of
+// the retro sent in current-state events carries that version as well.
+//
+// Events must be dispatched in the order in which they were stamped.
+func (r *Retro) stampEvents(events []Event) []Event {
+	if len(events) == 0 {
+		return events
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.version++
+
+	for i := range events {
+		ev := &events[i]
+		ev.Version = r.version
+		ev.PreviousVersion = r.sentVersions[ev.Recipient]
+		r.sentVersions[ev.Recipient] = r.version
+
+		if state, ok := ev.Payload.(SerializedRetro); ok {
+			state.Version = r.version
+			ev.Payload = state
+		}
+	}
+
+	return events
+}
+
+// Resync sends the current state of the retro to a participant that missed
+// some events.
+func (r *Retro) Resync(clientID sseconn.ClientID) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.hasParticipantLocked(clientID) {
+		return nil
+	}
+
+	return []Event{{
+		Recipient: clientID,
+		Name:      currentStateEventName,
+		Payload:   r.serializeForClientLocked(clientID),
+	}}
+}
@@ -0,0 +1,127 @@
+package retro
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/abustany/goretro/sseconn"
+)
+
+// NoteVotes is the number of votes for a note. Until the retro moves past the
+// vote phase, participants only see their own votes, with a Count of 1 for
+// each note they voted for.
+type NoteVotes struct {
+	AuthorID sseconn.ClientID `json:"authorId"`
+	NoteID   uint             `json:"noteId"`
+	Count    int              `json:"count"`
+}
+
+func (v NoteVotes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AuthorID ParticipantID `json:"authorId"`
+		NoteID   uint          `json:"noteId"`
+		Count    int           `json:"count"`
+	}{
+		AuthorID: ParticipantIDOf(v.AuthorID),
+		NoteID:   v.NoteID,
+		Count:    v.Count,
+	})
+}
+
+// Vote adds or removes the vote of clientID for a note. Votes are secret until
+// the retro moves past the vote phase, so only the voter is sent its vote.
+func (r *Retro) Vote(clientID sseconn.ClientID, authorID ParticipantID, noteID uint, vote bool) []Event {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.allowsLocked(voteCommandName) || !r.hasParticipantLocked(clientID) {
+		return nil
+	}
+
+	ref, _, ok := r.findNoteLocked(authorID, noteID)
+	if !ok {
+		return nil
+	}
+
+	votes := NoteVotes{AuthorID: ref.authorID, NoteID: noteID}
+
+	if vote {
+		if r.votes[clientID] == nil {
+			r.votes[clientID] = map[noteRef]bool{}
+		}
+
+		r.votes[clientID][ref] = true
+		votes.Count = 1
+	} else {
+		delete(r.votes[clientID], ref)
+	}
+
+	return []Event{{
+		Recipient: clientID,
+		Name:      voteSavedEventName,
+		Payload:   votes,
+	}}
+}
+
+// canVote returns false if voting for the note would give clientID more than
+// maxVotes votes.
+func (r *Retro) canVote(clientID sseconn.ClientID, authorID ParticipantID, noteID uint, maxVotes int) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if ref, _, ok := r.findNoteLocked(authorID, noteID); ok && r.votes[clientID][ref] {
+		return true
+	}
+
+	return len(r.votes[clientID]) < maxVotes
+}
+
+// votesHiddenLocked returns true until the retro moves past the vote phase.
+func (r *Retro) votesHiddenLocked() bool {
+	current := r.phaseIndexLocked()
+
+	for i, state := range r.agenda {
+		if state == Voting {
+			return current <= i
+		}
+	}
+
+	return false
+}
+
+// votesLocked returns the votes clientID can see: its own votes until the
+// retro moves past the vote phase, and the votes of everybody afterwards.
+func (r *Retro) votesLocked(clientID sseconn.ClientID) []NoteVotes {
+	hidden := r.votesHiddenLocked()
+	counts := map[noteRef]int{}
+
+	for voterID, voterVotes := range r.votes {
+		if hidden && voterID != clientID {
+			continue
+		}
+
+		for ref := range voterVotes {
+			counts[ref]++
+		}
+	}
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	votes := make([]NoteVotes, 0, len(counts))
+	for ref, count := range counts {
+		votes = append(votes, NoteVotes{AuthorID: ref.authorID, NoteID: ref.noteID, Count: count})
+	}
+
+	sort.Slice(votes, func(i, j int) bool {
+		if c := bytes.Compare(votes[i].AuthorID[:], votes[j].AuthorID[:]); c != 0 {
+			return c < 0
+		}
+
+		return votes[i].NoteID < votes[j].NoteID
+	})
+
+	return votes
+}
@@ -2,6 +2,7 @@ package sseconn
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 )
 
@@ -13,11 +14,281 @@ const (
 	eventsPaused
 )
 
+func (s clientConnState) String() string {
+	switch s {
+	case helloReceived:
+		return "hello-received"
+	case eventsOpen:
+		return "events-open"
+	case eventsPaused:
+		return "events-paused"
+	default:
+		return "unknown"
+	}
+}
+
+// clientConn is the connection of a client, which can have several event
+// streams open at the same time (one per browser tab for example). The
+// connection is open as long as at least one of its streams is.
+//
+// clientID, secret, identity and protocolVersion never change. The other
+// fields are protected by lock.
 type clientConn struct {
-	state     clientConnState
-	pausedAt  time.Time
-	clientID  ClientID
-	secret    ClientSecret
-	eventChan chan interface{}
-	listeners []chan json.RawMessage
+	clientID        ClientID
+	secret          ClientSecret
+	identity        *Identity // nil for anonymous connections
+	protocolVersion int
+
+	lock       sync.Mutex
+	state      clientConnState
+	pausedAt   time.Time
+	closed     bool
+	backlog    chan interface{} // events sent while no stream is open
+	streams    []chan interface{}
+	listeners  []chan json.RawMessage
+	commandSeq uint64 // number of the last data command
+}
+
+func newClientConn(clientID ClientID, secret ClientSecret, identity *Identity, protocolVersion, bufferSize int) *clientConn {
+	return &clientConn{
+		clientID:        clientID,
+		secret:          secret,
+		identity:        identity,
+		protocolVersion: protocolVersion,
+		state:           helloReceived,
+		backlog:         make(chan interface{}, bufferSize),
+	}
+}
+
+// queueCommand queues the payload of a data command for all the listeners of
+// the connection, and returns its sequence number. Either all the listeners
+// get the payload, or none of them does: commands are rejected rather than
+// lost when nothing listens on the connection.
+func (c *clientConn) queueCommand(payload json.RawMessage) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return 0, errUnknownClient
+	}
+
+	if len(c.listeners) == 0 {
+		return 0, errNoListener
+	}
+
+	// only senders hold the lock, so a listener with room now will still have
+	// room below
+	for _, listener := range c.listeners {
+		if len(listener) == cap(listener) {
+			return 0, errCommandQueueFull
+		}
+	}
+
+	c.commandSeq++
+
+	for _, listener := range c.listeners {
+		listener <- payload
+	}
+
+	return c.commandSeq, nil
+}
+
+func (c *clientConn) addListener(bufferSize int) (chan json.RawMessage, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, errUnknownClient
+	}
+
+	listener := make(chan json.RawMessage, bufferSize)
+	c.listeners = append(c.listeners, listener)
+
+	return listener, nil
+}
+
+// addStream opens a new event stream. The first stream receives the events
+// sent while no stream was open. It also returns the number of those events
+// that did not fit in the stream.
+func (c *clientConn) addStream(bufferSize int) (chan interface{}, int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, 0, errUnknownClient
+	}
+
+	stream := make(chan interface{}, bufferSize)
+	dropped := 0
+
+	if len(c.streams) == 0 {
+		dropped = moveEvents(stream, c.backlog)
+	}
+
+	c.streams = append(c.streams, stream)
+	c.state = eventsOpen
+	c.pausedAt = time.Time{}
+
+	return stream, dropped, nil
+}
+
+// removeStream closes an event stream. Once the last stream is closed, the
+// connection is paused, and the events that were not delivered yet are kept
+// for the next stream. It returns true if the connection was paused, and the
+// number of undelivered events that did not fit in the backlog.
+func (c *clientConn) removeStream(stream chan interface{}, now time.Time) (bool, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return false, 0
+	}
+
+	found := false
+
+	for i, s := range c.streams {
+		if s == stream {
+			c.streams = append(c.streams[:i], c.streams[i+1:]...)
+			found = true
+			break
+		}
+	}
+
+	if !found || len(c.streams) > 0 {
+		return false, 0
+	}
+
+	dropped := moveEvents(c.backlog, stream)
+	c.state = eventsPaused
+	c.pausedAt = now
+
+	return true, dropped
+}
+
+// send queues an event on all the streams of the connection, or in the
+// backlog if no stream is open. It returns the number of queues that were
+// full, and errEventBufferFull if the event could not be queued anywhere.
+func (c *clientConn) send(event interface{}) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return 0, errUnknownClient
+	}
+
+	if len(c.streams) == 0 {
+		if !trySend(c.backlog, event) {
+			return 1, errEventBufferFull
+		}
+
+		return 0, nil
+	}
+
+	dropped := 0
+
+	for _, stream := range c.streams {
+		if !trySend(stream, event) {
+			dropped++
+		}
+	}
+
+	if dropped == len(c.streams) {
+		return dropped, errEventBufferFull
+	}
+
+	return dropped, nil
+}
+
+// isOpen returns true if the connection has at least one open stream.
+func (c *clientConn) isOpen() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return !c.closed && c.state == eventsOpen
+}
+
+func (c *clientConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closed
+}
+
+// status returns the state of the connection and its number of streams.
+func (c *clientConn) status() (clientConnState, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.state, len(c.streams)
+}
+
+// close closes the connection, and returns false if it was already closed.
+func (c *clientConn) close() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closeLocked()
+}
+
+// closeIfPausedSince closes the connection if it is still paused since
+// pausedAt, and returns true if it did.
+func (c *clientConn) closeIfPausedSince(pausedAt time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != eventsPaused || !c.pausedAt.Equal(pausedAt) {
+		return false
+	}
+
+	return c.closeLocked()
+}
+
+func (c *clientConn) closeLocked() bool {
+	if c.closed {
+		return false
+	}
+
+	c.closed = true
+
+	for _, listener := range c.listeners {
+		close(listener)
+	}
+
+	for _, stream := range c.streams {
+		close(stream)
+	}
+
+	close(c.backlog)
+
+	return true
+}
+
+func trySend(ch chan interface{}, event interface{}) bool {
+	select {
+	case ch <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// moveEvents moves the events queued in from to "to", oldest first. Once "to"
+// is full, the remaining events are discarded, and moveEvents returns their
+// count. The caller must hold the lock of the connection, so that nothing
+// else queues events in "to" meanwhile.
+func moveEvents(to, from chan interface{}) int {
+	dropped := 0
+
+	for {
+		select {
+		case event := <-from:
+			if len(to) < cap(to) {
+				to <- event
+			} else {
+				dropped++
+			}
+		default:
+			return dropped
+		}
+	}
 }
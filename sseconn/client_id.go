@@ -41,6 +41,16 @@ func (c ClientID) MarshalText() ([]byte, error) {
 	return []byte(c.String()), nil
 }
 
+func (c *ClientID) UnmarshalText(data []byte) error {
+	id, err := ClientIDFromString(string(data))
+	if err != nil {
+		return err
+	}
+
+	*c = id
+	return nil
+}
+
 func (c ClientID) IsZero() bool {
 	var zero ClientID
 	return bytes.Equal(zero[:], c[:])
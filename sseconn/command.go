@@ -10,21 +10,91 @@ type command struct {
 
 const helloCommandName = "hello"
 
+type helloCommand struct {
+	command
+	ProtocolVersion int    `json:"protocolVersion"` // newest version the client speaks
+	Transport       string `json:"transport,omitempty"`
+}
+
 type helloResult struct {
-	EventsURL string `json:"eventsUrl"`
+	EventsURL       string `json:"eventsUrl"`
+	Transport       string `json:"transport"`
+	ProtocolVersion int    `json:"protocolVersion"` // version the client must speak
+}
+
+// Transports on which clients receive their events. The events URL returned
+// by hello and events-url depends on the transport they ask for, event
+// streams being the default.
+const (
+	sseTransport  = "sse"
+	pollTransport = "poll"
+)
+
+// the events-url command returns a fresh events URL for an existing
+// connection, once the one returned by hello expired.
+const eventsURLCommandName = "events-url"
+
+type eventsURLCommand struct {
+	command
+	Transport string `json:"transport,omitempty"`
 }
 
 const dataCommandName = "data"
 
 type dataCommand struct {
 	command
+	Key     string          `json:"key,omitempty"` // optional idempotency key
 	Payload json.RawMessage `json:"payload"`
 }
 
+// dataResult is the result of a data command. Seq numbers the data commands
+// accepted for a client, in the order in which listeners receive them.
+// Duplicate is set when a command with the same idempotency key was already
+// accepted, in which case Seq is the one of that command.
 type dataResult struct {
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// the batch command sends several data commands at once, typically the ones a
+// client buffered while it was offline. Each of them must have an idempotency
+// key, so that replaying a command that already reached the server does not
+// run it twice.
+const batchCommandName = "batch"
+
+type batchCommand struct {
+	command
+	Commands []batchEntry `json:"commands"`
+}
+
+type batchEntry struct {
+	Key     string          `json:"key"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// batchResult holds the result of each command of a batch, in order. Commands
+// are queued in order, so once a command is rejected the following ones are
+// rejected too, with the same error.
+type batchResult struct {
+	Results []batchEntryResult `json:"results"`
+}
+
+type batchEntryResult struct {
+	Key string `json:"key"`
+	dataResult
+	Error string `json:"error,omitempty"`
 }
 
 type eventData struct {
 	Event   string      `json:"event"`
 	Payload interface{} `json:"payload,omitempty"`
+	EventVersion
+}
+
+// EventVersion lets clients detect the events they missed. Version orders the
+// events of a source (a room for example), and Previous is the version of the
+// previous event of that source sent to the same client.
+type EventVersion struct {
+	Version  uint64 `json:"version,omitempty"`
+	Previous uint64 `json:"previousVersion,omitempty"`
 }
@@ -0,0 +1,104 @@
+package sseconn
+
+import (
+	"sync"
+	"time"
+)
+
+// commandKeys remembers the idempotency keys of the data commands of each
+// client. Keys are kept across the connections of a client, so that commands
+// replayed after the connection expired or was replaced by a new hello are
+// still only queued once. The keys of a client are forgotten once it has not
+// sent any keyed command for Options.CommandKeysTTL.
+type commandKeys struct {
+	lock    sync.Mutex // protects clients
+	clients map[ClientID]*clientCommandKeys
+	maxKeys int
+	ttl     time.Duration
+}
+
+type clientCommandKeys struct {
+	lock     sync.Mutex
+	seqs     map[string]uint64 // by key
+	order    []string          // oldest first
+	lastUsed time.Time
+	pruned   bool // removed from commandKeys.clients by prune
+}
+
+func newCommandKeys(maxKeys int, ttl time.Duration) *commandKeys {
+	return &commandKeys{clients: map[ClientID]*clientCommandKeys{}, maxKeys: maxKeys, ttl: ttl}
+}
+
+// queue calls queueCommand unless clientID already used key, in which case
+// it returns the sequence number of the first command and true. Commands
+// without a key are always queued.
+func (k *commandKeys) queue(clientID ClientID, key string, now time.Time, queueCommand func() (uint64, error)) (uint64, bool, error) {
+	if key == "" {
+		seq, err := queueCommand()
+		return seq, false, err
+	}
+
+	client := k.lockClient(clientID)
+	defer client.lock.Unlock()
+
+	client.lastUsed = now
+
+	if seq, ok := client.seqs[key]; ok {
+		return seq, true, nil
+	}
+
+	seq, err := queueCommand()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(client.order) == k.maxKeys {
+		delete(client.seqs, client.order[0])
+		client.order = client.order[1:]
+	}
+
+	client.seqs[key] = seq
+	client.order = append(client.order, key)
+
+	return seq, false, nil
+}
+
+// lockClient returns the keys of clientID, locked. The lock of the client is
+// held while queueing, so that concurrent requests with the same key don't
+// both queue their command.
+func (k *commandKeys) lockClient(clientID ClientID) *clientCommandKeys {
+	for {
+		k.lock.Lock()
+		client := k.clients[clientID]
+		if client == nil {
+			client = &clientCommandKeys{seqs: map[string]uint64{}}
+			k.clients[clientID] = client
+		}
+		k.lock.Unlock()
+
+		client.lock.Lock()
+
+		// prune may have removed the client before we locked it, its keys
+		// would then be lost: look it up again.
+		if !client.pruned {
+			return client
+		}
+
+		client.lock.Unlock()
+	}
+}
+
+// prune forgets the keys of the clients that did not use any for the TTL.
+func (k *commandKeys) prune(now time.Time) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	for clientID, client := range k.clients {
+		client.lock.Lock()
+		if now.Sub(client.lastUsed) >= k.ttl {
+			client.pruned = true
+			delete(k.clients, clientID)
+		}
+		client.lock.Unlock()
+	}
+}
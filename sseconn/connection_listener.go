@@ -0,0 +1,58 @@
+package sseconn
+
+import "sync"
+
+// connectionListener hands the IDs of new connections to a listener. IDs are
+// queued while the listener is busy, so that no connection is missed and
+// hello requests never wait for the listener.
+type connectionListener struct {
+	lock    sync.Mutex // protects pending
+	pending []ClientID
+	wake    chan struct{} // signals that pending is not empty
+	out     chan ClientID
+}
+
+func newConnectionListener() *connectionListener {
+	return &connectionListener{
+		wake: make(chan struct{}, 1),
+		out:  make(chan ClientID),
+	}
+}
+
+func (l *connectionListener) notify(clientID ClientID) {
+	l.lock.Lock()
+	l.pending = append(l.pending, clientID)
+	l.lock.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default: // already signaled
+	}
+}
+
+// run delivers the queued IDs in order until closeChan is closed, and then
+// closes the channel of the listener.
+func (l *connectionListener) run(closeChan <-chan struct{}) {
+	defer close(l.out)
+
+	for {
+		l.lock.Lock()
+		pending := l.pending
+		l.pending = nil
+		l.lock.Unlock()
+
+		for _, clientID := range pending {
+			select {
+			case l.out <- clientID:
+			case <-closeChan:
+				return
+			}
+		}
+
+		select {
+		case <-l.wake:
+		case <-closeChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package sseconn
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	corsAllowedHeaders = "Content-Type"
+	corsMaxAge         = 10 * 60 // seconds
+)
+
+// allowAllOrigins can be used in Options.AllowedOrigins to accept requests
+// from any origin.
+const allowAllOrigins = "*"
+
+// checkOrigin rejects cross origin requests coming from origins that are not
+// explicitly allowed, and sets the CORS headers for the allowed ones.
+//
+// Requests without an Origin header (non browser clients) and same origin
+// requests are always accepted.
+func (h *Handler) checkOrigin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.setCORSHeaders(w, r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// CheckOrigin applies the cross origin policy of the Handler (see
+// Options.AllowedOrigins) to another API served next to it, and answers the
+// CORS preflight requests for the given methods.
+func (h *Handler) CheckOrigin(next http.Handler, methods ...string) http.Handler {
+	checked := h.checkOrigin(next.ServeHTTP)
+	preflight := h.preflightHandlerHTTP(methods...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			preflight(w, r)
+			return
+		}
+
+		checked(w, r)
+	})
+}
+
+// preflightHandlerHTTP answers the CORS preflight requests sent by browsers
+// before cross origin requests.
+func (h *Handler) preflightHandlerHTTP(methods ...string) http.HandlerFunc {
+	allowedMethods := strings.Join(methods, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.setCORSHeaders(w, r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// setCORSHeaders returns false if the request comes from an origin that is
+// not allowed.
+func (h *Handler) setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || isSameOrigin(origin, r, h.options.TrustForwardedProto) {
+		return true
+	}
+
+	if !h.isAllowedOrigin(origin) {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+
+	return true
+}
+
+func (h *Handler) isAllowedOrigin(origin string) bool {
+	for _, allowed := range h.options.AllowedOrigins {
+		if allowed == allowAllOrigins || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSameOrigin returns true if origin has the same scheme and host as r.
+func isSameOrigin(origin string, r *http.Request, trustForwardedProto bool) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Scheme, requestScheme(r, trustForwardedProto)) && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestScheme returns the scheme with which the client sent r.
+func requestScheme(r *http.Request, trustForwardedProto bool) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); trustForwardedProto && proto != "" {
+		return proto
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
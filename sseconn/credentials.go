@@ -0,0 +1,122 @@
+package sseconn
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const credentialsTimeLength = 8 // bytes
+
+// credentialsResult is returned by the credentials endpoint.
+type credentialsResult struct {
+	ClientID  string    `json:"clientId"`
+	Secret    string    `json:"secret"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// newCredentials mints a new client ID, and the secret that goes with it.
+// Secrets are signed by the server, so that they can be checked without
+// keeping track of the issued credentials.
+//
+// Format: issue time as big endian Unix seconds || HMAC-SHA512(key, client ID
+// || issue time), truncated to the length of a secret.
+func (h *Handler) newCredentials(now time.Time) (ClientID, ClientSecret, error) {
+	clientID, err := NewClientID()
+	if err != nil {
+		return clientID, ClientSecret{}, err
+	}
+
+	var secret ClientSecret
+	binary.BigEndian.PutUint64(secret[:credentialsTimeLength], uint64(now.Unix()))
+	copy(secret[credentialsTimeLength:], h.credentialsMAC(clientID, secret[:credentialsTimeLength]))
+
+	return clientID, secret, nil
+}
+
+// checkCredentials returns errInvalidClientSecret unless secret was issued
+// for clientID by newCredentials, and neither expired nor was revoked.
+func (h *Handler) checkCredentials(clientID ClientID, secret ClientSecret, now time.Time) error {
+	if h.options.ClientChosenCredentials {
+		return nil
+	}
+
+	issuedAt, mac := secret[:credentialsTimeLength], secret[credentialsTimeLength:]
+
+	if !hmac.Equal(mac, h.credentialsMAC(clientID, issuedAt)[:len(mac)]) {
+		return errInvalidClientSecret
+	}
+
+	if now.After(credentialsExpiry(secret, h.options.CredentialsTTL)) {
+		return errInvalidClientSecret
+	}
+
+	revoked, err := h.options.Revocations.Revoked(clientID)
+	if err != nil {
+		return fmt.Errorf("error looking up revocation: %w", err)
+	}
+
+	if revoked {
+		return errInvalidClientSecret
+	}
+
+	return nil
+}
+
+func (h *Handler) credentialsMAC(clientID ClientID, issuedAt []byte) []byte {
+	mac := hmac.New(sha512.New, h.credentialsKey)
+	mac.Write(clientID[:])
+	mac.Write(issuedAt)
+
+	return mac.Sum(nil)
+}
+
+func credentialsExpiry(secret ClientSecret, ttl time.Duration) time.Time {
+	issuedAt := int64(binary.BigEndian.Uint64(secret[:credentialsTimeLength]))
+	return time.Unix(issuedAt, 0).Add(ttl)
+}
+
+// RevokeClient rejects all future commands of clientID, and closes its
+// connection if it is connected to this Handler. Revocations are forgotten
+// once the credentials of the client would have expired anyway. Replicas
+// sharing Options.Revocations reject the next commands of the client, but
+// leave its connection open until then.
+func (h *Handler) RevokeClient(clientID ClientID) error {
+	if err := h.options.Revocations.Revoke(clientID, time.Now().Add(h.options.CredentialsTTL)); err != nil {
+		return fmt.Errorf("error revoking client: %w", err)
+	}
+
+	if err := h.closeConnection(clientID); err == nil {
+		h.logger.Info("closed the connection of a revoked client", "client_id", clientID)
+	}
+
+	return nil
+}
+
+func (h *Handler) credentialsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	if !h.ipRateLimiter.allow(remoteIP(r), now) {
+		h.writeError(w, errRateLimited)
+		return
+	}
+
+	clientID, secret, err := h.newCredentials(now)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.Header().Add("Content-Type", jsonContentType)
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(credentialsResult{
+		ClientID:  clientID.String(),
+		Secret:    secret.String(),
+		ExpiresAt: credentialsExpiry(secret, h.options.CredentialsTTL),
+	})
+}
@@ -0,0 +1,54 @@
+package sseconn
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+const eventsTokenTimeLength = 8 // bytes
+
+// newEventsToken returns a token proving that whoever opens the event stream
+// of clientID knows its secret, without putting the secret itself in the
+// events URL. The token expires after Options.EventsTokenTTL.
+//
+// Format: base64url(expiry as big endian Unix seconds || HMAC-SHA256(key,
+// client ID || secret || expiry))
+func (h *Handler) newEventsToken(clientID ClientID, secret ClientSecret, now time.Time) string {
+	var expiry [eventsTokenTimeLength]byte
+	binary.BigEndian.PutUint64(expiry[:], uint64(now.Add(h.options.EventsTokenTTL).Unix()))
+
+	token := append(expiry[:], h.eventsTokenMAC(clientID, secret, expiry[:])...)
+
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func (h *Handler) checkEventsToken(token string, clientID ClientID, secret ClientSecret, now time.Time) error {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != eventsTokenTimeLength+sha256.Size {
+		return errInvalidEventsToken
+	}
+
+	expiry, mac := data[:eventsTokenTimeLength], data[eventsTokenTimeLength:]
+
+	if !hmac.Equal(mac, h.eventsTokenMAC(clientID, secret, expiry)) {
+		return errInvalidEventsToken
+	}
+
+	if now.Unix() > int64(binary.BigEndian.Uint64(expiry)) {
+		return errInvalidEventsToken
+	}
+
+	return nil
+}
+
+func (h *Handler) eventsTokenMAC(clientID ClientID, secret ClientSecret, expiry []byte) []byte {
+	mac := hmac.New(sha256.New, h.eventsTokenKey)
+	mac.Write(clientID[:])
+	mac.Write(secret[:])
+	mac.Write(expiry)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,65 @@
+package sseconn
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryQueue orders the paused connections by the time at which they expire,
+// so that the janitor does not have to look at all the connections.
+//
+// Connections are not removed from the queue when they resume. Instead, each
+// entry remembers when its connection was paused, and is ignored if the
+// connection was resumed since.
+type expiryQueue struct {
+	lock    sync.Mutex
+	entries expiryHeap
+}
+
+type expiryEntry struct {
+	conn      *clientConn
+	pausedAt  time.Time
+	expiresAt time.Time
+}
+
+func (q *expiryQueue) push(entry expiryEntry) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	heap.Push(&q.entries, entry)
+}
+
+// popExpired removes and returns the entries that expired at now.
+func (q *expiryQueue) popExpired(now time.Time) []expiryEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var expired []expiryEntry
+
+	for len(q.entries) > 0 && !q.entries[0].expiresAt.After(now) {
+		expired = append(expired, heap.Pop(&q.entries).(expiryEntry))
+	}
+
+	return expired
+}
+
+// expiryHeap implements heap.Interface.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = expiryEntry{}
+	*h = old[:len(old)-1]
+
+	return entry
+}
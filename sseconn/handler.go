@@ -1,16 +1,21 @@
 package sseconn
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -20,14 +25,11 @@ const (
 	keepAliveEventName     = "keep-alive"
 	clientIDLength         = 16 // bytes
 	clientSecretLength     = 64 // bytes
+	maxCommandKeyLength    = 128
 	jsonContentType        = "application/json; charset=utf-8"
 	eventStreamContentType = "text/event-stream"
 )
 
-var (
-	keepAliveInterval = 3 * time.Second
-)
-
 var (
 	errInvalidRequest      = errors.New("Invalid request")
 	errInvalidClientID     = errors.New("Invalid client ID")
@@ -35,6 +37,14 @@ var (
 	errUnknownClient       = errors.New("Unknown client")
 	errInvalidConnState    = errors.New("Invalid connection state")
 	errEventBufferFull     = errors.New("Event buffer full")
+	errRequestTooLarge     = errors.New("Request too large")
+	errRateLimited         = errors.New("Too many requests")
+	errCommandQueueFull    = errors.New("Command queue full")
+	errNoListener          = errors.New("No listener for the connection")
+	errInvalidEventsToken  = errors.New("Invalid events token")
+	errIdentityMismatch    = errors.New("Connection belongs to another user")
+	errUnsupportedProtocol = errors.New("Unsupported protocol version")
+	errProtocolMismatch    = errors.New("Connection uses a newer protocol version")
 )
 
 // Handler is a HTTP handler that manages bidirectional connections on top of
@@ -43,27 +53,107 @@ var (
 // The client-to-server messages are sent over regular HTTP requests, and the
 // server-to-client messages are dispatched via server sent events.
 //
-// This handler handles two routes under a given prefix:
-// 1. POST /prefix/command for client sent messages
-// 2. GET /api/events/{ID} for server sent events
+// This handler handles four routes under a given prefix:
+// 1. POST /prefix/credentials to get a client ID and secret
+// 2. POST /prefix/command for client sent messages
+// 3. GET /api/events/{ID}?token={token} for server sent events
+// 4. GET /api/poll/{ID}?token={token} to long poll for events instead
+//
+// Client secrets are signed by the server (see Options.CredentialsKey), so
+// that clients cannot take over the client ID of somebody else. Clients that
+// pick their own ID and secret are only accepted with
+// Options.ClientChosenCredentials.
+//
+// The events URL is returned by the hello command, for the transport the
+// client picks (the "transport" field, "sse" or "poll"). Its token proves that the
+// client knows the secret of the connection, so that knowing a client ID is
+// not enough to read its events.
+//
+// A client can open several event streams at the same time, for example from
+// several browser tabs. Events are sent to all of them, and the connection is
+// only paused once all of them are closed.
+//
+// Data commands are queued for the listeners of the connection in the order
+// they are received, and numbered per client (the "seq" field of their
+// result). When the queue is full, or when nothing listens on the connection
+// yet, commands are rejected with a 503 status and a Retry-After header rather
+// than dropped.
+//
+// Data commands can carry an idempotency key. A command whose key was already
+// used by the client is not queued again, even on a later connection, so that
+// clients can safely retry commands whose response they did not get. Clients
+// that were offline can replay the commands they buffered in the meantime with
+// a single batch command, which returns the result of each of them.
+//
+// The hello command negotiates the version of the protocol spoken on top of
+// the connection (see Options.MaxProtocolVersion), which listeners get with
+// ProtocolVersion. Tabs sharing a connection share its version, and tabs
+// running a client older than that version are rejected while the connection
+// is open.
+//
+// When an authentication layer attaches an Identity to the request context
+// (see ContextWithIdentity), the connection created by hello belongs to that
+// identity, and requests from other users are rejected.
+//
+// Both routes reject cross origin requests, unless the origin is listed in
+// Options.AllowedOrigins.
 //
 // Connection steps:
-// 1. Client sends initial POST to open connection with a client ID (how do we prevent takeovers?).
-// 2. Server sends back SSE endpoint URL.
-// 3. Client creates EventSource and when the connection is open, confirms to the server.
+// 1. Client gets its credentials, unless it still has valid ones.
+// 2. Client sends initial POST to open connection with its credentials.
+// 3. Server sends back SSE endpoint URL.
+// 4. Client creates EventSource and when the connection is open, confirms to the server.
 type Handler struct {
+	// counters, accessed atomically. Kept at the top of the struct for 64 bit
+	// alignment on 32 bit platforms.
+	expiredConnections uint64
+	droppedEvents      uint64
+	rejectedData       uint64
+	duplicateData      uint64
+
 	prefix              string
+	options             Options
+	logger              *slog.Logger
 	router              *mux.Router
-	lock                sync.RWMutex
-	connections         map[ClientID]*clientConn
-	connectionListeners []chan ClientID
+	connections         *registry
+	commandKeys         *commandKeys
+	expiries            expiryQueue
+	lock                sync.RWMutex // protects connectionListeners
+	connectionListeners []*connectionListener
 	closeChan           chan struct{}
+	eventsTokenKey      []byte
+	credentialsKey      []byte
+	clientRateLimiter   *rateLimiter
+	ipRateLimiter       *rateLimiter
 }
 
-func NewHandler(prefix string) *Handler {
+// NewHandler returns a Handler serving its routes under prefix.
+func NewHandler(prefix string, options Options) *Handler {
+	options = options.withDefaults()
+
+	eventsTokenKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(eventsTokenKey); err != nil {
+		panic("error generating events token key: " + err.Error())
+	}
+
+	credentialsKey := options.CredentialsKey
+	if len(credentialsKey) == 0 {
+		credentialsKey = make([]byte, sha512.Size)
+		if _, err := rand.Read(credentialsKey); err != nil {
+			panic("error generating credentials key: " + err.Error())
+		}
+	}
+
 	h := &Handler{
-		router:      mux.NewRouter(),
-		connections: map[ClientID]*clientConn{},
+		options:           options,
+		logger:            options.Logger,
+		router:            mux.NewRouter(),
+		connections:       newRegistry(),
+		commandKeys:       newCommandKeys(options.MaxCommandKeys, options.CommandKeysTTL),
+		eventsTokenKey:    eventsTokenKey,
+		credentialsKey:    credentialsKey,
+		clientRateLimiter: newRateLimiter(options.ClientRateLimit),
+		ipRateLimiter:     newRateLimiter(options.IPRateLimit),
 	}
 
 	router := h.router
@@ -81,8 +171,14 @@ func NewHandler(prefix string) *Handler {
 	}
 
 	h.prefix = prefix
-	router.Methods("POST").Path("/command").HandlerFunc(h.commandHandlerHTTP)
-	router.Methods("GET").Path("/events/{id}").HandlerFunc(h.eventsHandlerHTTP)
+	router.Methods("POST").Path("/credentials").HandlerFunc(h.checkOrigin(h.credentialsHandlerHTTP))
+	router.Methods("OPTIONS").Path("/credentials").HandlerFunc(h.preflightHandlerHTTP("POST"))
+	router.Methods("POST").Path("/command").HandlerFunc(h.checkOrigin(h.commandHandlerHTTP))
+	router.Methods("OPTIONS").Path("/command").HandlerFunc(h.preflightHandlerHTTP("POST"))
+	router.Methods("GET").Path("/events/{id}").HandlerFunc(h.checkOrigin(h.eventsHandlerHTTP))
+	router.Methods("OPTIONS").Path("/events/{id}").HandlerFunc(h.preflightHandlerHTTP("GET"))
+	router.Methods("GET").Path("/poll/{id}").HandlerFunc(h.checkOrigin(h.pollHandlerHTTP))
+	router.Methods("OPTIONS").Path("/poll/{id}").HandlerFunc(h.preflightHandlerHTTP("GET"))
 
 	h.closeChan = make(chan struct{})
 
@@ -94,7 +190,7 @@ func NewHandler(prefix string) *Handler {
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("panic happened while handling %s %s: %s", r.Method, r.URL.String(), err)
+			h.logger.Error("panic happened while handling request", "method", r.Method, "url", r.URL.String(), "error", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
 	}()
@@ -105,46 +201,50 @@ func (h *Handler) Close() {
 	close(h.closeChan)
 }
 
+// ListenConnections returns a channel receiving the ID of each new
+// connection, in the order they were created. The channel is closed once the
+// handler is closed.
 func (h *Handler) ListenConnections() <-chan ClientID {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	ch := make(chan ClientID)
-	h.connectionListeners = append(h.connectionListeners, ch)
-	return ch
+	listener := newConnectionListener()
+	h.connectionListeners = append(h.connectionListeners, listener)
+	go listener.run(h.closeChan)
+
+	return listener.out
 }
 
 func (h *Handler) Send(clientID ClientID, eventName string, payload interface{}) error {
-	h.lock.RLock()
-	defer h.lock.RUnlock()
+	return h.SendVersioned(clientID, eventName, payload, EventVersion{})
+}
 
-	c, exists := h.connections[clientID]
-	if !exists {
+// SendVersioned is like Send, but attaches a version to the event.
+func (h *Handler) SendVersioned(clientID ClientID, eventName string, payload interface{}, version EventVersion) error {
+	c := h.connections.get(clientID)
+	if c == nil {
 		return errUnknownClient
 	}
 
-	select {
-	case c.eventChan <- eventData{Event: eventName, Payload: payload}:
-		return nil
-	default:
-		return errEventBufferFull
+	dropped, err := c.send(eventData{Event: eventName, Payload: payload, EventVersion: version})
+	h.countDroppedEvents(dropped)
+
+	return err
+}
+
+func (h *Handler) countDroppedEvents(dropped int) {
+	if dropped > 0 {
+		atomic.AddUint64(&h.droppedEvents, uint64(dropped))
 	}
 }
 
 func (h *Handler) Listen(clientID ClientID) (<-chan json.RawMessage, error) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
-
-	c, exists := h.connections[clientID]
-	if !exists {
+	c := h.connections.get(clientID)
+	if c == nil {
 		return nil, errUnknownClient
 	}
 
-	ch := make(chan json.RawMessage)
-	c.listeners = append(c.listeners, ch)
-	h.connections[clientID] = c
-
-	return ch, nil
+	return c.addListener(h.options.CommandQueueSize)
 }
 
 // Handler - Private
@@ -153,16 +253,33 @@ func (h *Handler) writeError(w http.ResponseWriter, err error) {
 	switch {
 	case errors.Is(err, errInvalidRequest), errors.Is(err, errInvalidClientID),
 		errors.Is(err, errUnknownClient), errors.Is(err, errInvalidConnState),
-		errors.Is(err, errInvalidClientSecret):
+		errors.Is(err, errInvalidClientSecret), errors.Is(err, errUnsupportedProtocol):
 		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errInvalidEventsToken), errors.Is(err, errIdentityMismatch):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errProtocolMismatch):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errRequestTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errRateLimited):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, errCommandQueueFull), errors.Is(err, errNoListener):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 	default:
-		log.Printf("error serving request: %s", err)
+		h.logger.Error("error serving request", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
 func (h *Handler) commandHandlerHTTP(w http.ResponseWriter, r *http.Request) {
-	result, err := h.commandHandler(r.Body)
+	if !h.ipRateLimiter.allow(remoteIP(r), time.Now()) {
+		h.writeError(w, errRateLimited)
+		return
+	}
+
+	result, err := h.commandHandler(requestIdentity(r.Context()), http.MaxBytesReader(w, r.Body, h.options.MaxCommandSize))
 
 	if err != nil {
 		h.writeError(w, err)
@@ -174,9 +291,16 @@ func (h *Handler) commandHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-func (h *Handler) commandHandler(in io.Reader) (interface{}, error) {
+// commandHandler runs a command sent on behalf of identity, which is nil for
+// anonymous requests.
+func (h *Handler) commandHandler(identity *Identity, in io.Reader) (interface{}, error) {
 	var rawCmd json.RawMessage
 	if err := json.NewDecoder(in).Decode(&rawCmd); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, errRequestTooLarge
+		}
+
 		return nil, errInvalidRequest
 	}
 
@@ -195,18 +319,50 @@ func (h *Handler) commandHandler(in io.Reader) (interface{}, error) {
 		return struct{}{}, errInvalidClientSecret
 	}
 
+	now := time.Now()
+
+	// requests with invalid credentials are only charged to the IP rate
+	// limit, so that they cannot use up the rate limit of the client they
+	// pretend to be.
+	if err := h.checkCredentials(clientID, clientSecret, now); err != nil {
+		return struct{}{}, err
+	}
+
+	if !h.clientRateLimiter.allow(clientRateLimitKey(clientID, clientSecret, h.options.ClientChosenCredentials), now) {
+		return nil, errRateLimited
+	}
+
 	var result interface{}
 
 	switch baseCmd.Name {
 	case helloCommandName:
-		result, err = h.handleHelloCommand(clientID, clientSecret)
+		cmd := helloCommand{}
+		if err := json.Unmarshal(rawCmd, &cmd); err != nil {
+			return nil, errInvalidRequest
+		}
+
+		result, err = h.handleHelloCommand(identity, clientID, clientSecret, cmd)
+	case eventsURLCommandName:
+		cmd := eventsURLCommand{}
+		if err := json.Unmarshal(rawCmd, &cmd); err != nil {
+			return nil, errInvalidRequest
+		}
+
+		result, err = h.handleEventsURLCommand(identity, clientID, clientSecret, cmd)
 	case dataCommandName:
 		cmd := dataCommand{}
 		if err := json.Unmarshal(rawCmd, &cmd); err != nil {
 			return nil, errInvalidRequest
 		}
 
-		result, err = h.handleDataCommand(clientID, clientSecret, cmd)
+		result, err = h.handleDataCommand(identity, clientID, clientSecret, cmd)
+	case batchCommandName:
+		cmd := batchCommand{}
+		if err := json.Unmarshal(rawCmd, &cmd); err != nil {
+			return nil, errInvalidRequest
+		}
+
+		result, err = h.handleBatchCommand(identity, clientID, clientSecret, cmd)
 	default:
 		err = errInvalidRequest
 	}
@@ -214,45 +370,181 @@ func (h *Handler) commandHandler(in io.Reader) (interface{}, error) {
 	return result, err
 }
 
-func (h *Handler) handleHelloCommand(clientID ClientID, clientSecret ClientSecret) (helloResult, error) {
-	if err := h.closeConnectionIfExists(clientID, clientSecret); err != nil && err != errUnknownClient {
+// clientRateLimitKey returns the key of the rate limit of a client. Client
+// chosen credentials are not verified, so their secret is part of the key:
+// commands sent with the client ID of someone else but the wrong secret don't
+// use up their rate limit.
+func clientRateLimitKey(clientID ClientID, secret ClientSecret, clientChosenCredentials bool) string {
+	if clientChosenCredentials {
+		return clientID.String() + "/" + secret.String()
+	}
+
+	return clientID.String()
+}
+
+func (h *Handler) handleHelloCommand(identity *Identity, clientID ClientID, clientSecret ClientSecret, cmd helloCommand) (helloResult, error) {
+	transport, err := checkTransport(cmd.Transport)
+	if err != nil {
+		return helloResult{}, err
+	}
+
+	protocolVersion, err := h.negotiateProtocolVersion(cmd.ProtocolVersion)
+	if err != nil {
+		return helloResult{}, err
+	}
+
+	// another tab of the same client is already connected, share its
+	// connection (and its protocol version). Tabs running an older client
+	// cannot speak it.
+	if c, err := h.openConnection(identity, clientID, clientSecret); err != nil {
+		return helloResult{}, err
+	} else if c != nil {
+		if protocolVersion < c.protocolVersion {
+			return helloResult{}, errProtocolMismatch
+		}
+
+		return helloResult{EventsURL: h.eventsURL(clientID, clientSecret, transport), Transport: transport, ProtocolVersion: c.protocolVersion}, nil
+	}
+
+	if err := h.closeConnectionIfExists(identity, clientID, clientSecret); err != nil && err != errUnknownClient {
 		return helloResult{}, fmt.Errorf("error closing existing connection: %w", err)
 	}
 
-	clientConn, err := h.createConnection(clientID, clientSecret)
+	clientConn, err := h.createConnection(identity, clientID, clientSecret, protocolVersion)
 	if err != nil {
 		return helloResult{}, fmt.Errorf("error creating connection: %w", err)
 	}
 
-	eventsURL := path.Join(h.prefix, "events", url.PathEscape(clientConn.clientID.String()))
+	return helloResult{EventsURL: h.eventsURL(clientConn.clientID, clientConn.secret, transport), Transport: transport, ProtocolVersion: protocolVersion}, nil
+}
+
+func (h *Handler) handleEventsURLCommand(identity *Identity, clientID ClientID, clientSecret ClientSecret, cmd eventsURLCommand) (helloResult, error) {
+	transport, err := checkTransport(cmd.Transport)
+	if err != nil {
+		return helloResult{}, err
+	}
+
+	c := h.connections.get(clientID)
+	if c == nil {
+		return helloResult{}, errUnknownClient
+	} else if c.secret != clientSecret {
+		return helloResult{}, errInvalidClientSecret
+	} else if !sameIdentity(c.identity, identity) {
+		return helloResult{}, errIdentityMismatch
+	}
+
+	return helloResult{EventsURL: h.eventsURL(clientID, clientSecret, transport), Transport: transport, ProtocolVersion: c.protocolVersion}, nil
+}
 
-	return helloResult{EventsURL: eventsURL}, nil
+// checkTransport returns the transport asked for by a client, which defaults
+// to event streams.
+func checkTransport(transport string) (string, error) {
+	switch transport {
+	case "", sseTransport:
+		return sseTransport, nil
+	case pollTransport:
+		return pollTransport, nil
+	default:
+		return "", errInvalidRequest
+	}
 }
 
-func (h *Handler) handleDataCommand(clientID ClientID, clientSecret ClientSecret, cmd dataCommand) (dataResult, error) {
-	h.lock.RLock()
-	defer h.lock.RUnlock()
+func (h *Handler) eventsURL(clientID ClientID, secret ClientSecret, transport string) string {
+	route := "events"
+	if transport == pollTransport {
+		route = "poll"
+	}
 
-	var res dataResult
+	query := url.Values{"token": {h.newEventsToken(clientID, secret, time.Now())}}
+	return path.Join(h.prefix, route, url.PathEscape(clientID.String())) + "?" + query.Encode()
+}
 
-	c, exists := h.connections[clientID]
-	if !exists {
-		return res, errUnknownClient
-	} else if c.secret != clientSecret {
-		return res, errInvalidClientSecret
+func (h *Handler) handleDataCommand(identity *Identity, clientID ClientID, clientSecret ClientSecret, cmd dataCommand) (dataResult, error) {
+	if len(cmd.Key) > maxCommandKeyLength {
+		return dataResult{}, errInvalidRequest
 	}
 
-	for _, listener := range c.listeners {
-		select {
-		case listener <- cmd.Payload:
-		default:
-			log.Printf("listener lagging behind for client %s, dropping data", clientID.String())
+	c, err := h.commandConnection(identity, clientID, clientSecret)
+	if err != nil {
+		return dataResult{}, err
+	}
+
+	return h.queueData(c, cmd.Key, cmd.Payload)
+}
+
+func (h *Handler) handleBatchCommand(identity *Identity, clientID ClientID, clientSecret ClientSecret, cmd batchCommand) (batchResult, error) {
+	for _, entry := range cmd.Commands {
+		if entry.Key == "" || len(entry.Key) > maxCommandKeyLength {
+			return batchResult{}, errInvalidRequest
 		}
 	}
 
+	c, err := h.commandConnection(identity, clientID, clientSecret)
+	if err != nil {
+		return batchResult{}, err
+	}
+
+	res := batchResult{Results: make([]batchEntryResult, 0, len(cmd.Commands))}
+
+	for _, entry := range cmd.Commands {
+		entryResult := batchEntryResult{Key: entry.Key}
+
+		if err == nil {
+			entryResult.dataResult, err = h.queueData(c, entry.Key, entry.Payload)
+		}
+
+		if err != nil {
+			// keep the commands in order: once one is rejected, the following
+			// ones are too
+			entryResult.Error = err.Error()
+		}
+
+		res.Results = append(res.Results, entryResult)
+	}
+
 	return res, nil
 }
 
+// commandConnection returns the connection of clientID, once it checked that
+// the command was sent by its owner.
+func (h *Handler) commandConnection(identity *Identity, clientID ClientID, clientSecret ClientSecret) (*clientConn, error) {
+	c := h.connections.get(clientID)
+	if c == nil {
+		return nil, errUnknownClient
+	} else if c.secret != clientSecret {
+		return nil, errInvalidClientSecret
+	} else if !sameIdentity(c.identity, identity) {
+		return nil, errIdentityMismatch
+	}
+
+	return c, nil
+}
+
+// queueData queues the payload of a data command for the listeners of c.
+func (h *Handler) queueData(c *clientConn, key string, payload json.RawMessage) (dataResult, error) {
+	seq, duplicate, err := h.commandKeys.queue(c.clientID, key, time.Now(), func() (uint64, error) {
+		return c.queueCommand(payload)
+	})
+	if errors.Is(err, errCommandQueueFull) {
+		atomic.AddUint64(&h.rejectedData, 1)
+		h.logger.Warn("listener lagging behind, rejecting data", "client_id", c.clientID)
+	} else if errors.Is(err, errNoListener) {
+		atomic.AddUint64(&h.rejectedData, 1)
+		h.logger.Warn("no listener for the connection, rejecting data", "client_id", c.clientID)
+	}
+
+	if err != nil {
+		return dataResult{}, err
+	}
+
+	if duplicate {
+		atomic.AddUint64(&h.duplicateData, 1)
+		h.logger.Debug("ignoring duplicate data", "client_id", c.clientID, "key", key)
+	}
+
+	return dataResult{Seq: seq, Duplicate: duplicate}, nil
+}
+
 func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	clientID, err := ClientIDFromString(vars["id"])
@@ -261,7 +553,7 @@ func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	eventsChan, err := h.markConnectionOpen(clientID)
+	c, stream, err := h.openStream(requestIdentity(r.Context()), clientID, r.URL.Query().Get("token"))
 	if err != nil {
 		h.writeError(w, err)
 		return
@@ -269,7 +561,7 @@ func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 
 	encoder := json.NewEncoder(w)
 	flusher := w.(http.Flusher)
-	keepAliveTicker := time.NewTicker(keepAliveInterval)
+	keepAliveTicker := time.NewTicker(h.options.KeepAliveInterval)
 	defer keepAliveTicker.Stop()
 
 	w.Header().Add("Cache-Control", "no-cache, no-transform")
@@ -281,7 +573,7 @@ func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 	for {
 		var message interface{}
 		select {
-		case ev, ok := <-eventsChan:
+		case ev, ok := <-stream:
 			if !ok {
 				// the connection has been definitely closed by the Handler
 				return
@@ -291,8 +583,8 @@ func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 		case <-keepAliveTicker.C:
 			message = eventData{Event: keepAliveEventName}
 		case <-r.Context().Done():
-			// the downstream connection to the client broke, pause the connection
-			h.markConnectionPaused(clientID)
+			// the downstream connection to the client broke
+			h.closeStream(c, stream)
 			return
 		}
 
@@ -300,7 +592,7 @@ func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 
 		err := encoder.Encode(message)
 		if err != nil {
-			log.Printf("error encoding event for client %s: %s", clientID.String(), err)
+			h.logger.Error("error encoding event", "client_id", clientID, "error", err)
 			break
 		}
 
@@ -311,131 +603,140 @@ func (h *Handler) eventsHandlerHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) closeConnection(clientID ClientID) error {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+	c := h.connections.get(clientID)
+	if c == nil {
+		return errUnknownClient
+	}
+
+	h.removeConnection(c)
 
-	return h.closeConnectionLocked(clientID)
+	return nil
 }
 
-func (h *Handler) closeConnectionIfExists(clientID ClientID, secret ClientSecret) error {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// openConnection returns the connection of clientID if it has an open event
+// stream, or nil.
+func (h *Handler) openConnection(identity *Identity, clientID ClientID, secret ClientSecret) (*clientConn, error) {
+	c := h.connections.get(clientID)
+	if c == nil || c.secret != secret || !c.isOpen() {
+		return nil, nil
+	}
 
-	if conn := h.connections[clientID]; conn != nil && conn.secret == secret {
-		return h.closeConnectionLocked(clientID)
+	if !sameIdentity(c.identity, identity) {
+		return nil, errIdentityMismatch
 	}
 
-	return nil
+	return c, nil
 }
 
-func (h *Handler) closeConnectionLocked(clientID ClientID) error {
-
-	c, exists := h.connections[clientID]
-	if !exists {
-		return errUnknownClient
-	}
+func (h *Handler) closeConnectionIfExists(identity *Identity, clientID ClientID, secret ClientSecret) error {
+	if c := h.connections.get(clientID); c != nil && c.secret == secret {
+		if !sameIdentity(c.identity, identity) {
+			return errIdentityMismatch
+		}
 
-	delete(h.connections, clientID)
-	for _, listener := range c.listeners {
-		close(listener)
+		h.removeConnection(c)
 	}
-	close(c.eventChan)
 
-	// FIXME: Implement
 	return nil
 }
 
-func (h *Handler) createConnection(clientID ClientID, secret ClientSecret) (*clientConn, error) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// removeConnection closes c and removes it from the registry.
+func (h *Handler) removeConnection(c *clientConn) {
+	c.close()
+	h.connections.remove(c)
+}
 
-	if _, exists := h.connections[clientID]; exists {
+func (h *Handler) createConnection(identity *Identity, clientID ClientID, secret ClientSecret, protocolVersion int) (*clientConn, error) {
+	c := newClientConn(clientID, secret, identity, protocolVersion, h.options.EventBufferSize)
+
+	if !h.connections.add(c) {
 		return nil, fmt.Errorf("connection already exists")
 	}
 
-	c := &clientConn{
-		state:     helloReceived,
-		clientID:  clientID,
-		secret:    secret,
-		eventChan: make(chan interface{}, 128),
-	}
+	h.logger.Debug("connection created", "client_id", clientID)
 
-	h.connections[clientID] = c
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 
 	for _, listener := range h.connectionListeners {
-		select {
-		case listener <- clientID:
-		default:
-			log.Printf("connection listener lagging behind, dropping data")
-		}
+		listener.notify(clientID)
 	}
 
 	return c, nil
 }
 
-func (h *Handler) markConnectionOpen(clientID ClientID) (<-chan interface{}, error) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// openStream adds an event stream to the connection of clientID.
+func (h *Handler) openStream(identity *Identity, clientID ClientID, token string) (*clientConn, chan interface{}, error) {
+	c := h.connections.get(clientID)
+	if c == nil {
+		return nil, nil, errUnknownClient
+	} else if err := h.checkEventsToken(token, clientID, c.secret, time.Now()); err != nil {
+		return nil, nil, err
+	} else if !sameIdentity(c.identity, identity) {
+		return nil, nil, errIdentityMismatch
+	}
 
-	c, exists := h.connections[clientID]
-	if !exists {
-		return nil, errUnknownClient
-	} else if c.state != helloReceived && c.state != eventsPaused {
-		return nil, errInvalidConnState
+	stream, dropped, err := c.addStream(h.options.EventBufferSize)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	c.state = eventsOpen
-	c.pausedAt = time.Time{}
+	h.countDroppedEvents(dropped)
 
-	return c.eventChan, nil
+	return c, stream, nil
 }
 
-func (h *Handler) markConnectionPaused(clientID ClientID) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// closeStream removes a stream from c, pausing the connection if it was its
+// last stream.
+func (h *Handler) closeStream(c *clientConn, stream chan interface{}) {
+	now := time.Now()
 
-	c, exists := h.connections[clientID]
-	if !exists {
-		log.Printf("trying to pause non existing connection")
-		return
-	} else if c.state != eventsOpen {
-		log.Printf("trying to pause a connection that was not open")
-		return
-	}
+	paused, dropped := c.removeStream(stream, now)
+	h.countDroppedEvents(dropped)
 
-	c.state = eventsPaused
-	c.pausedAt = time.Now()
+	if paused {
+		h.expiries.push(expiryEntry{conn: c, pausedAt: now, expiresAt: now.Add(h.options.PausedConnectionTTL)})
+		h.logger.Debug("connection paused", "client_id", c.clientID)
+	}
 }
 
 func (h *Handler) janitor() {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(h.options.JanitorInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-h.closeChan:
 			return
-		case <-ticker.C:
-			h.closeExpiredConnections()
+		case now := <-ticker.C:
+			h.closeExpiredConnections(now)
+			h.clientRateLimiter.prune(now)
+			h.ipRateLimiter.prune(now)
+			h.commandKeys.prune(now)
 		}
 	}
 }
 
-func (h *Handler) closeExpiredConnections() {
-	const pausedConnectionTTL = 30 * time.Second
-
-	h.lock.Lock()
-	defer h.lock.Unlock()
-
-	now := time.Now()
-
-	for clientID, conn := range h.connections {
-		if conn.state != eventsPaused || now.Sub(conn.pausedAt) < pausedConnectionTTL {
+func (h *Handler) closeExpiredConnections(now time.Time) {
+	for _, entry := range h.expiries.popExpired(now) {
+		// the connection might have been resumed or closed in the meantime
+		if !entry.conn.closeIfPausedSince(entry.pausedAt) {
 			continue
 		}
 
-		if err := h.closeConnectionLocked(clientID); err != nil {
-			log.Printf("error closing connection %s: %s", clientID, err)
-		}
+		h.connections.remove(entry.conn)
+		atomic.AddUint64(&h.expiredConnections, 1)
+		h.logger.Debug("closed expired connection", "client_id", entry.conn.clientID)
 	}
 }
+
+// remoteIP returns the IP address of the client that sent r. Proxy headers
+// are not trusted.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
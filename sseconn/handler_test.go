@@ -9,17 +9,22 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func init() {
-	// else tests take forever
-	keepAliveInterval = 200 * time.Millisecond
+func testOptions() Options {
+	return Options{
+		// else tests take forever
+		KeepAliveInterval: 200 * time.Millisecond,
+	}
 }
 
-func makeClientID(t *testing.T) ClientID {
+func makeClientID(t testing.TB) ClientID {
 	clientID, err := NewClientID()
 	if err != nil {
 		t.Fatalf("error generating second client ID: %s", err)
@@ -28,17 +33,18 @@ func makeClientID(t *testing.T) ClientID {
 	return clientID
 }
 
-func makeClientSecret(t *testing.T) ClientSecret {
-	clientSecret, err := ClientSecretFromString("R0sxpQUrf7Yc2_uqbQi6E_YJUXUbKqXM-v7dm_m9qe-LuEAtR-ST9IUvwn31_dgSFMeJf51XVhZA-1XhytCnjg==")
+// makeCredentials returns credentials issued by h.
+func makeCredentials(t *testing.T, h *Handler) (ClientID, ClientSecret) {
+	clientID, clientSecret, err := h.newCredentials(time.Now())
 	if err != nil {
-		t.Fatalf("error parsing client secret: %s", err)
+		t.Fatalf("error issuing credentials: %s", err)
 	}
 
-	return clientSecret
+	return clientID, clientSecret
 }
 
 func TestSendOnUnknownClient(t *testing.T) {
-	handler := NewHandler("api")
+	handler := NewHandler("api", testOptions())
 	defer handler.Close()
 
 	if err := handler.Send(makeClientID(t), "client does not exist", 33); !errors.Is(err, errUnknownClient) {
@@ -47,7 +53,7 @@ func TestSendOnUnknownClient(t *testing.T) {
 }
 
 func TestListenOnUnknownClient(t *testing.T) {
-	handler := NewHandler("api")
+	handler := NewHandler("api", testOptions())
 	defer handler.Close()
 
 	if _, err := handler.Listen(makeClientID(t)); !errors.Is(err, errUnknownClient) {
@@ -56,18 +62,14 @@ func TestListenOnUnknownClient(t *testing.T) {
 }
 
 func TestInvalidCommands(t *testing.T) {
-	handler := NewHandler("api")
+	handler := NewHandler("api", testOptions())
 	server := httptest.NewServer(handler)
 	defer server.Close()
 	defer handler.Close()
 
 	baseURL := server.URL + "/api/"
 
-	clientID := makeClientID(t)
-	clientSecret, err := ClientSecretFromString("R0sxpQUrf7Yc2_uqbQi6E_YJUXUbKqXM-v7dm_m9qe-LuEAtR-ST9IUvwn31_dgSFMeJf51XVhZA-1XhytCnjg")
-	if err != nil {
-		t.Fatalf("error parsing client secret: %s", err)
-	}
+	clientID, clientSecret := makeCredentials(t, handler)
 
 	type testCommand struct {
 		Name     interface{} `json:"name"`
@@ -164,9 +166,9 @@ func TestInvalidCommands(t *testing.T) {
 	}
 
 	t.Run("invalid client secret", func(t *testing.T) {
-		clientID := makeClientID(t)
+		clientID, clientSecret := makeCredentials(t, handler)
 		zeroClientSecret := ClientSecret{}.String()
-		sendCommand(t, makeCommand(t, func(c *testCommand) { c.Name = "hello"; c.ClientID = clientID }), http.StatusOK)
+		sendCommand(t, makeCommand(t, func(c *testCommand) { c.Name = "hello"; c.ClientID = clientID; c.Secret = clientSecret.String() }), http.StatusOK)
 		sendCommand(t, makeCommand(t, func(c *testCommand) { c.Name = "data"; c.ClientID = clientID; c.Secret = zeroClientSecret }), http.StatusBadRequest)
 	})
 
@@ -175,22 +177,22 @@ func TestInvalidCommands(t *testing.T) {
 	})
 
 	t.Run("unknown client ID in events request", func(t *testing.T) {
-		clientID := makeClientID(t)
-		sendCommand(t, makeCommand(t, func(c *testCommand) { c.Name = "hello"; c.ClientID = clientID }), http.StatusOK)
+		clientID, clientSecret := makeCredentials(t, handler)
+		sendCommand(t, makeCommand(t, func(c *testCommand) { c.Name = "hello"; c.ClientID = clientID; c.Secret = clientSecret.String() }), http.StatusOK)
 		getEvents(t, makeClientID(t).String(), http.StatusBadRequest)
 	})
 }
 
 func TestReconnectEventSource(t *testing.T) {
-	handler := NewHandler("api")
+	handler := NewHandler("api", testOptions())
 	server := httptest.NewServer(handler)
 	defer server.Close()
 	defer handler.Close()
 
 	baseURL := server.URL + "/api/"
-	clientID, clientSecret := makeClientID(t), makeClientSecret(t)
+	clientID, clientSecret := makeCredentials(t, handler)
 
-	_, err := postHello(baseURL, clientID.String(), clientSecret.String())
+	helloRes, err := postHello(baseURL, clientID.String(), clientSecret.String())
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -201,7 +203,7 @@ func TestReconnectEventSource(t *testing.T) {
 			t.Fatalf(err.Error())
 		}
 
-		events, err := getEvents(baseURL, clientID.String())
+		events, err := getEvents(server.URL, helloRes.EventsURL)
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
@@ -218,22 +220,209 @@ func TestReconnectEventSource(t *testing.T) {
 	}
 }
 
+func TestSeveralStreams(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	firstHello, err := postHello(baseURL, clientID.String(), clientSecret.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	firstEvents, err := getEvents(server.URL, firstHello.EventsURL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	defer firstEvents.Close()
+
+	checkConnectionState(t, handler, clientID, eventsOpen)
+	firstReader := bufio.NewReader(firstEvents)
+	expectEvent(t, firstReader, `: Beginning of the event stream`)
+
+	// a second tab sends hello while the first one is connected, the
+	// connection should be kept
+	secondHello, err := postHello(baseURL, clientID.String(), clientSecret.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	secondEvents, err := getEvents(server.URL, secondHello.EventsURL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	secondReader := bufio.NewReader(secondEvents)
+	expectEvent(t, secondReader, `: Beginning of the event stream`)
+
+	if stats := handler.Stats(); stats.Streams != 2 {
+		t.Errorf("expected 2 streams, got %d", stats.Streams)
+	}
+
+	if err := handler.Send(clientID, "event-name", "payload"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expectDataEvent(t, firstReader, `data: {"event":"event-name","payload":"payload"}`)
+	expectDataEvent(t, secondReader, `data: {"event":"event-name","payload":"payload"}`)
+
+	// closing one of the tabs should not pause the connection
+	secondEvents.Close()
+
+	for i := 0; i < 50 && handler.Stats().Streams != 1; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	checkConnectionState(t, handler, clientID, eventsOpen)
+
+	if err := handler.Send(clientID, "event-name", "other-payload"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expectDataEvent(t, firstReader, `data: {"event":"event-name","payload":"other-payload"}`)
+
+	// closing the last one should
+	firstEvents.Close()
+	checkConnectionState(t, handler, clientID, eventsPaused)
+}
+
+func TestStreamBufferOverflow(t *testing.T) {
+	receive := func(stream chan interface{}) []interface{} {
+		var events []interface{}
+
+		for len(stream) > 0 {
+			events = append(events, <-stream)
+		}
+
+		return events
+	}
+
+	t.Run("the backlog does not fit in the new stream", func(t *testing.T) {
+		c := newClientConn(makeClientID(t), ClientSecret{}, nil, 0, 4)
+		for i := 0; i < 4; i++ {
+			c.send(i)
+		}
+
+		stream, dropped, err := c.addStream(2)
+		if err != nil {
+			t.Fatalf("error opening stream: %s", err)
+		}
+
+		if dropped != 2 {
+			t.Errorf("expected 2 dropped events, got %d", dropped)
+		}
+
+		if events := fmt.Sprint(receive(stream)); events != "[0 1]" {
+			t.Errorf("expected the oldest events in the stream, got %s", events)
+		}
+	})
+
+	t.Run("the stream does not fit in the backlog", func(t *testing.T) {
+		c := newClientConn(makeClientID(t), ClientSecret{}, nil, 0, 1)
+
+		stream, _, err := c.addStream(3)
+		if err != nil {
+			t.Fatalf("error opening stream: %s", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			c.send(i)
+		}
+
+		paused, dropped := c.removeStream(stream, time.Now())
+		if !paused || dropped != 2 {
+			t.Errorf("expected the connection to be paused with 2 dropped events, got %v and %d", paused, dropped)
+		}
+
+		if events := fmt.Sprint(receive(c.backlog)); events != "[0]" {
+			t.Errorf("expected the oldest event in the backlog, got %s", events)
+		}
+	})
+}
+
+func TestExpiredConnections(t *testing.T) {
+	options := testOptions()
+	options.PausedConnectionTTL = time.Minute
+	options.JanitorInterval = time.Hour // expired connections are closed below
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+
+	var resumedEvents io.ReadCloser
+
+	// pause the connection of a client, optionally resuming it afterwards
+	pausedClient := func(resume bool) ClientID {
+		clientID, clientSecret := makeCredentials(t, handler)
+
+		helloRes, err := postHello(baseURL, clientID.String(), clientSecret.String())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		events, err := getEvents(server.URL, helloRes.EventsURL)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		checkConnectionState(t, handler, clientID, eventsOpen)
+		events.Close()
+		checkConnectionState(t, handler, clientID, eventsPaused)
+
+		if resume {
+			if resumedEvents, err = getEvents(server.URL, helloRes.EventsURL); err != nil {
+				t.Fatalf(err.Error())
+			}
+
+			checkConnectionState(t, handler, clientID, eventsOpen)
+		}
+
+		return clientID
+	}
+
+	expired := pausedClient(false)
+	resumed := pausedClient(true)
+	defer resumedEvents.Close()
+
+	handler.closeExpiredConnections(time.Now())
+
+	if handler.connections.get(expired) == nil {
+		t.Errorf("connection expired too early")
+	}
+
+	handler.closeExpiredConnections(time.Now().Add(options.PausedConnectionTTL))
+
+	if err := handler.Send(expired, "event-name", nil); !errors.Is(err, errUnknownClient) {
+		t.Errorf("expected error %v for an expired connection, got %v", errUnknownClient, err)
+	}
+
+	checkConnectionState(t, handler, resumed, eventsOpen)
+
+	if stats := handler.Stats(); stats.ExpiredConnections != 1 {
+		t.Errorf("expected 1 expired connection, got %d", stats.ExpiredConnections)
+	}
+}
+
 func checkConnectionState(t *testing.T, h *Handler, clientID ClientID, expectedState clientConnState) {
 	t.Helper()
 
 	var state clientConnState
 
 	for i := 0; i < 50; i++ {
-		h.lock.RLock()
-		conn, ok := h.connections[clientID]
-		h.lock.RUnlock()
-
-		if !ok {
+		conn := h.connections.get(clientID)
+		if conn == nil {
 			t.Errorf("connection does not exist: %s", clientID)
 			return
 		}
 
-		state = conn.state
+		state, _ = conn.status()
 
 		if expectedState == state {
 			return
@@ -245,15 +434,53 @@ func checkConnectionState(t *testing.T, h *Handler, clientID ClientID, expectedS
 	t.Errorf("unexpected connection state: expected %d, got %d", expectedState, state)
 }
 
+func TestListenConnections(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	incomingConnections := handler.ListenConnections()
+	baseURL := server.URL + "/api/"
+
+	// the listener is busy while the clients connect
+	var clientIDs []ClientID
+
+	for i := 0; i < 3; i++ {
+		clientID, clientSecret := makeCredentials(t, handler)
+		if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		clientIDs = append(clientIDs, clientID)
+	}
+
+	for _, expected := range clientIDs {
+		select {
+		case clientID := <-incomingConnections:
+			if clientID != expected {
+				t.Errorf("expected connection %s, got %s", expected, clientID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for connection %s", expected)
+		}
+	}
+
+	handler.Close()
+
+	if _, ok := <-incomingConnections; ok {
+		t.Errorf("expected the channel to be closed with the handler")
+	}
+}
+
 func TestHelloKeepaliveGoodbye(t *testing.T) {
-	handler := NewHandler("api")
+	handler := NewHandler("api", testOptions())
 	server := httptest.NewServer(handler)
 	defer server.Close()
 	defer handler.Close()
 
 	incomingConnections := handler.ListenConnections()
 	baseURL := server.URL + "/api/"
-	clientID, clientSecret := makeClientID(t), makeClientSecret(t)
+	clientID, clientSecret := makeCredentials(t, handler)
 
 	go func(t *testing.T) {
 		select {
@@ -272,13 +499,13 @@ func TestHelloKeepaliveGoodbye(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 
-	expectedEventsURL := "/api/events/" + clientID.String()
-	if helloRes.EventsURL != expectedEventsURL {
-		t.Fatalf("unexpected events URL, expected %q, got %q", expectedEventsURL, helloRes.EventsURL)
+	expectedEventsURLPrefix := "/api/events/" + clientID.String() + "?token="
+	if !strings.HasPrefix(helloRes.EventsURL, expectedEventsURLPrefix) {
+		t.Fatalf("unexpected events URL, expected %q..., got %q", expectedEventsURLPrefix, helloRes.EventsURL)
 	}
 
 	// 2. Open events channel
-	events, err := getEvents(baseURL, clientID.String())
+	events, err := getEvents(server.URL, helloRes.EventsURL)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -296,6 +523,12 @@ func TestHelloKeepaliveGoodbye(t *testing.T) {
 
 	expectEvent(t, eventReader, `data: {"event":"test","payload":{"Test":42}}`)
 
+	if err := handler.SendVersioned(clientID, "test", testEventPayload, EventVersion{Version: 2, Previous: 1}); err != nil {
+		t.Fatalf("error sending event: %s", err)
+	}
+
+	expectEvent(t, eventReader, `data: {"event":"test","payload":{"Test":42},"version":2,"previousVersion":1}`)
+
 	// 3. Receive message
 	resultChan := make(chan interface{}, 1)
 	go func() {
@@ -329,8 +562,20 @@ func TestHelloKeepaliveGoodbye(t *testing.T) {
 }
 
 func postHello(baseURL, clientID, clientSecret string) (helloResult, error) {
-	helloCommand := fmt.Sprintf(`{"name": "hello", "clientID":"%s", "secret":"%s"}`, clientID, clientSecret)
-	res, err := http.Post(baseURL+"command", jsonContentType, strings.NewReader(helloCommand))
+	return postVersionedHello(baseURL, clientID, clientSecret, 0)
+}
+
+func postVersionedHello(baseURL, clientID, clientSecret string, protocolVersion int) (helloResult, error) {
+	return postHelloCommand(baseURL, helloCommand{command: command{Name: helloCommandName, ClientID: clientID, Secret: clientSecret}, ProtocolVersion: protocolVersion})
+}
+
+func postHelloCommand(baseURL string, cmd helloCommand) (helloResult, error) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return helloResult{}, fmt.Errorf("error encoding hello command: %w", err)
+	}
+
+	res, err := http.Post(baseURL+"command", jsonContentType, bytes.NewReader(body))
 	if err != nil {
 		return helloResult{}, fmt.Errorf("POST hello returned an error: %w", err)
 	}
@@ -353,8 +598,8 @@ func postHello(baseURL, clientID, clientSecret string) (helloResult, error) {
 	return helloRes, nil
 }
 
-func getEvents(baseURL, clientID string) (io.ReadCloser, error) {
-	res, err := http.Get(baseURL + "events/" + clientID)
+func getEvents(serverURL, eventsURL string) (io.ReadCloser, error) {
+	res, err := http.Get(serverURL + eventsURL)
 	if err != nil {
 		return nil, fmt.Errorf("GET events returned an error: %w", err)
 	}
@@ -394,118 +639,714 @@ func expectEvent(t *testing.T, r *bufio.Reader, expected string) {
 	}
 }
 
+// expectDataEvent is like expectEvent, but skips keep-alive events.
+func expectDataEvent(t *testing.T, r *bufio.Reader, expected string) {
+	t.Helper()
+
+	ev := receiveEvent(t, r)
+	for ev == "data: {\"event\":\"keep-alive\"}\n" {
+		ev = receiveEvent(t, r)
+	}
+
+	if expectedEvent := expected + "\n"; ev != expectedEvent {
+		t.Errorf("expected %q, got %q", expectedEvent, ev)
+	}
+}
+
 func postData(baseURL, clientID, clientSecret string, data interface{}) error {
+	res, err := postDataCommand(baseURL, clientID, clientSecret, data)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code, expected 200, got %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func postDataCommand(baseURL, clientID, clientSecret string, data interface{}) (*http.Response, error) {
+	return postKeyedDataCommand(baseURL, clientID, clientSecret, "", data)
+}
+
+func postKeyedDataCommand(baseURL, clientID, clientSecret, key string, data interface{}) (*http.Response, error) {
 	type clientDataCommand struct {
 		Name     string      `json:"name"`
 		ClientID string      `json:"clientId"`
 		Secret   string      `json:"secret"`
+		Key      string      `json:"key,omitempty"`
 		Payload  interface{} `json:"payload"`
 	}
 
 	var body bytes.Buffer
-	cmd := clientDataCommand{Name: dataCommandName, ClientID: clientID, Secret: clientSecret, Payload: data}
+	cmd := clientDataCommand{Name: dataCommandName, ClientID: clientID, Secret: clientSecret, Key: key, Payload: data}
 	if err := json.NewEncoder(&body).Encode(cmd); err != nil {
-		return fmt.Errorf("error encoding data command: %w", err)
+		return nil, fmt.Errorf("error encoding data command: %w", err)
 	}
 
 	res, err := http.Post(baseURL+"command", jsonContentType, bytes.NewReader(body.Bytes()))
 	if err != nil {
-		return fmt.Errorf("POST hello returned an error: %w", err)
+		return nil, fmt.Errorf("POST data returned an error: %w", err)
+	}
+
+	return res, nil
+}
+
+func postBatch(baseURL, clientID, clientSecret string, entries []batchEntry) (batchResult, error) {
+	var result batchResult
+
+	cmd := batchCommand{command: command{Name: batchCommandName, ClientID: clientID, Secret: clientSecret}, Commands: entries}
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return result, fmt.Errorf("error encoding batch command: %w", err)
+	}
+
+	res, err := http.Post(baseURL+"command", jsonContentType, bytes.NewReader(body))
+	if err != nil {
+		return result, fmt.Errorf("POST batch returned an error: %w", err)
 	}
 
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code, expected 200, got %d", res.StatusCode)
+		return result, fmt.Errorf("unexpected status code, expected 200, got %d", res.StatusCode)
 	}
 
-	return nil
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("error decoding batch result: %w", err)
+	}
+
+	return result, nil
 }
 
-func TestClientID(t *testing.T) {
-	validClientID := ClientID{0x26, 0xf1, 0xe1, 0x49, 0x53, 0x52, 0xe5, 0xc9, 0x63, 0x16, 0xeb, 0x6d, 0xa7, 0xcf, 0xa0, 0xdc}
-	validClientIDString := "JvHhSVNS5cljFuttp8-g3A"
-	for _, tc := range []struct {
-		Name     string
-		Input    string
-		Expected ClientID
-	}{
-		{
-			Name:  "Invalid base64",
-			Input: "this is not really base64",
-		},
-		{
-			Name:  "Invalid length",
-			Input: "UYm22c4yMsUJug",
-		},
-		{
-			Name:     "Valid ID",
-			Input:    validClientIDString,
-			Expected: validClientID,
-		},
-	} {
-		t.Run(tc.Name, func(t *testing.T) {
-			res, err := ClientIDFromString(tc.Input)
-			if tc.Expected.IsZero() {
-				if err == nil {
-					t.Errorf("expected error")
-				}
-			} else {
-				if res != tc.Expected {
-					t.Errorf("expected %q, got %q", tc.Expected, res)
-				}
-			}
-		})
+func TestCommandQueue(t *testing.T) {
+	options := testOptions()
+	options.CommandQueueSize = 2
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+		t.Fatalf(err.Error())
 	}
 
-	t.Run("NewClientID", func(t *testing.T) {
-		res, err := NewClientID()
+	// nothing listens on the connection yet, the command would be lost
+	res, err := postDataCommand(baseURL, clientID.String(), clientSecret.String(), 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d without listener, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+
+	listener, err := handler.Listen(clientID)
+	if err != nil {
+		t.Fatalf("error listening on connection: %s", err)
+	}
+
+	sendData := func(i int) (int, dataResult) {
+		t.Helper()
+
+		res, err := postDataCommand(baseURL, clientID.String(), clientSecret.String(), i)
 		if err != nil {
-			t.Errorf("NewClientID returned an error: %s", err)
-		} else if res.IsZero() {
-			t.Errorf("NewClientID returned a zero ID")
+			t.Fatalf(err.Error())
 		}
-	})
 
-	t.Run("Marshal to string", func(t *testing.T) {
-		if res := validClientID.String(); res != validClientIDString {
-			t.Errorf("expected %q, got %q", validClientIDString, res)
-		}
-	})
+		defer res.Body.Close()
 
-	t.Run("Marshal to JSON", func(t *testing.T) {
-		expected := `"` + validClientIDString + `"`
-		res, err := json.Marshal(validClientID)
-		if err != nil {
-			t.Fatalf("failed to marshal to JSON: %s", err)
+		var result dataResult
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+				t.Fatalf("error decoding data result: %s", err)
+			}
 		}
 
-		if string(res) != expected {
-			t.Errorf("expected %q, got %q", expected, string(res))
+		return res.StatusCode, result
+	}
+
+	for i := 1; i <= 2; i++ {
+		if status, result := sendData(i); status != http.StatusOK || result.Seq != uint64(i) {
+			t.Errorf("expected status %d and seq %d, got %d and %d", http.StatusOK, i, status, result.Seq)
+		}
+	}
+
+	// the listener is not reading, the queue is full
+	res, err = postDataCommand(baseURL, clientID.String(), clientSecret.String(), 3)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+
+	if stats := handler.Stats(); stats.RejectedData != 2 {
+		t.Errorf("expected 2 rejected payloads, got %d", stats.RejectedData)
+	}
+
+	// rejected commands don't use a sequence number, and the accepted ones are
+	// received in order
+	for i := 1; i <= 2; i++ {
+		if payload := string(<-listener); payload != fmt.Sprint(i) {
+			t.Errorf("expected payload %d, got %s", i, payload)
+		}
+	}
+
+	if status, result := sendData(3); status != http.StatusOK || result.Seq != 3 {
+		t.Errorf("expected status %d and seq 3, got %d and %d", http.StatusOK, status, result.Seq)
+	}
+
+	if payload := string(<-listener); payload != "3" {
+		t.Errorf("expected payload 3, got %s", payload)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	options := testOptions()
+	options.MinProtocolVersion = 1
+	options.MaxProtocolVersion = 3
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+
+	t.Run("clients older than the minimum version are rejected", func(t *testing.T) {
+		clientID, clientSecret := makeCredentials(t, handler)
+
+		if _, err := postVersionedHello(baseURL, clientID.String(), clientSecret.String(), 0); err == nil {
+			t.Errorf("expected hello to fail")
+		}
+
+		if _, ok := handler.ProtocolVersion(clientID); ok {
+			t.Errorf("expected no connection")
 		}
 	})
 
-	t.Run("Marshal to text", func(t *testing.T) {
-		res, err := validClientID.MarshalText()
+	for _, tc := range []struct{ client, expected int }{{1, 1}, {2, 2}, {3, 3}, {4, 3}} {
+		t.Run(fmt.Sprintf("client version %d", tc.client), func(t *testing.T) {
+			clientID, clientSecret := makeCredentials(t, handler)
+
+			res, err := postVersionedHello(baseURL, clientID.String(), clientSecret.String(), tc.client)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+
+			if res.ProtocolVersion != tc.expected {
+				t.Errorf("expected protocol version %d, got %d", tc.expected, res.ProtocolVersion)
+			}
+
+			if version, ok := handler.ProtocolVersion(clientID); !ok || version != tc.expected {
+				t.Errorf("expected connection protocol version %d, got %d (%v)", tc.expected, version, ok)
+			}
+		})
+	}
+
+	t.Run("tabs sharing a connection share its version", func(t *testing.T) {
+		clientID, clientSecret := makeCredentials(t, handler)
+
+		res, err := postVersionedHello(baseURL, clientID.String(), clientSecret.String(), 2)
 		if err != nil {
-			t.Fatalf("failed to marshal to JSON: %s", err)
+			t.Fatalf(err.Error())
 		}
 
-		if string(res) != validClientIDString {
-			t.Errorf("expected %q, got %q", validClientIDString, string(res))
+		events, err := getEvents(server.URL, res.EventsURL)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		defer events.Close()
+
+		expectEvent(t, bufio.NewReader(events), `: Beginning of the event stream`)
+
+		res, err = postVersionedHello(baseURL, clientID.String(), clientSecret.String(), 3)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if res.ProtocolVersion != 2 {
+			t.Errorf("expected protocol version 2, got %d", res.ProtocolVersion)
+		}
+
+		// an older cached client cannot share the connection
+		if _, err = postVersionedHello(baseURL, clientID.String(), clientSecret.String(), 1); err == nil || !strings.Contains(err.Error(), "409") {
+			t.Errorf("expected hello to fail with status 409, got %v", err)
+		}
+
+		if version, _ := handler.ProtocolVersion(clientID); version != 2 {
+			t.Errorf("expected connection protocol version 2, got %d", version)
 		}
 	})
 }
 
-func TestClientSecret(t *testing.T) {
-	zeroClientSecret := ClientSecret{}
-	validClientSecret := ClientSecret{0xae, 0x69, 0x29, 0x6c, 0x65, 0x7d, 0x73, 0xa9, 0x8c, 0xa3, 0x55, 0x17, 0x8a, 0x9e, 0xe3, 0x64, 0xb6, 0xb8, 0x84, 0x76, 0x18, 0xe7, 0x22, 0xe3, 0x72, 0x1e, 0x3f, 0x3e, 0xcd, 0xd6, 0x50, 0xf0, 0x0b, 0xef, 0x4d, 0x68, 0xed, 0xe2, 0xa3, 0x7a, 0xdb, 0x51, 0xea, 0x71, 0x3b, 0xfe, 0xa3, 0xcb, 0xcc, 0xd4, 0x9e, 0x98, 0xf3, 0xe7, 0x02, 0x5b, 0x19, 0xb3, 0xf0, 0x2a, 0x43, 0x9c, 0x7c, 0xe0}
-	validClientSecretString := "rmkpbGV9c6mMo1UXip7jZLa4hHYY5yLjch4_Ps3WUPAL701o7eKjettR6nE7_qPLzNSemPPnAlsZs_AqQ5x84A"
+func TestLongPolling(t *testing.T) {
+	options := testOptions()
+	options.PollTimeout = 100 * time.Millisecond
+	options.PausedConnectionTTL = time.Minute
+	options.JanitorInterval = time.Hour // expired connections are closed below
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	helloRes, err := postHelloCommand(baseURL, helloCommand{
+		command:   command{Name: helloCommandName, ClientID: clientID.String(), Secret: clientSecret.String()},
+		Transport: pollTransport,
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if helloRes.Transport != pollTransport || !strings.HasPrefix(helloRes.EventsURL, "/api/poll/") {
+		t.Fatalf("expected a poll URL, got %+v", helloRes)
+	}
+
+	pollURL := helloRes.EventsURL
+
+	poll := func() []string {
+		t.Helper()
+
+		res, err := http.Get(server.URL + pollURL)
+		if err != nil {
+			t.Fatalf("GET poll returned an error: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code, expected 200, got %d", res.StatusCode)
+		}
+
+		var result struct {
+			Events  []json.RawMessage `json:"events"`
+			NextURL string            `json:"nextUrl"`
+		}
+
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatalf("error decoding poll result: %s", err)
+		}
+
+		pollURL = result.NextURL
+
+		events := []string{}
+		for _, ev := range result.Events {
+			events = append(events, string(ev))
+		}
+
+		return events
+	}
+
+	checkPoll := func(expected ...string) {
+		t.Helper()
+
+		if events := poll(); fmt.Sprint(events) != fmt.Sprint(expected) {
+			t.Errorf("expected events %v, got %v", expected, events)
+		}
+	}
+
+	t.Run("events sent before the first poll are kept", func(t *testing.T) {
+		handler.Send(clientID, "first", nil)
+		handler.Send(clientID, "second", nil)
+
+		checkPoll(`{"event":"first"}`, `{"event":"second"}`)
+		checkConnectionState(t, handler, clientID, eventsPaused)
+	})
+
+	t.Run("polls return empty once they time out", func(t *testing.T) {
+		checkPoll()
+	})
+
+	t.Run("polls return as soon as an event is sent", func(t *testing.T) {
+		go func() {
+			for {
+				if state, _ := handler.connections.get(clientID).status(); state == eventsOpen {
+					break
+				}
+
+				time.Sleep(time.Millisecond)
+			}
+
+			handler.Send(clientID, "third", nil)
+		}()
+
+		checkPoll(`{"event":"third"}`)
+	})
+
+	t.Run("connections expire when the client stops polling", func(t *testing.T) {
+		handler.closeExpiredConnections(time.Now().Add(options.PausedConnectionTTL))
+
+		res, err := http.Get(server.URL + pollURL)
+		if err != nil {
+			t.Fatalf("GET poll returned an error: %s", err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, res.StatusCode)
+		}
+	})
+}
+
+func TestIdempotentCommands(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	listener, err := handler.Listen(clientID)
+	if err != nil {
+		t.Fatalf("error listening on connection: %s", err)
+	}
+
+	sendData := func(key string, i int) dataResult {
+		t.Helper()
+
+		res, err := postKeyedDataCommand(baseURL, clientID.String(), clientSecret.String(), key, i)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+
+		var result dataResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatalf("error decoding data result: %s", err)
+		}
+
+		return result
+	}
+
+	if result := sendData("a", 1); result != (dataResult{Seq: 1}) {
+		t.Errorf("expected seq 1, got %+v", result)
+	}
+
+	// a retry whose first attempt reached the server
+	if result := sendData("a", 1); result != (dataResult{Seq: 1, Duplicate: true}) {
+		t.Errorf("expected a duplicate of seq 1, got %+v", result)
+	}
+
+	// commands without a key are never duplicates
+	for i := 2; i <= 3; i++ {
+		if result := sendData("", 2); result != (dataResult{Seq: uint64(i)}) {
+			t.Errorf("expected seq %d, got %+v", i, result)
+		}
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		result, err := postBatch(baseURL, clientID.String(), clientSecret.String(), []batchEntry{
+			{Key: "a", Payload: json.RawMessage("1")},
+			{Key: "b", Payload: json.RawMessage("4")},
+			{Key: "b", Payload: json.RawMessage("4")},
+		})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		expected := []batchEntryResult{
+			{Key: "a", dataResult: dataResult{Seq: 1, Duplicate: true}},
+			{Key: "b", dataResult: dataResult{Seq: 4}},
+			{Key: "b", dataResult: dataResult{Seq: 4, Duplicate: true}},
+		}
+
+		if fmt.Sprint(result.Results) != fmt.Sprint(expected) {
+			t.Errorf("expected results %+v, got %+v", expected, result.Results)
+		}
+	})
+
+	// listeners receive each command once
+	for _, expected := range []string{"1", "2", "2", "4"} {
+		if payload := string(<-listener); payload != expected {
+			t.Errorf("expected payload %s, got %s", expected, payload)
+		}
+	}
+
+	select {
+	case payload := <-listener:
+		t.Errorf("unexpected payload %s", payload)
+	default:
+	}
+
+	if stats := handler.Stats(); stats.DuplicateData != 3 {
+		t.Errorf("expected 3 duplicate payloads, got %d", stats.DuplicateData)
+	}
+
+	t.Run("batch commands need keys", func(t *testing.T) {
+		if _, err := postBatch(baseURL, clientID.String(), clientSecret.String(), []batchEntry{{Payload: json.RawMessage("5")}}); err == nil {
+			t.Errorf("expected an error for a command without key")
+		}
+	})
+
+	t.Run("keys outlive the connection", func(t *testing.T) {
+		previous := handler.connections.get(clientID)
+
+		// a hello while no stream is open replaces the connection, as
+		// after a pause
+		if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if conn := handler.connections.get(clientID); conn == nil || conn == previous {
+			t.Fatalf("expected the connection to be replaced")
+		}
+
+		if _, err := handler.Listen(clientID); err != nil {
+			t.Fatalf("error listening on connection: %s", err)
+		}
+
+		if result := sendData("b", 4); !result.Duplicate {
+			t.Errorf("expected a duplicate on the new connection, got %+v", result)
+		}
+
+		// keys are forgotten once the client stopped using them
+		handler.commandKeys.prune(time.Now().Add(DefaultCommandKeysTTL))
+
+		if result := sendData("b", 4); result.Duplicate {
+			t.Errorf("expected the key to be forgotten, got %+v", result)
+		}
+	})
+}
+
+func TestCommandKeysPrune(t *testing.T) {
+	keys := newCommandKeys(DefaultMaxCommandKeys, time.Minute)
+	clientID := makeClientID(t)
+	now := time.Now()
+
+	// prune runs concurrently with the requests, and forgets the clients
+	// that were just created but not used yet. Their keys must not be lost.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				keys.prune(now.Add(time.Second))
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		var (
+			key    = strconv.Itoa(i)
+			queued uint64
+			wg     sync.WaitGroup
+		)
+
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				keys.queue(clientID, key, now, func() (uint64, error) {
+					return atomic.AddUint64(&queued, 1), nil
+				})
+			}()
+		}
+
+		wg.Wait()
+
+		if queued != 1 {
+			t.Fatalf("expected the command with key %s to be queued once, got %d", key, queued)
+		}
+	}
+}
+
+func TestBatchCommandQueue(t *testing.T) {
+	options := testOptions()
+	options.CommandQueueSize = 2
+	options.MaxCommandKeys = 2
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	listener, err := handler.Listen(clientID)
+	if err != nil {
+		t.Fatalf("error listening on connection: %s", err)
+	}
+
+	entries := []batchEntry{
+		{Key: "a", Payload: json.RawMessage("1")},
+		{Key: "b", Payload: json.RawMessage("2")},
+		{Key: "c", Payload: json.RawMessage("3")},
+	}
+
+	result, err := postBatch(baseURL, clientID.String(), clientSecret.String(), entries)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the queue only has room for two commands
+	expected := []batchEntryResult{
+		{Key: "a", dataResult: dataResult{Seq: 1}},
+		{Key: "b", dataResult: dataResult{Seq: 2}},
+		{Key: "c", Error: errCommandQueueFull.Error()},
+	}
+
+	if fmt.Sprint(result.Results) != fmt.Sprint(expected) {
+		t.Errorf("expected results %+v, got %+v", expected, result.Results)
+	}
+
+	<-listener
+	<-listener
+
+	// replaying the whole batch only queues the rejected command
+	result, err = postBatch(baseURL, clientID.String(), clientSecret.String(), entries)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected = []batchEntryResult{
+		{Key: "a", dataResult: dataResult{Seq: 1, Duplicate: true}},
+		{Key: "b", dataResult: dataResult{Seq: 2, Duplicate: true}},
+		{Key: "c", dataResult: dataResult{Seq: 3}},
+	}
 
+	if fmt.Sprint(result.Results) != fmt.Sprint(expected) {
+		t.Errorf("expected results %+v, got %+v", expected, result.Results)
+	}
+
+	if payload := string(<-listener); payload != "3" {
+		t.Errorf("expected payload 3, got %s", payload)
+	}
+
+	// only the last MaxCommandKeys keys are remembered
+	result, err = postBatch(baseURL, clientID.String(), clientSecret.String(), entries[:1])
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if expected := (batchEntryResult{Key: "a", dataResult: dataResult{Seq: 4}}); result.Results[0] != expected {
+		t.Errorf("expected result %+v, got %+v", expected, result.Results[0])
+	}
+}
+
+func TestClientID(t *testing.T) {
+	validClientID := ClientID{0x26, 0xf1, 0xe1, 0x49, 0x53, 0x52, 0xe5, 0xc9, 0x63, 0x16, 0xeb, 0x6d, 0xa7, 0xcf, 0xa0, 0xdc}
+	validClientIDString := "JvHhSVNS5cljFuttp8-g3A"
 	for _, tc := range []struct {
 		Name     string
 		Input    string
-		Expected ClientSecret
+		Expected ClientID
+	}{
+		{
+			Name:  "Invalid base64",
+			Input: "this is not really base64",
+		},
+		{
+			Name:  "Invalid length",
+			Input: "UYm22c4yMsUJug",
+		},
+		{
+			Name:     "Valid ID",
+			Input:    validClientIDString,
+			Expected: validClientID,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			res, err := ClientIDFromString(tc.Input)
+			if tc.Expected.IsZero() {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+			} else {
+				if res != tc.Expected {
+					t.Errorf("expected %q, got %q", tc.Expected, res)
+				}
+			}
+		})
+	}
+
+	t.Run("NewClientID", func(t *testing.T) {
+		res, err := NewClientID()
+		if err != nil {
+			t.Errorf("NewClientID returned an error: %s", err)
+		} else if res.IsZero() {
+			t.Errorf("NewClientID returned a zero ID")
+		}
+	})
+
+	t.Run("Marshal to string", func(t *testing.T) {
+		if res := validClientID.String(); res != validClientIDString {
+			t.Errorf("expected %q, got %q", validClientIDString, res)
+		}
+	})
+
+	t.Run("Marshal to JSON", func(t *testing.T) {
+		expected := `"` + validClientIDString + `"`
+		res, err := json.Marshal(validClientID)
+		if err != nil {
+			t.Fatalf("failed to marshal to JSON: %s", err)
+		}
+
+		if string(res) != expected {
+			t.Errorf("expected %q, got %q", expected, string(res))
+		}
+	})
+
+	t.Run("Marshal to text", func(t *testing.T) {
+		res, err := validClientID.MarshalText()
+		if err != nil {
+			t.Fatalf("failed to marshal to JSON: %s", err)
+		}
+
+		if string(res) != validClientIDString {
+			t.Errorf("expected %q, got %q", validClientIDString, string(res))
+		}
+	})
+}
+
+func TestClientSecret(t *testing.T) {
+	zeroClientSecret := ClientSecret{}
+	validClientSecret := ClientSecret{0xae, 0x69, 0x29, 0x6c, 0x65, 0x7d, 0x73, 0xa9, 0x8c, 0xa3, 0x55, 0x17, 0x8a, 0x9e, 0xe3, 0x64, 0xb6, 0xb8, 0x84, 0x76, 0x18, 0xe7, 0x22, 0xe3, 0x72, 0x1e, 0x3f, 0x3e, 0xcd, 0xd6, 0x50, 0xf0, 0x0b, 0xef, 0x4d, 0x68, 0xed, 0xe2, 0xa3, 0x7a, 0xdb, 0x51, 0xea, 0x71, 0x3b, 0xfe, 0xa3, 0xcb, 0xcc, 0xd4, 0x9e, 0x98, 0xf3, 0xe7, 0x02, 0x5b, 0x19, 0xb3, 0xf0, 0x2a, 0x43, 0x9c, 0x7c, 0xe0}
+	validClientSecretString := "rmkpbGV9c6mMo1UXip7jZLa4hHYY5yLjch4_Ps3WUPAL701o7eKjettR6nE7_qPLzNSemPPnAlsZs_AqQ5x84A"
+
+	for _, tc := range []struct {
+		Name     string
+		Input    string
+		Expected ClientSecret
 	}{
 		{
 			Name:  "Invalid base64",
@@ -541,3 +1382,520 @@ func TestClientSecret(t *testing.T) {
 		}
 	})
 }
+
+func TestStats(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	stats := handler.Stats()
+	expectedConnections := map[string]int{"hello-received": 1, "events-open": 0, "events-paused": 0}
+	if fmt.Sprint(stats.ConnectionsByState) != fmt.Sprint(expectedConnections) {
+		t.Errorf("expected connections %v, got %v", expectedConnections, stats.ConnectionsByState)
+	}
+
+	for i := 0; i < cap(handler.connections.get(clientID).backlog)+1; i++ {
+		handler.Send(clientID, "event-name", i)
+	}
+
+	if stats := handler.Stats(); stats.DroppedEvents != 1 {
+		t.Errorf("expected 1 dropped event, got %d", stats.DroppedEvents)
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	options := testOptions()
+	options.MaxCommandSize = 512
+	options.ClientRateLimit = RateLimit{PerSecond: 0.01, Burst: 2}
+	options.IPRateLimit = RateLimit{PerSecond: -1}
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+
+	t.Run("large commands are rejected", func(t *testing.T) {
+		body := `{"name": "hello", "padding": "` + strings.Repeat("x", 1024) + `"}`
+		res, err := http.Post(baseURL+"command", jsonContentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error sending command: %s", err)
+		}
+
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, res.StatusCode)
+		}
+	})
+
+	t.Run("clients sending too many commands are rate limited", func(t *testing.T) {
+		clientID, clientSecret := makeCredentials(t, handler)
+
+		// commands with a forged secret don't use up the rate limit of the
+		// client
+		_, forgedSecret := makeCredentials(t, handler)
+		for i := 0; i < 3; i++ {
+			_, err := postHello(baseURL, clientID.String(), forgedSecret.String())
+			if err == nil || strings.Contains(err.Error(), "got 429") {
+				t.Fatalf("expected the forged command to be rejected, got %v", err)
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+
+		_, err := postHello(baseURL, clientID.String(), clientSecret.String())
+		if err == nil || !strings.Contains(err.Error(), "got 429") {
+			t.Errorf("expected the third command to be rate limited, got %v", err)
+		}
+
+		// other clients are not affected
+		otherClientID, otherClientSecret := makeCredentials(t, handler)
+		if _, err := postHello(baseURL, otherClientID.String(), otherClientSecret.String()); err != nil {
+			t.Errorf(err.Error())
+		}
+	})
+}
+
+func TestCORS(t *testing.T) {
+	options := testOptions()
+	options.AllowedOrigins = []string{"http://allowed.example.com"}
+	handler := NewHandler("api", options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+	helloCommand := fmt.Sprintf(`{"name": "hello", "clientID":"%s", "secret":"%s"}`, clientID, clientSecret)
+
+	sendRequest := func(t *testing.T, method, url, origin, body string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error creating request: %s", err)
+		}
+
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+
+		res.Body.Close()
+
+		return res
+	}
+
+	for _, tc := range []struct {
+		Name        string
+		Method      string
+		Path        string
+		Origin      string
+		Code        int
+		AllowOrigin string
+	}{
+		{"command without origin", "POST", "command", "", http.StatusOK, ""},
+		{"command from same origin", "POST", "command", server.URL, http.StatusOK, ""},
+		{"command from same host with another scheme", "POST", "command", strings.Replace(server.URL, "http://", "https://", 1), http.StatusForbidden, ""},
+		{"command from allowed origin", "POST", "command", "http://allowed.example.com", http.StatusOK, "http://allowed.example.com"},
+		{"command from other origin", "POST", "command", "http://evil.example.com", http.StatusForbidden, ""},
+		{"command preflight from allowed origin", "OPTIONS", "command", "http://allowed.example.com", http.StatusNoContent, "http://allowed.example.com"},
+		{"command preflight from other origin", "OPTIONS", "command", "http://evil.example.com", http.StatusForbidden, ""},
+		{"events preflight from allowed origin", "OPTIONS", "events/" + clientID.String(), "http://allowed.example.com", http.StatusNoContent, "http://allowed.example.com"},
+		{"events from other origin", "GET", "events/" + clientID.String(), "http://evil.example.com", http.StatusForbidden, ""},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			res := sendRequest(t, tc.Method, baseURL+tc.Path, tc.Origin, helloCommand)
+
+			if res.StatusCode != tc.Code {
+				t.Errorf("expected status %d, got %d", tc.Code, res.StatusCode)
+			}
+
+			if allowOrigin := res.Header.Get("Access-Control-Allow-Origin"); allowOrigin != tc.AllowOrigin {
+				t.Errorf("expected Access-Control-Allow-Origin %q, got %q", tc.AllowOrigin, allowOrigin)
+			}
+		})
+	}
+
+	t.Run("scheme forwarded by a trusted proxy", func(t *testing.T) {
+		options := testOptions()
+		options.TrustForwardedProto = true
+		proxied := NewHandler("api", options)
+		defer proxied.Close()
+
+		clientID, clientSecret := makeCredentials(t, proxied)
+		helloCommand := fmt.Sprintf(`{"name": "hello", "clientID":"%s", "secret":"%s"}`, clientID, clientSecret)
+
+		req := httptest.NewRequest("POST", "http://goretro.example.com/api/command", strings.NewReader(helloCommand))
+		req.Header.Set("Origin", "https://goretro.example.com")
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		rec := httptest.NewRecorder()
+		proxied.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+	})
+
+	t.Run("events from allowed origin", func(t *testing.T) {
+		helloRes, err := postHello(baseURL, clientID.String(), clientSecret.String())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		req, err := http.NewRequest("GET", server.URL+helloRes.EventsURL, nil)
+		if err != nil {
+			t.Fatalf("error creating request: %s", err)
+		}
+
+		req.Header.Set("Origin", "http://allowed.example.com")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+
+		if allowOrigin := res.Header.Get("Access-Control-Allow-Origin"); allowOrigin != "http://allowed.example.com" {
+			t.Errorf("unexpected Access-Control-Allow-Origin %q", allowOrigin)
+		}
+	})
+}
+
+func TestEventsToken(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expectStatus := func(t *testing.T, url string, expectedCode int) {
+		t.Helper()
+
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("error sending events request: %s", err)
+		}
+
+		res.Body.Close()
+		if res.StatusCode != expectedCode {
+			t.Errorf("expected status %d, got %d", expectedCode, res.StatusCode)
+		}
+	}
+
+	now := time.Now()
+	eventsURL := baseURL + "events/" + clientID.String()
+
+	t.Run("missing token", func(t *testing.T) {
+		expectStatus(t, eventsURL, http.StatusForbidden)
+	})
+
+	t.Run("token for another secret", func(t *testing.T) {
+		token := handler.newEventsToken(clientID, ClientSecret{}, now)
+		expectStatus(t, eventsURL+"?token="+token, http.StatusForbidden)
+	})
+
+	t.Run("token for another client", func(t *testing.T) {
+		token := handler.newEventsToken(makeClientID(t), clientSecret, now)
+		expectStatus(t, eventsURL+"?token="+token, http.StatusForbidden)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		token := handler.newEventsToken(clientID, clientSecret, now.Add(-2*handler.options.EventsTokenTTL))
+		expectStatus(t, eventsURL+"?token="+token, http.StatusForbidden)
+	})
+
+	t.Run("events-url returns a fresh URL", func(t *testing.T) {
+		cmd := fmt.Sprintf(`{"name": "events-url", "clientId":"%s", "secret":"%s"}`, clientID, clientSecret)
+		res, err := http.Post(baseURL+"command", jsonContentType, strings.NewReader(cmd))
+		if err != nil {
+			t.Fatalf("error sending command: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		var result helloResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatalf("error decoding result: %s", err)
+		}
+
+		events, err := getEvents(server.URL, result.EventsURL)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		events.Close()
+	})
+}
+
+func TestIdentity(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	defer handler.Close()
+
+	// identifies requests from the X-User header, as an authenticating proxy
+	// would.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Header.Get("X-User"); user != "" {
+			r = r.WithContext(ContextWithIdentity(r.Context(), Identity{Subject: user, Name: "Name of " + user}))
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	baseURL := server.URL + "/api/"
+	clientID, clientSecret := makeCredentials(t, handler)
+
+	sendCommand := func(t *testing.T, user, name string) int {
+		t.Helper()
+
+		cmd := fmt.Sprintf(`{"name": "%s", "clientId":"%s", "secret":"%s", "payload": {}}`, name, clientID, clientSecret)
+		req, err := http.NewRequest("POST", baseURL+"command", strings.NewReader(cmd))
+		if err != nil {
+			t.Fatalf("error creating request: %s", err)
+		}
+
+		req.Header.Set("Content-Type", jsonContentType)
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending command: %s", err)
+		}
+
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := sendCommand(t, "alice", helloCommandName); code != http.StatusOK {
+		t.Fatalf("expected status 200 for hello, got %d", code)
+	}
+
+	if _, err := handler.Listen(clientID); err != nil {
+		t.Fatalf("error listening on connection: %s", err)
+	}
+
+	t.Run("the identity is attached to the connection", func(t *testing.T) {
+		identity, ok := handler.Identity(clientID)
+		if !ok {
+			t.Fatalf("no identity attached to the connection")
+		}
+
+		if identity.Subject != "alice" || identity.Name != "Name of alice" {
+			t.Errorf("unexpected identity %+v", identity)
+		}
+	})
+
+	for _, tc := range []struct {
+		name         string
+		user         string
+		expectedCode int
+	}{
+		{"same user", "alice", http.StatusOK},
+		{"other user", "bob", http.StatusForbidden},
+		{"anonymous", "", http.StatusForbidden},
+	} {
+		t.Run("data command from "+tc.name, func(t *testing.T) {
+			if code := sendCommand(t, tc.user, dataCommandName); code != tc.expectedCode {
+				t.Errorf("expected status %d, got %d", tc.expectedCode, code)
+			}
+		})
+	}
+
+	t.Run("another user cannot take over the connection", func(t *testing.T) {
+		if code := sendCommand(t, "bob", helloCommandName); code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", code)
+		}
+	})
+
+	t.Run("anonymous connections have no identity", func(t *testing.T) {
+		anonymousID, anonymousSecret := makeCredentials(t, handler)
+		if _, err := postHello(baseURL, anonymousID.String(), anonymousSecret.String()); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if _, ok := handler.Identity(anonymousID); ok {
+			t.Errorf("unexpected identity for an anonymous connection")
+		}
+	})
+}
+
+func TestCredentials(t *testing.T) {
+	handler := NewHandler("api", testOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Close()
+
+	baseURL := server.URL + "/api/"
+
+	t.Run("the credentials endpoint issues working credentials", func(t *testing.T) {
+		res, err := http.Post(baseURL+"credentials", jsonContentType, nil)
+		if err != nil {
+			t.Fatalf("error requesting credentials: %s", err)
+		}
+
+		defer res.Body.Close()
+
+		var credentials credentialsResult
+		if err := json.NewDecoder(res.Body).Decode(&credentials); err != nil {
+			t.Fatalf("error decoding credentials: %s", err)
+		}
+
+		if _, err := postHello(baseURL, credentials.ClientID, credentials.Secret); err != nil {
+			t.Errorf(err.Error())
+		}
+	})
+
+	t.Run("client chosen credentials are rejected", func(t *testing.T) {
+		if _, err := postHello(baseURL, makeClientID(t).String(), ClientSecret{}.String()); err == nil {
+			t.Errorf("expected hello to fail")
+		}
+	})
+
+	t.Run("credentials of another client are rejected", func(t *testing.T) {
+		_, clientSecret := makeCredentials(t, handler)
+		if _, err := postHello(baseURL, makeClientID(t).String(), clientSecret.String()); err == nil {
+			t.Errorf("expected hello to fail")
+		}
+	})
+
+	t.Run("expired credentials are rejected", func(t *testing.T) {
+		clientID, clientSecret, err := handler.newCredentials(time.Now().Add(-2 * handler.options.CredentialsTTL))
+		if err != nil {
+			t.Fatalf("error issuing credentials: %s", err)
+		}
+
+		if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err == nil {
+			t.Errorf("expected hello to fail")
+		}
+	})
+
+	t.Run("revoked clients are disconnected", func(t *testing.T) {
+		clientID, clientSecret := makeCredentials(t, handler)
+		if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if err := handler.RevokeClient(clientID); err != nil {
+			t.Fatalf("error revoking client: %s", err)
+		}
+
+		if err := handler.Send(clientID, "event", nil); !errors.Is(err, errUnknownClient) {
+			t.Errorf("expected the connection to be closed, got %v", err)
+		}
+
+		if _, err := postHello(baseURL, clientID.String(), clientSecret.String()); err == nil {
+			t.Errorf("expected hello to fail")
+		}
+	})
+
+	t.Run("client chosen credentials are accepted in compatibility mode", func(t *testing.T) {
+		options := testOptions()
+		options.ClientChosenCredentials = true
+
+		handler := NewHandler("api", options)
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		defer handler.Close()
+
+		if _, err := postHello(server.URL+"/api/", makeClientID(t).String(), ClientSecret{}.String()); err != nil {
+			t.Errorf(err.Error())
+		}
+	})
+}
+
+func BenchmarkSend(b *testing.B) {
+	for _, clients := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("%d clients", clients), func(b *testing.B) {
+			benchmarkSend(b, clients)
+		})
+	}
+}
+
+// benchmarkSend measures Send fanning events out to many clients from
+// concurrent goroutines, the way rooms do.
+func benchmarkSend(b *testing.B, clientCount int) {
+	handler := NewHandler("api", testOptions())
+	defer handler.Close()
+
+	var (
+		clientIDs = make([]ClientID, clientCount)
+		wg        sync.WaitGroup
+	)
+
+	for i := range clientIDs {
+		clientIDs[i] = makeClientID(b)
+
+		c, err := handler.createConnection(nil, clientIDs[i], ClientSecret{}, 0)
+		if err != nil {
+			b.Fatalf("error creating connection: %s", err)
+		}
+
+		stream, _, err := c.addStream(handler.options.EventBufferSize)
+		if err != nil {
+			b.Fatalf("error opening stream: %s", err)
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range stream {
+			}
+		}()
+	}
+
+	var next uint64
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&next, 1)
+			handler.Send(clientIDs[i%uint64(clientCount)], "event-name", i)
+		}
+	})
+
+	b.StopTimer()
+
+	for _, clientID := range clientIDs {
+		handler.closeConnection(clientID)
+	}
+
+	wg.Wait()
+}
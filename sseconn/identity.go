@@ -0,0 +1,57 @@
+package sseconn
+
+import "context"
+
+// Identity is a user verified by an authentication layer in front of the
+// Handler, for example an authenticating reverse proxy.
+type Identity struct {
+	// Subject uniquely identifies the user for the authentication layer.
+	Subject string `json:"subject"`
+	Name    string `json:"name,omitempty"`
+	Email   string `json:"email,omitempty"`
+}
+
+type identityContextKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying identity. Requests whose
+// context carry an identity attach it to the connection they create, and
+// can then only use connections attached to the same identity.
+func ContextWithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns the identity attached to ctx by
+// ContextWithIdentity, if any.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
+
+// Identity returns the verified identity attached to the connection of
+// clientID, if any.
+func (h *Handler) Identity(clientID ClientID) (Identity, bool) {
+	c := h.connections.get(clientID)
+	if c == nil || c.identity == nil {
+		return Identity{}, false
+	}
+
+	return *c.identity, true
+}
+
+// requestIdentity returns the identity of the request context, or nil for
+// anonymous requests.
+func requestIdentity(ctx context.Context) *Identity {
+	if identity, ok := IdentityFromContext(ctx); ok {
+		return &identity
+	}
+
+	return nil
+}
+
+func sameIdentity(a, b *Identity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Subject == b.Subject
+}
@@ -0,0 +1,187 @@
+package sseconn
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultKeepAliveInterval   = 3 * time.Second
+	DefaultPollTimeout         = 20 * time.Second
+	DefaultPausedConnectionTTL = 30 * time.Second
+	DefaultEventBufferSize     = 128
+	DefaultCommandQueueSize    = 32
+	DefaultMaxCommandKeys      = 1024
+	DefaultCommandKeysTTL      = 24 * time.Hour
+	DefaultJanitorInterval     = 5 * time.Second
+	DefaultMaxCommandSize      = 64 * 1024 // bytes
+	DefaultEventsTokenTTL      = 5 * time.Minute
+	DefaultCredentialsTTL      = 30 * 24 * time.Hour
+)
+
+var (
+	DefaultClientRateLimit = RateLimit{PerSecond: 20, Burst: 40}
+	DefaultIPRateLimit     = RateLimit{PerSecond: 100, Burst: 200}
+)
+
+// Options configures a Handler. Zero values are replaced by their defaults.
+type Options struct {
+	// Logger receives the log messages of the Handler. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+
+	// KeepAliveInterval is the delay between two keep-alive events on an idle
+	// event stream.
+	KeepAliveInterval time.Duration
+
+	// PollTimeout is how long a poll request waits for events before
+	// returning an empty response. It must be shorter than
+	// PausedConnectionTTL, connections being paused between two polls.
+	PollTimeout time.Duration
+
+	// PausedConnectionTTL is how long a paused connection is kept around
+	// waiting for the client to reopen its event stream.
+	PausedConnectionTTL time.Duration
+
+	// EventBufferSize is the number of events that can be queued for a client
+	// before Send starts failing.
+	EventBufferSize int
+
+	// CommandQueueSize is the number of data commands of a client that can be
+	// waiting for its listeners. Further commands are rejected with a 503
+	// status until the listeners catch up.
+	CommandQueueSize int
+
+	// MaxCommandKeys is the number of idempotency keys remembered for each
+	// client. A command replayed with a key that was forgotten since is run
+	// again.
+	MaxCommandKeys int
+
+	// CommandKeysTTL is how long the idempotency keys of a client are
+	// remembered after its last keyed command.
+	CommandKeysTTL time.Duration
+
+	// JanitorInterval is the delay between two checks for expired
+	// connections.
+	JanitorInterval time.Duration
+
+	// MaxCommandSize is the maximum size in bytes of the body of a command
+	// request.
+	MaxCommandSize int64
+
+	// ClientRateLimit limits the number of commands a client can send.
+	// Setting PerSecond to a negative value disables the limit.
+	ClientRateLimit RateLimit
+
+	// IPRateLimit limits the number of commands that can be sent from a given
+	// IP address. Setting PerSecond to a negative value disables the limit.
+	IPRateLimit RateLimit
+
+	// AllowedOrigins lists the origins (for example "http://localhost:3000")
+	// from which cross origin requests are accepted. "*" accepts any origin.
+	// Same origin requests are always accepted.
+	AllowedOrigins []string
+
+	// TrustForwardedProto takes the scheme of requests from their
+	// X-Forwarded-Proto header when checking whether they come from the same
+	// origin, for servers behind a TLS terminating reverse proxy. The proxy
+	// must overwrite that header.
+	TrustForwardedProto bool
+
+	// EventsTokenTTL is how long the events URL returned by the hello command
+	// can be used to open an event stream. Clients can get a fresh URL with
+	// the events-url command.
+	EventsTokenTTL time.Duration
+
+	// CredentialsKey signs the client credentials issued by the credentials
+	// endpoint. All the replicas of a deployment must use the same key.
+	// Defaults to a random key, in which case the credentials become invalid
+	// when the process restarts.
+	CredentialsKey []byte
+
+	// CredentialsTTL is how long issued credentials remain valid.
+	CredentialsTTL time.Duration
+
+	// Revocations keeps track of the clients revoked with RevokeClient.
+	// Defaults to an in-memory store, which is only suitable for a single
+	// replica.
+	Revocations Revocations
+
+	// MinProtocolVersion and MaxProtocolVersion are the oldest and newest
+	// versions of the protocol spoken on top of the connections that the
+	// server supports. The hello command negotiates the newest version
+	// supported by both the client and the server, and rejects clients older
+	// than MinProtocolVersion.
+	MinProtocolVersion int
+	MaxProtocolVersion int
+
+	// ClientChosenCredentials accepts any client ID and secret in commands,
+	// for the clients that generate their own credentials instead of getting
+	// them from the credentials endpoint. Whoever sends hello first with a
+	// given client ID then owns it.
+	ClientChosenCredentials bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	if o.KeepAliveInterval <= 0 {
+		o.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+
+	if o.PollTimeout <= 0 {
+		o.PollTimeout = DefaultPollTimeout
+	}
+
+	if o.PausedConnectionTTL <= 0 {
+		o.PausedConnectionTTL = DefaultPausedConnectionTTL
+	}
+
+	if o.EventBufferSize <= 0 {
+		o.EventBufferSize = DefaultEventBufferSize
+	}
+
+	if o.CommandQueueSize <= 0 {
+		o.CommandQueueSize = DefaultCommandQueueSize
+	}
+
+	if o.MaxCommandKeys <= 0 {
+		o.MaxCommandKeys = DefaultMaxCommandKeys
+	}
+
+	if o.CommandKeysTTL <= 0 {
+		o.CommandKeysTTL = DefaultCommandKeysTTL
+	}
+
+	if o.JanitorInterval <= 0 {
+		o.JanitorInterval = DefaultJanitorInterval
+	}
+
+	if o.MaxCommandSize <= 0 {
+		o.MaxCommandSize = DefaultMaxCommandSize
+	}
+
+	if o.EventsTokenTTL <= 0 {
+		o.EventsTokenTTL = DefaultEventsTokenTTL
+	}
+
+	if o.CredentialsTTL <= 0 {
+		o.CredentialsTTL = DefaultCredentialsTTL
+	}
+
+	if o.Revocations == nil {
+		o.Revocations = newMemoryRevocations()
+	}
+
+	if o.ClientRateLimit == (RateLimit{}) {
+		o.ClientRateLimit = DefaultClientRateLimit
+	}
+
+	if o.IPRateLimit == (RateLimit{}) {
+		o.IPRateLimit = DefaultIPRateLimit
+	}
+
+	return o
+}
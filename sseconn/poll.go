@@ -0,0 +1,83 @@
+package sseconn
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// pollResult is the response to a poll request. NextURL carries a fresh
+// events token, so that polling clients don't have to renew it with the
+// events-url command.
+type pollResult struct {
+	Events  []interface{} `json:"events"`
+	NextURL string        `json:"nextUrl"`
+}
+
+// pollHandlerHTTP serves the long polling transport, for the clients behind
+// proxies that buffer event streams. Each request opens a stream on the
+// connection, waits up to Options.PollTimeout for events and closes the
+// stream again: between two requests the connection is paused, and expires if
+// the client stops polling, like with event streams.
+func (h *Handler) pollHandlerHTTP(w http.ResponseWriter, r *http.Request) {
+	clientID, err := ClientIDFromString(mux.Vars(r)["id"])
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	c, stream, err := h.openStream(requestIdentity(r.Context()), clientID, r.URL.Query().Get("token"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	timer := time.NewTimer(h.options.PollTimeout)
+	defer timer.Stop()
+
+	result := pollResult{Events: []interface{}{}}
+
+	select {
+	case ev, ok := <-stream:
+		if !ok {
+			// the connection has been definitely closed by the Handler
+			h.writeError(w, errUnknownClient)
+			return
+		}
+
+		result.Events = drainEvents(stream, append(result.Events, ev))
+	case <-timer.C:
+	case <-r.Context().Done():
+		// the events still queued are kept for the next request
+		h.closeStream(c, stream)
+		return
+	}
+
+	h.closeStream(c, stream)
+
+	result.NextURL = h.eventsURL(clientID, c.secret, pollTransport)
+
+	w.Header().Add("Cache-Control", "no-cache, no-transform")
+	w.Header().Add("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// drainEvents appends the events queued in stream to events, without
+// waiting for more.
+func drainEvents(stream chan interface{}, events []interface{}) []interface{} {
+	for {
+		select {
+		case ev, ok := <-stream:
+			if !ok {
+				return events
+			}
+
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package sseconn
+
+// negotiateProtocolVersion returns the protocol version to use with a client
+// speaking clientVersion: the newest version both the client and the server
+// support. Clients that predate protocol versions send none, which is version
+// 0.
+func (h *Handler) negotiateProtocolVersion(clientVersion int) (int, error) {
+	if clientVersion < h.options.MinProtocolVersion {
+		return 0, errUnsupportedProtocol
+	}
+
+	if clientVersion > h.options.MaxProtocolVersion {
+		return h.options.MaxProtocolVersion, nil
+	}
+
+	return clientVersion, nil
+}
+
+// ProtocolVersion returns the protocol version negotiated by the hello command
+// of clientID, if it has a connection.
+func (h *Handler) ProtocolVersion(clientID ClientID) (int, bool) {
+	c := h.connections.get(clientID)
+	if c == nil {
+		return 0, false
+	}
+
+	return c.protocolVersion, true
+}
@@ -0,0 +1,86 @@
+package sseconn
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit configures a token bucket: PerSecond tokens are added every
+// second, up to Burst tokens.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.PerSecond > 0 && l.Burst > 0
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+// rateLimiter keeps one token bucket per key (client ID or IP address).
+type rateLimiter struct {
+	limit   RateLimit
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from the bucket of key, and returns false if the bucket
+// was empty.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if !l.limit.enabled() {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), lastFill: now}
+		l.buckets[key] = b
+	}
+
+	l.fill(b, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (l *rateLimiter) fill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.lastFill).Seconds() * l.limit.PerSecond
+	if max := float64(l.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+
+	b.lastFill = now
+}
+
+// prune forgets the buckets that are full, since they behave like new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for key, b := range l.buckets {
+		l.fill(b, now)
+
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sseconn
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// registryShardCount is the number of shards of a registry.
+const registryShardCount = 64
+
+// registry holds the connections of a Handler. Connections are spread over
+// shards that each have their own lock, so that clients don't contend on a
+// single lock. Shard locks only protect the maps, the state of a connection is
+// protected by its own lock.
+type registry struct {
+	shards [registryShardCount]registryShard
+}
+
+type registryShard struct {
+	lock        sync.RWMutex
+	connections map[ClientID]*clientConn
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+
+	for i := range r.shards {
+		r.shards[i].connections = map[ClientID]*clientConn{}
+	}
+
+	return r
+}
+
+func (r *registry) shard(clientID ClientID) *registryShard {
+	// client IDs are random, their first bytes are enough to spread them
+	return &r.shards[binary.LittleEndian.Uint32(clientID[:4])%registryShardCount]
+}
+
+// get returns the connection of clientID, or nil if it has none.
+func (r *registry) get(clientID ClientID) *clientConn {
+	s := r.shard(clientID)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.connections[clientID]
+}
+
+// add registers c, unless its client already has an open connection.
+func (r *registry) add(c *clientConn) bool {
+	s := r.shard(c.clientID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing := s.connections[c.clientID]; existing != nil && !existing.isClosed() {
+		return false
+	}
+
+	s.connections[c.clientID] = c
+
+	return true
+}
+
+// remove unregisters c, if it is still the connection of its client.
+func (r *registry) remove(c *clientConn) {
+	s := r.shard(c.clientID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.connections[c.clientID] == c {
+		delete(s.connections, c.clientID)
+	}
+}
+
+// each calls f for all the connections, one shard at a time.
+func (r *registry) each(f func(c *clientConn)) {
+	for i := range r.shards {
+		s := &r.shards[i]
+
+		s.lock.RLock()
+		conns := make([]*clientConn, 0, len(s.connections))
+		for _, c := range s.connections {
+			conns = append(conns, c)
+		}
+		s.lock.RUnlock()
+
+		for _, c := range conns {
+			f(c)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package sseconn
+
+import (
+	"sync"
+	"time"
+)
+
+// Revocations keeps track of the revoked clients. Replicas sharing the same
+// credentials key must share their Revocations, or the clients revoked by one
+// replica are still accepted by the others.
+type Revocations interface {
+	// Revoke records that clientID is revoked until the given time, after
+	// which its credentials expire anyway.
+	Revoke(clientID ClientID, until time.Time) error
+
+	// Revoked returns whether clientID is currently revoked.
+	Revoked(clientID ClientID) (bool, error)
+}
+
+// memoryRevocations is the default Revocations, only known to the process
+// that recorded them.
+type memoryRevocations struct {
+	lock    sync.Mutex
+	revoked map[ClientID]time.Time // until when
+	now     func() time.Time
+}
+
+func newMemoryRevocations() *memoryRevocations {
+	return &memoryRevocations{revoked: map[ClientID]time.Time{}, now: time.Now}
+}
+
+func (r *memoryRevocations) Revoke(clientID ClientID, until time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// revocations are rare, forgetting the expired ones here is enough to
+	// keep the map small
+	now := r.now()
+	for revokedID, expiresAt := range r.revoked {
+		if now.After(expiresAt) {
+			delete(r.revoked, revokedID)
+		}
+	}
+
+	r.revoked[clientID] = until
+
+	return nil
+}
+
+func (r *memoryRevocations) Revoked(clientID ClientID) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	until, ok := r.revoked[clientID]
+	return ok && !r.now().After(until), nil
+}
@@ -0,0 +1,53 @@
+package sseconn
+
+import "sync/atomic"
+
+// Stats is a point in time snapshot of the Handler's connections and counters.
+type Stats struct {
+	// ConnectionsByState counts the current connections, indexed by state
+	// name ("hello-received", "events-open" or "events-paused").
+	ConnectionsByState map[string]int
+
+	// Streams is the number of open event streams. Clients can have several
+	// of them, for example one per browser tab.
+	Streams int
+
+	// ExpiredConnections is the number of paused connections that were closed
+	// because the client did not come back in time.
+	ExpiredConnections uint64
+
+	// DroppedEvents is the number of events that could not be queued because
+	// the client's event buffer was full.
+	DroppedEvents uint64
+
+	// RejectedData is the number of client data payloads that were rejected
+	// because a listener was lagging behind, or nothing listened on the
+	// connection.
+	RejectedData uint64
+
+	// DuplicateData is the number of client data payloads that were not
+	// queued because a payload with the same idempotency key already was.
+	DuplicateData uint64
+}
+
+func (h *Handler) Stats() Stats {
+	stats := Stats{
+		ConnectionsByState: map[string]int{},
+		ExpiredConnections: atomic.LoadUint64(&h.expiredConnections),
+		DroppedEvents:      atomic.LoadUint64(&h.droppedEvents),
+		RejectedData:       atomic.LoadUint64(&h.rejectedData),
+		DuplicateData:      atomic.LoadUint64(&h.duplicateData),
+	}
+
+	for _, state := range []clientConnState{helloReceived, eventsOpen, eventsPaused} {
+		stats.ConnectionsByState[state.String()] = 0
+	}
+
+	h.connections.each(func(c *clientConn) {
+		state, streams := c.status()
+		stats.ConnectionsByState[state.String()]++
+		stats.Streams += streams
+	})
+
+	return stats
+}
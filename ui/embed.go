@@ -0,0 +1,23 @@
+//go:build embedui
+
+// Package ui gives access to the built UI files when the binary is built with
+// the embedui build tag. Run "yarn build" in this directory first.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:build
+var files embed.FS
+
+// FS returns the built UI files, or nil if they were not embedded.
+func FS() fs.FS {
+	sub, err := fs.Sub(files, "build")
+	if err != nil {
+		panic(err) // cannot happen, "build" is a valid path
+	}
+
+	return sub
+}
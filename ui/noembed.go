@@ -0,0 +1,10 @@
+//go:build !embedui
+
+package ui
+
+import "io/fs"
+
+// FS returns the built UI files, or nil if they were not embedded.
+func FS() fs.FS {
+	return nil
+}
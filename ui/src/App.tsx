@@ -17,6 +17,10 @@ import './App.scss'
 const ERROR_START_FAILED = "Couldn't reach the service."
 const NAME_LS_KEY: string = "nickname"
 const ROOMID_PARAM = "id"
+const TEAMID_PARAM = "team"
+const PREVIOUS_RETROID_PARAM = "previous"
+const CHECKIN_PARAM = "checkin"
+const AGENDA_PARAM = "agenda" // comma separated phase names
 
 const initialState: types.State = {
   lagging: false,
@@ -36,8 +40,8 @@ export default function({connection, api}: Props) {
   const [state, dispatch] = useReducer(Reducer, initialState)
 
   useEffect(() => {
-    configureConnection(connection, dispatch)
-  }, [connection])
+    configureConnection(connection, api, dispatch)
+  }, [connection, api])
 
   // (Re)connect
   useEffect(() => {
@@ -64,7 +68,12 @@ export default function({connection, api}: Props) {
     if (state.roomId) {
       api.joinRoom(state.roomId)
     } else {
-      api.createRoom()
+      api.createRoom(
+        getURLParam(TEAMID_PARAM) || undefined,
+        getURLParam(PREVIOUS_RETROID_PARAM) || undefined,
+        getURLParam(CHECKIN_PARAM) !== null || undefined,
+        getURLParam(AGENDA_PARAM)?.split(",") || undefined,
+      )
     }
   }, [api, state.identified, state.roomId])
 
@@ -74,7 +83,7 @@ export default function({connection, api}: Props) {
       <Header name={state.name}/>
 
       <main className="App__main">
-        { mainComponent(api, connection.clientId, state, dispatch) }
+        { mainComponent(api, state, dispatch) }
       </main>
     </div>
   );
@@ -82,7 +91,7 @@ export default function({connection, api}: Props) {
 
 // Components
 
-function mainComponent(api: API, userId: string, state: types.State, dispatch: Dispatch<types.Action>) {
+function mainComponent(api: API, state: types.State, dispatch: Dispatch<types.Action>) {
   if (state.error) {
     return <AppGlobalMessage title="Error :(">{ state.error }</AppGlobalMessage>
   }
@@ -95,12 +104,22 @@ function mainComponent(api: API, userId: string, state: types.State, dispatch: D
     return <AppGlobalMessage title="Loading..."/>
   }
 
+  // Other participants are only known by their participant ID, never by
+  // their client ID.
+  const userId = state.room.selfId
+
   return <Room
     room={state.room}
     userId={userId}
     link={window.location.toString()}
     onNoteSave={(mood, text, id) => { handleNoteSave(api, userId, state, dispatch, mood, text, id) }}
-    onStateTransition={() => { handleRoomStateIncrement(api, state) }}
+    onNextPhase={() => { api.nextPhase() }}
+    onPreviousPhase={() => { api.previousPhase() }}
+    onActionItemSave={(id, text, done) => { api.saveActionItem(id, text, done) }}
+    onCheckIn={(checkIn) => { api.checkIn(checkIn) }}
+    onCheckInsReveal={() => { api.revealCheckIns() }}
+    onNoteGroup={(note, group) => { api.groupNote(note.authorId, note.id, group) }}
+    onNoteVote={(note, vote) => { api.vote(note.authorId, note.id, vote) }}
     onHasFinishedWriting={(hasFinished) => { handleFinishedWriting(api, hasFinished)} }
     onNameUpdate={(name) => handleNameSet(dispatch, name)}
   />
@@ -121,23 +140,21 @@ function handleNameSet(dispatch: Dispatch<types.Action>, name: string): void {
   dispatch({type: 'name', payload: trimmedName})
 }
 
-function handleRoomStateIncrement(api: API, state: types.State): void {
-  api.setRoomState(state.room!.state + 1)
-}
-
 function handleNoteSave(api: API, userId: string, state: types.State, dispatch: Dispatch<types.Action>, mood: types.Mood, text: string, noteId?: number): void {
   if (noteId !== undefined) {
+    const note = state.room!.notes.find((n) => n.id === noteId && n.authorId === userId)
     dispatch({type: 'noteUpdated', payload: {noteId: noteId, text: text}})
-    api.saveNote(noteId, text, mood)
+    api.saveNote(noteId, note ? note.revision : 0, text, mood)
   } else {
     const note = {
       authorId: userId,
       id: noteId || state.room!.notes.length,
+      revision: 0,
       text: text,
       mood: mood,
     }
     dispatch({type: 'noteCreated', payload: note})
-    api.saveNote(note.id, note.text, note.mood)
+    api.saveNote(note.id, note.revision, note.text, note.mood)
   }
 }
 
@@ -170,17 +187,44 @@ function handleMessage(message: Message, dispatch: Dispatch<types.Action>): void
     case "host-changed":
       dispatch({type: 'hostChange', payload: message.payload})
       break
+    case "note-saved":
+    case "note-conflict":
+      // on conflicts, the note was changed from another tab in the meantime and
+      // the server sends its current version
+      dispatch({type: 'noteSaved', payload: message.payload})
+      break
+    case "action-item-saved":
+      dispatch({type: 'actionItemSaved', payload: message.payload})
+      break
+    case "check-ins-updated":
+      dispatch({type: 'checkInsUpdated', payload: message.payload})
+      break
+    case "vote-saved":
+      dispatch({type: 'voteSaved', payload: message.payload})
+      break
   }
 }
 
-function restructureRoomNotes(notes: {[clientId: string]: types.Note[]}): types.Note[] {
+function restructureRoomNotes(notes: {[participantId: string]: types.Note[]}): types.Note[] {
   return Object.values(notes).flat();
 }
 
 // Misc.
 
-function configureConnection(connection: Connection, dispatch: Dispatch<types.Action>): void {
+function configureConnection(connection: Connection, api: API, dispatch: Dispatch<types.Action>): void {
+  // Version of the room after the last event received. Events carry the
+  // version of the previous event sent to us, if it doesn't match we missed
+  // something and ask for the state of the room again.
+  let roomVersion = 0
+
   connection.onMessage((message) => {
+    if (message.event === 'current-state') {
+      roomVersion = message.payload.version
+    } else if (message.version) {
+      if ((message.previousVersion || 0) !== roomVersion) api.resync()
+      roomVersion = message.version
+    }
+
     handleMessage(message, dispatch)
   });
 
@@ -1,5 +1,5 @@
 import { Connection } from './connection';
-import { Mood, RoomState } from './types';
+import { CheckIn, Mood, RoomState } from './types';
 
 export class API {
   private connection: Connection
@@ -12,25 +12,61 @@ export class API {
     return this.connection.dataCommand({name: 'identify', nickname: nickname})
   }
 
-  async createRoom() {
+  async createRoom(teamId?: string, previousRetroId?: string, checkIn?: boolean, agenda?: string[]) {
      // TODO(abustany): What do we do for the room name?
-    return this.connection.dataCommand({name: 'create-room', roomName: "name"})
+    return this.connection.dataCommand({name: 'create-room', roomName: "name", teamId, previousRetroId, checkIn, agenda})
   }
 
   async joinRoom(roomId: string) {
     return this.connection.dataCommand({name: 'join-room', roomId: roomId})
   }
 
+  async resync() {
+    return this.connection.dataCommand({name: 'resync'})
+  }
+
   async setRoomState(state: RoomState) {
     return this.connection.dataCommand({name: 'set-state', state: state})
   }
 
-  async saveNote(noteId: number, text: string, mood: Mood) {
-    return this.connection.dataCommand({name: 'save-note', noteId, text, mood})
+  async nextPhase() {
+    return this.connection.dataCommand({name: 'next-phase'})
+  }
+
+  async previousPhase() {
+    return this.connection.dataCommand({name: 'previous-phase'})
+  }
+
+  async saveNote(noteId: number, revision: number, text: string, mood: Mood) {
+    return this.connection.dataCommand({name: 'save-note', noteId, revision, text, mood})
   }
 
   async setFinishedWriting(hasFinished: boolean) {
     return this.connection.dataCommand({name: 'set-finished-writing', finished: hasFinished})
   }
 
+  async saveActionItem(actionItemId: number, text: string, done: boolean) {
+    return this.connection.dataCommand({name: 'save-action-item', actionItemId, text, done})
+  }
+
+  async groupNote(authorId: string, noteId: number, group: number) {
+    return this.connection.dataCommand({name: 'group-note', authorId, noteId, group})
+  }
+
+  async vote(authorId: string, noteId: number, vote: boolean) {
+    return this.connection.dataCommand({name: 'vote', authorId, noteId, vote})
+  }
+
+  async closeRoom() {
+    return this.connection.dataCommand({name: 'close-room'})
+  }
+
+  async checkIn(checkIn: CheckIn) {
+    return this.connection.dataCommand({name: 'check-in', ...checkIn})
+  }
+
+  async revealCheckIns() {
+    return this.connection.dataCommand({name: 'reveal-check-ins'})
+  }
+
 }
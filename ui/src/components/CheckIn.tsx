@@ -0,0 +1,54 @@
+import React, { useState } from 'react';
+
+import * as t from '../types'
+
+import './CheckIn.scss'
+
+const scores = [1, 2, 3, 4, 5]
+
+interface Props {
+  results: t.CheckInResults;
+  participantCount: number;
+  participantNames: Map<string, string>;
+  userId: string;
+  isHost: boolean;
+  onCheckIn: (checkIn: t.CheckIn) => void;
+  onReveal: () => void;
+}
+export default function({results, participantCount, participantNames, userId, isHost, onCheckIn, onReveal}: Props) {
+  const [word, setWord] = useState("")
+  const own = results.checkIns[userId]
+
+  const handleWordSubmit = (e: React.FormEvent) => {
+    e.preventDefault()
+    const trimmedWord = word.trim()
+    if (!trimmedWord || /\s/.test(trimmedWord)) return
+    onCheckIn({word: trimmedWord})
+  }
+
+  return <div className="CheckIn">
+    { !results.revealed && <>
+      <div className="CheckIn__scores">
+        { scores.map(score =>
+          <button key={score} className={own?.score === score ? "CheckIn__selected" : ""} onClick={() => onCheckIn({score})}>{ score }</button>
+        ) }
+      </div>
+
+      <form onSubmit={handleWordSubmit}>
+        <input type="text" placeholder="...or one word" value={word} onChange={(e) => setWord(e.target.value)}/>
+      </form>
+
+      <div className="CheckIn__answered">{ results.answered.length } / { participantCount } checked in</div>
+      { isHost && <button onClick={onReveal}>Reveal</button> }
+    </> }
+
+    { results.revealed && <ul className="CheckIn__results">
+      { Object.entries(results.checkIns).map(([participantId, checkIn]) =>
+        <li key={participantId}>
+          { participantNames.get(participantId) }: <strong>{ checkIn.score || checkIn.word }</strong>
+        </li>
+      ) }
+      { results.summary?.averageScore && <li className="CheckIn__average">Average: { results.summary.averageScore.toFixed(1) }</li> }
+    </ul> }
+  </div>
+}
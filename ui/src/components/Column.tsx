@@ -9,18 +9,27 @@ interface Props {
   icon: string;
   notes: types.Note[];
   participants: Map<string, string>;
+  votes: Map<string, number>; // by author ID and note ID
   onNoteSave: (text: string, id?: number) => void;
+  onNoteGroup?: (note: types.Note, group: number) => void; // only while grouping
+  onNoteVote?: (note: types.Note, vote: boolean) => void; // only while voting
   tabIndex: number;
 }
 
-export default function({editable, icon, notes, participants, onNoteSave, tabIndex, ...rest}: Props) {
-  const noteComponents = notes.filter((n) => n.text !== "").map((n) => <Note
+export default function({editable, icon, notes, participants, votes, onNoteSave, onNoteGroup, onNoteVote, tabIndex, ...rest}: Props) {
+  // grouped notes are shown next to each other
+  const sortedNotes = [...notes].sort((a, b) => (a.group || 0) - (b.group || 0))
+
+  const noteComponents = sortedNotes.filter((n) => n.text !== "").map((n) => <Note
     key={n.authorId + n.id}
 
     note={n}
     author={participants.get(n.authorId)}
     editable={editable}
+    votes={votes.get(n.authorId + "/" + n.id) || 0}
     onNoteSave={onNoteSave}
+    onGroup={onNoteGroup && ((group) => onNoteGroup(n, group))}
+    onVote={onNoteVote && ((vote) => onNoteVote(n, vote))}
   />)
 
   if (editable) {
@@ -9,13 +9,16 @@ interface Props {
   author?: string;
   editable: boolean;
   onNoteSave: (text: string, id?: number) => void;
+  votes?: number; // our own vote while voting, the votes of everybody afterwards
+  onGroup?: (group: number) => void;
+  onVote?: (vote: boolean) => void;
   tabIndex?: number
 }
 
 // If `note` is present, behaves as an Note that can be edited or deleted.
 // Otherwise, behaves as a Note creator that gets empty after edition.
 // `note` is not meant to change over the lifetime.
-export default function({note, author, editable, onNoteSave, tabIndex}: Props) {
+export default function({note, author, editable, onNoteSave, votes, onGroup, onVote, tabIndex}: Props) {
   const textareaRef = useRef<HTMLTextAreaElement>(null);
   const [editedText, setEditedText] = useState<string>("")
   const isCreate = !note
@@ -54,10 +57,13 @@ export default function({note, author, editable, onNoteSave, tabIndex}: Props) {
   // Badges
 
   const editBadge = () => <button onClick={handleEdit} className="Note__badge Note__edit" data-test-id="noteeditor-edit">{t.Chars.EDIT}</button>
-  const authorBadge = () => <em className="Note__badge">{ author }</em>
+  const authorBadge = () => <em key="author" className="Note__badge">{ author }</em>
   const saveBadge = () => <button key="save" onClick={handleSave} className="Note__badge" data-test-id="noteeditor-save">{t.Chars.VALIDATE}</button>
   const cancelBadge = () => <button key="cancel" onClick={handleCancelEdition} className="Note__badge" data-test-id="noteeditor-cancel">{t.Chars.CANCEL}</button>
   const deleteBadge = () => <button key="delete" onClick={handleDelete} className="Note__badge" data-test-id="noteeditor-delete">{t.Chars.DELETE}</button>
+  const groupBadge = () => <input key="group" type="number" min="0" value={note?.group || 0} onChange={(e) => onGroup!(parseInt(e.target.value, 10) || 0)} className="Note__badge Note__group" data-test-id="note-group"/>
+  const voteBadge = () => <button key="vote" onClick={() => onVote!(!votes)} className="Note__badge" data-test-id="note-vote">{votes ? t.Chars.VOTED : t.Chars.NOT_VOTED}</button>
+  const votesBadge = () => <em key="votes" className="Note__badge">{votes} {t.Chars.VOTED}</em>
 
   // Logic
 
@@ -65,7 +71,12 @@ export default function({note, author, editable, onNoteSave, tabIndex}: Props) {
 
   const badges = () => {
     if (!editable) {
-      return authorBadge()
+      // reversed because of the float:right.
+      return [
+        onVote ? voteBadge() : (votes ? votesBadge() : null),
+        onGroup ? groupBadge() : null,
+        authorBadge(),
+      ]
     } else {
       if (isCreate) {
         return saveBadge()
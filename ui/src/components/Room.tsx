@@ -2,6 +2,7 @@ import React, { useState } from 'react';
 
 import * as t from '../types';
 
+import CheckIn from './CheckIn'
 import Column from './Column'
 import Participants from './Participants'
 import StatusParticipant from './StatusParticipant'
@@ -21,30 +22,62 @@ interface Props {
   userId: string;
   link: string;
   onNoteSave: (mood: t.Mood, text: string, id?: number) => void;
-  onStateTransition: () => void;
+  onNextPhase: () => void;
+  onPreviousPhase: () => void;
+  onActionItemSave: (id: number, text: string, done: boolean) => void;
+  onCheckIn: (checkIn: t.CheckIn) => void;
+  onCheckInsReveal: () => void;
+  onNoteGroup: (note: t.Note, group: number) => void;
+  onNoteVote: (note: t.Note, vote: boolean) => void;
   onHasFinishedWriting: (hasFinished: boolean) => void;
   onNameUpdate: (name: string) => void;
 }
 
-export default function({room, userId, link, onNoteSave, onStateTransition, onHasFinishedWriting, onNameUpdate}: Props) {
+export default function({room, userId, link, onNoteSave, onNextPhase, onPreviousPhase, onActionItemSave, onCheckIn, onCheckInsReveal, onNoteGroup, onNoteVote, onHasFinishedWriting, onNameUpdate}: Props) {
   // Refactor nameById and participantById into a same ExtendedParticipant.
   const [hasFinished, setHasFinished] = useState(false)
 
   const nameById = idToName(room.participants)
-  const participantById = new Map(room.participants.map(p => [p.clientId, p]))
+  const participantById = new Map(room.participants.map(p => [p.participantId, p]))
 
   const notesByMood = moodToNotes(room.notes)
+  const votesByNote = new Map((room.votes || []).map(v => [v.authorId + "/" + v.noteId, v.count]))
   const isHost = userId === room.hostId
   const isWaiting = room.state === t.RoomState.WAITING_FOR_PARTICIPANTS
   const isRunning = room.state === t.RoomState.RUNNING
-  const isReviewing = room.state === t.RoomState.REVIEWING
+  const isReviewing = room.state === t.RoomState.REVIEWING || room.state === t.RoomState.CLOSING
+  const isReviewingActionItems = room.state === t.RoomState.REVIEWING_ACTION_ITEMS
+  const isCheckingIn = room.state === t.RoomState.CHECKING_IN
+  const isGrouping = room.state === t.RoomState.GROUPING
+  const isVoting = room.state === t.RoomState.VOTING
   const handleHasFinishedWriting = (hasFinished: boolean) => {
     setHasFinished(hasFinished)
     onHasFinishedWriting(hasFinished)
   }
 
   return <div className="Room">
-    { !isWaiting && <div className="Room__notes">
+    { isCheckingIn && room.checkIns && <CheckIn
+      results={room.checkIns}
+      participantCount={room.participants.length}
+      participantNames={nameById}
+      userId={userId}
+      isHost={isHost}
+      onCheckIn={onCheckIn}
+      onReveal={onCheckInsReveal}
+    /> }
+
+    { isReviewingActionItems && <ul className="Room__action-items">
+      { room.actionItems.filter(a => a.carriedOver).map(a =>
+        <li key={a.id}>
+          <label>
+            <input type="checkbox" checked={a.done} onChange={(e) => onActionItemSave(a.id, a.text, e.target.checked)}/>
+            { a.text }
+          </label>
+        </li>
+      ) }
+    </ul> }
+
+    { !isWaiting && !isReviewingActionItems && !isCheckingIn && <div className="Room__notes">
       { [t.Mood.POSITIVE, t.Mood.NEGATIVE, t.Mood.CONFUSED].map((mood, index) =>
         <Column
           key={mood}
@@ -52,7 +85,10 @@ export default function({room, userId, link, onNoteSave, onStateTransition, onHa
           editable={isRunning && (isHost || !hasFinished)}
           participants={nameById}
           notes={ notesByMood[mood] }
+          votes={votesByNote}
           onNoteSave={ (text, id) => onNoteSave(mood, text, id) }
+          onNoteGroup={ isGrouping ? onNoteGroup : undefined }
+          onNoteVote={ isVoting ? onNoteVote : undefined }
           data-test-id={ "room-column-" + t.Mood[mood].toLowerCase() }
           tabIndex={index + 1}
         />
@@ -66,12 +102,12 @@ export default function({room, userId, link, onNoteSave, onStateTransition, onHa
       </div>
 
       <div className="Room__info-bottom">
-        { isReviewing && <button onClick={() => handleExport(room.notes, nameById)}>Export</button> }
+        { isReviewing && <button onClick={() => handleExport(room.notes, nameById, room.checkIns?.summary)}>Export</button> }
         <Participants participants={participantById} participantNames={nameById} hostId={room.hostId} userId={userId} onNameUpdate={onNameUpdate}/>
       </div>
 
       <div className="Room__info-footer">
-        { isHost && <StatusHost state={room.state} onStateTransition={onStateTransition}/> }
+        { isHost && <StatusHost state={room.state} agenda={room.agenda} onNextPhase={onNextPhase} onPreviousPhase={onPreviousPhase}/> }
       </div>
     </div>
   </div>
@@ -99,7 +135,7 @@ function idToName(participants: t.Participant[]): Map<string, string> {
       ids = []
       nameToIDs.set(p.name, ids)
     }
-    ids.push(p.clientId)
+    ids.push(p.participantId)
   })
 
   const res = new Map()
@@ -118,11 +154,11 @@ function idToName(participants: t.Participant[]): Map<string, string> {
 
 // Export
 
-function handleExport(notes: t.Note[], participants: Map<string, string>) {
+function handleExport(notes: t.Note[], participants: Map<string, string>, checkIns?: t.CheckInSummary) {
   const now = new Date()
   triggerDownload(
     exportFileName(now),
-    JSON.stringify(buildExportData(notes, participants, now), null, 2)
+    JSON.stringify(buildExportData(notes, participants, now, checkIns), null, 2)
   )
 }
 
@@ -146,7 +182,7 @@ function exportFileName(date: Date): string {
   return `${formattedDate}-retrospective.json`
 }
 
-function buildExportData(notes: t.Note[], participants: Map<string, string>, date: Date): any {
+function buildExportData(notes: t.Note[], participants: Map<string, string>, date: Date, checkIns?: t.CheckInSummary): any {
   const resNotes: any[] = []
 
   notes.forEach(n => {
@@ -160,5 +196,6 @@ function buildExportData(notes: t.Note[], participants: Map<string, string>, dat
   return {
     date: date.toISOString(),
     notes: resNotes,
+    checkIns: checkIns,
   }
 }
@@ -8,26 +8,55 @@ const stateDescription = {
   [t.RoomState.WAITING_FOR_PARTICIPANTS]: "Press start when everyone is ready.",
   [t.RoomState.RUNNING]: "Give participants time to write notes.",
   [t.RoomState.REVIEWING]: null,
+  [t.RoomState.REVIEWING_ACTION_ITEMS]: "Check what was done since the last retro.",
+  [t.RoomState.CHECKING_IN]: "Let everyone tell how they feel.",
+  [t.RoomState.GROUPING]: "Find the notes that talk about the same thing.",
+  [t.RoomState.VOTING]: "Pick the topics to discuss.",
+  [t.RoomState.DISCUSSING]: "Go through the notes together.",
+  [t.RoomState.CLOSING]: "Thank everyone for their time!",
 }
 
-const nextButton = {
-  [t.RoomState.WAITING_FOR_PARTICIPANTS]: {text: "Start!", testId: "room-start"},
-  [t.RoomState.RUNNING]: {text: "Close & Review", testId: "room-close"},
-  [t.RoomState.REVIEWING]: null,
+// Label of the button moving to a given phase
+const nextButtonText = {
+  [t.RoomState.WAITING_FOR_PARTICIPANTS]: "",
+  [t.RoomState.RUNNING]: "Start writing",
+  [t.RoomState.REVIEWING]: "Close & Review",
+  [t.RoomState.REVIEWING_ACTION_ITEMS]: "Review action items",
+  [t.RoomState.CHECKING_IN]: "Check in",
+  [t.RoomState.GROUPING]: "Group notes",
+  [t.RoomState.VOTING]: "Vote",
+  [t.RoomState.DISCUSSING]: "Discuss",
+  [t.RoomState.CLOSING]: "Wrap up",
+}
+
+function nextButton(state: t.RoomState, next: t.RoomState) {
+  switch (state) {
+    case t.RoomState.WAITING_FOR_PARTICIPANTS:
+      return {text: "Start!", testId: "room-start"}
+    case t.RoomState.RUNNING:
+      return {text: nextButtonText[next], testId: "room-close"}
+    default:
+      return {text: nextButtonText[next], testId: "room-next-phase"}
+  }
 }
 
 interface Props {
   state: t.RoomState
-  onStateTransition: () => void;
+  agenda: t.RoomState[]
+  onNextPhase: () => void;
+  onPreviousPhase: () => void;
 }
-export default function({state, onStateTransition}: Props) {
-  const btn = nextButton[state]
+export default function({state, agenda, onNextPhase, onPreviousPhase}: Props) {
+  const index = agenda.indexOf(state)
+  const next = agenda[index + 1]
+  const btn = next !== undefined ? nextButton(state, next) : null
   const descr = stateDescription[state]
 
-  if (!descr && !btn) return null
+  if (!descr && !btn && index <= 0) return null
   return <div className="StatusHost">
     <h2>Host Controls</h2>
-    { btn && <button className="Room__info-block" onClick={onStateTransition} data-test-id={btn.testId}>{ btn.text }</button> }
+    { btn && <button className="Room__info-block" onClick={onNextPhase} data-test-id={btn.testId}>{ btn.text }</button> }
+    { index > 0 && <button className="Room__info-block" onClick={onPreviousPhase} data-test-id="room-previous-phase">Back</button> }
     { descr && <div className="Room__status">{ descr }</div> }
   </div>
 }
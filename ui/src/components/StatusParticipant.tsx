@@ -16,6 +16,18 @@ function stateDescription(state: t.RoomState, hasFinished: boolean) {
       }
     case t.RoomState.REVIEWING:
       return "Review & Action Points"
+    case t.RoomState.REVIEWING_ACTION_ITEMS:
+      return "Did we do what we said last time?"
+    case t.RoomState.CHECKING_IN:
+      return "How do you feel today?"
+    case t.RoomState.GROUPING:
+      return "Grouping notes"
+    case t.RoomState.VOTING:
+      return "Voting"
+    case t.RoomState.DISCUSSING:
+      return "Discussion"
+    case t.RoomState.CLOSING:
+      return "That's all folks!"
   }
 }
 
@@ -1,15 +1,27 @@
 import * as u from './utils'
+import { issueCredentials, storedCredentials } from './credentials'
 
 export type Message = {name: string} & Record<string, any>
 
+// Newest version of the protocol spoken with the server. The server may
+// negotiate an older one, see protocolVersion.
+const PROTOCOL_VERSION = 2
+
+// Events are received over an event stream, or by long polling when a proxy
+// buffers event streams. The transport that works is remembered.
+type Transport = 'sse' | 'poll'
+const TRANSPORT_LS_KEY = "transport"
+
 // A connection is either open (when `start` has successfully ran) or close (no `start` or session has been Lost).
 // When open, a Session exists.
 // When open, it allows sending commands with dataCommand.
 // When open, it also maintains an SSE connection which receives messages from the backend. This connection can be lagging, meaning it's not certain anymore that messages are received.
 export class Connection {
-  public clientId: string
+  public clientId?: string
+  // Protocol version negotiated with the server
+  public protocolVersion?: number
 
-  private secret: string
+  private secret?: string
   private baseUrl: string
 
   private sseConn?: EventSource
@@ -17,20 +29,33 @@ export class Connection {
   private sseMonitor?: NodeJS.Timeout
   private sseLagging?: boolean
   private sseUrl?: string
+  private sseLaunchedAt?: number
+  private sseReceived?: boolean // whether the current event stream delivered anything
+
+  private transport: Transport = localStorage.getItem(TRANSPORT_LS_KEY) === 'poll' ? 'poll' : 'sse'
+  private pollGeneration = 0 // incremented to stop the current polling loop
 
   private commandsChain?: Promise<any>
   private startServingCommands?: (value?: unknown) => void
 
+  // Data commands carry an idempotency key, so that the server ignores the
+  // ones it already received when they are retried. The prefix keeps the keys
+  // of the tabs sharing the same client ID apart.
+  private commandKeyPrefix = Math.random().toString(36).slice(2)
+  private commandCount = 0
+  // Commands sent while the event stream is lagging, replayed in a single
+  // batch once it is back. They stay buffered until the server accepted them,
+  // even across a restart of the session.
+  private bufferedCommands: BufferedCommand[] = []
+
   private lostSession?: boolean
 
   private messageListeners: MessageCallback[] = [];
   private laggingListeners: LaggingCallback[] = [];
   private lostListeners: LostCallback[] = [];
 
-  constructor(baseUrl: string, clientId: string, secret: string) {
+  constructor(baseUrl: string) {
     this.baseUrl = baseUrl;
-    this.clientId = clientId;
-    this.secret = secret;
   }
 
   public onMessage(callback: MessageCallback) { this.messageListeners.push(callback) }
@@ -41,11 +66,14 @@ export class Connection {
     this.lostSession = false
     this.sseLagging = false
     this.resetCommandsQueue()
+    // Replayed before the commands sent once the new session is up
+    this.flushBufferedCommands()
     // Start monitoring here already, as we expect it in fact from there on.
     this.ensureSSEMonitored()
 
     return this.createSession().then((helloResponse) => {
       this.startServingCommands!() // Could also be in launchSSE
+      this.protocolVersion = helloResponse.protocolVersion || 0
       this.sseUrl = helloResponse.eventsUrl
       this.launchSSE()
     })
@@ -56,12 +84,51 @@ export class Connection {
   }
 
   public async dataCommand<T>(payload: unknown): Promise<T> {
+    const key = `${this.commandKeyPrefix}-${++this.commandCount}`
+
+    if (this.sseLagging) {
+      return new Promise<T>((resolve) => this.bufferedCommands.push({key, payload, resolve}))
+    }
+
+    return this.chainCommand<T>(() =>
+      this.rawCommand<T>({name: 'data', clientId: this.clientId, secret: this.secret, key, payload})
+    )
+  }
+
+  // Replays the commands buffered while the event stream was lagging. Only
+  // the commands the server rejected are retried, and the server skips the
+  // ones it already has.
+  private flushBufferedCommands(): void {
+    if (this.bufferedCommands.length === 0) return
+
+    this.chainCommand<void>(() => u.withRetry(async () => {
+      const commands = this.bufferedCommands
+      if (commands.length === 0) return
+
+      const res = await this.rawCommand<BatchResponse>({
+        name: 'batch',
+        clientId: this.clientId,
+        secret: this.secret,
+        commands: commands.map(({key, payload}) => ({key, payload})),
+      })
+
+      res.results.forEach((r, i) => { if (!r.error) commands[i].resolve(r) })
+
+      // commands buffered while the batch was sent come after it
+      const rejected = commands.filter((_, i) => res.results[i].error)
+      this.bufferedCommands = rejected.concat(this.bufferedCommands.slice(commands.length))
+      if (rejected.length > 0) throw new RetriableError()
+    }, {only: [RetriableError]}))
+  }
+
+  private chainCommand<T>(send: () => Promise<T>): Promise<T> {
     this.commandsChain = this.commandsChain!.catch(() => {})
       .then(() => {
         if (this.lostSession) return u.makeUnresolvablePromise<T>()
-        return this.rawCommand<T>({name: 'data', clientId: this.clientId, secret: this.secret, payload: payload})
+        return send()
       }).catch((err) => {
-        if (err instanceof UnknownClientError) return u.makeUnresolvablePromise<T>()
+        if (err instanceof InvalidCredentialsError) this.handleLostSession()
+        if (err instanceof UnknownClientError || err instanceof InvalidCredentialsError) return u.makeUnresolvablePromise<T>()
         throw err
       })
     return this.commandsChain
@@ -74,7 +141,21 @@ export class Connection {
   }
 
   private async createSession(): Promise<HelloResponse> {
-    return this.rawCommand<HelloResponse>({name: 'hello', clientId: this.clientId, secret: this.secret})
+    const credentials = storedCredentials() || await issueCredentials(this.baseUrl)
+    this.clientId = credentials.clientId
+    this.secret = credentials.secret
+
+    return this.rawCommand<HelloResponse>({name: 'hello', clientId: this.clientId, secret: this.secret, protocolVersion: PROTOCOL_VERSION, transport: this.transport})
+      .catch(async (err) => {
+        if (!(err instanceof InvalidCredentialsError)) throw err
+
+        // the credentials were revoked, or signed with another server key
+        const credentials = await issueCredentials(this.baseUrl)
+        this.clientId = credentials.clientId
+        this.secret = credentials.secret
+
+        return this.rawCommand<HelloResponse>({name: 'hello', clientId: this.clientId, secret: this.secret, protocolVersion: PROTOCOL_VERSION, transport: this.transport})
+      })
   }
 
   // TODO: Temporary work-around, see Issues.
@@ -99,6 +180,13 @@ export class Connection {
   }
 
   private launchSSE(): void {
+    if (this.transport === 'poll') {
+      this.launchPolling()
+      return
+    }
+
+    this.sseLaunchedAt = Date.now()
+    this.sseReceived = false
     this.sseConn = new EventSource(this.sseUrl!);
 
     this.sseConn.onopen = () => {
@@ -114,30 +202,84 @@ export class Connection {
     }
 
     this.sseConn.onmessage = (evt) => {
-      const parsed = JSON.parse(evt.data);
+      this.sseReceived = true
+      this.handleEvent(JSON.parse(evt.data))
+    }
+  }
+
+  // Each poll returns the events queued since the previous one, or waits for
+  // the next event, and the URL of the next poll.
+  private launchPolling(): void {
+    const generation = ++this.pollGeneration
+
+    const poll = async (url: string): Promise<void> => {
+      if (generation !== this.pollGeneration || this.lostSession) return
 
-      // Update keep-alive
-      if (parsed.event === 'keep-alive') {
-        this.sseLastKeepAliveAt = Date.now()
+      this.sseLastKeepAliveAt = Date.now()
+      const res = await fetch(url, {mode: 'same-origin'}).catch(() => undefined)
+      if (generation !== this.pollGeneration) return
+
+      if (!res || res.status !== 200) {
+        // relaunchSSE finds out if the session was lost, and gets a fresh URL
+        await u.sleep(Connection.POLL_RETRY_MS)
+        if (generation === this.pollGeneration) this.relaunchSSE()
         return
       }
 
-      // Notify listeners
-      this.messageListeners.forEach(l => l(parsed));
+      const result: PollResponse = await res.json()
+      this.sseLastKeepAliveAt = Date.now()
+      result.events.forEach((ev) => this.handleEvent(ev))
+      poll(result.nextUrl)
+    }
+
+    poll(this.sseUrl!)
+  }
+
+  private handleEvent(parsed: any): void {
+    // Update keep-alive
+    if (parsed.event === 'keep-alive') {
+      this.sseLastKeepAliveAt = Date.now()
+      return
     }
+
+    // Notify listeners
+    this.messageListeners.forEach(l => l(parsed));
   }
 
+  // Proxies buffering event streams deliver nothing until the stream closes.
+  private fallBackToPolling(): void {
+    this.transport = 'poll'
+    localStorage.setItem(TRANSPORT_LS_KEY, this.transport)
+    this.relaunchSSE()
+  }
+
+  // Events URLs carry a short-lived token, so a fresh one must be requested
+  // before reopening the stream.
   private relaunchSSE(): void {
     this.sseConn?.close()
-    this.resumeSession().then(() => this.launchSSE)
+    this.sseConn = undefined
+    this.resumeSession()
+      .then(() => this.rawCommand<HelloResponse>({name: 'events-url', clientId: this.clientId, secret: this.secret, transport: this.transport}))
+      .then((response) => {
+        this.sseUrl = response.eventsUrl
+        this.launchSSE()
+      })
+      .catch(() => {}) // lost sessions are reported by rawCommand
   }
 
   private sseMonitoring(): void {
+    if (this.sseConn && !this.sseReceived && Date.now() - this.sseLaunchedAt! > Connection.SSE_FALLBACK_MS) {
+      this.fallBackToPolling()
+    }
+
+    // polls only return when there are events, or once they time out
+    const expectedInterval = this.transport === 'poll' ? Connection.POLL_EXPECTED_INTERVAL_MS : Connection.KEEPALIVE_EXPECTED_INTERVAL_MS
     const sinceLastAlive = (Date.now() - this.sseLastKeepAliveAt!)
-    const laggingNow = (sinceLastAlive > Connection.KEEPALIVE_EXPECTED_INTERVAL_MS)
+    const laggingNow = (sinceLastAlive > expectedInterval)
     if (this.sseLagging !== laggingNow) {
       this.sseLagging = laggingNow
       this.laggingListeners.forEach(l => l(laggingNow));
+      if (!laggingNow) this.flushBufferedCommands()
     }
   }
 
@@ -159,6 +301,8 @@ export class Connection {
       if (body === Connection.UNKNOWN_CLIENT_REQUEST_BODY) {
         this.handleLostSession()
         throw new UnknownClientError()
+      } else if (body === Connection.INVALID_CLIENT_SECRET_REQUEST_BODY) {
+        throw new InvalidCredentialsError()
       } else if (res.status >= 500) {
         throw new RetriableError()
       } else {
@@ -171,7 +315,12 @@ export class Connection {
   private static readonly MONITORING_INTERVAL_MS = 1000;
   private static readonly KEEPALIVE_BE_MS = 3000
   private static readonly KEEPALIVE_EXPECTED_INTERVAL_MS = Connection.KEEPALIVE_BE_MS + 1000
+  private static readonly SSE_FALLBACK_MS = 10000
+  private static readonly POLL_TIMEOUT_BE_MS = 20000
+  private static readonly POLL_EXPECTED_INTERVAL_MS = Connection.POLL_TIMEOUT_BE_MS + 5000
+  private static readonly POLL_RETRY_MS = 1000
   private static readonly UNKNOWN_CLIENT_REQUEST_BODY = "Unknown client\n"
+  private static readonly INVALID_CLIENT_SECRET_REQUEST_BODY = "Invalid client secret\n"
 }
 
 type LaggingCallback = (connected: boolean) => void;
@@ -180,6 +329,22 @@ type LostCallback = () => void;
 
 interface HelloResponse {
   eventsUrl: string;
+  protocolVersion?: number; // missing for servers that predate protocol versions
+}
+
+interface PollResponse {
+  events: Message[];
+  nextUrl: string;
+}
+
+interface BufferedCommand {
+  key: string;
+  payload: unknown;
+  resolve: (result: any) => void;
+}
+
+interface BatchResponse {
+  results: {key: string, seq: number, duplicate?: boolean, error?: string}[];
 }
 
 class UnknownClientError extends Error {
@@ -188,6 +353,12 @@ class UnknownClientError extends Error {
     this.name = "UnknownClientError";
   }
 }
+class InvalidCredentialsError extends Error {
+  constructor() {
+    super();
+    this.name = "InvalidCredentialsError";
+  }
+}
 class UnexpectedCommandError extends Error {
   constructor(message: string) {
     super(message);
@@ -1,18 +1,39 @@
-import { trimBase64Padding } from './utils';
+import { trimBase64Padding } from './utils';
 
-const CLIENT_ID_LEN = 16;
-const SECRET_LEN = 64;
+const CREDENTIALS_LS_KEY = "credentials"
+// Credentials stored by the versions of the UI that generated their own
+const LEGACY_CLIENT_ID_LS_KEY = "clientId"
+const LEGACY_SECRET_LS_KEY = "secret"
 
-export function generateClientId(): string {
-  return randomID(CLIENT_ID_LEN)
+export interface Credentials {
+  clientId: string;
+  secret: string;
+  expiresAt: string;
 }
 
-export function generateSecret(): string {
-  return randomID(SECRET_LEN)
+// Returns the credentials stored in the local storage, unless they expired.
+export function storedCredentials(): Credentials | null {
+  localStorage.removeItem(LEGACY_CLIENT_ID_LS_KEY)
+  localStorage.removeItem(LEGACY_SECRET_LS_KEY)
+
+  const stored = localStorage.getItem(CREDENTIALS_LS_KEY)
+  if (stored === null) return null
+
+  const credentials: Credentials = JSON.parse(stored)
+  if (new Date(credentials.expiresAt).getTime() < Date.now()) return null
+
+  return credentials
 }
 
-function randomID(length: number) {
-  const data = new Uint8Array(length);
-  window.crypto.getRandomValues(data);
-  return trimBase64Padding(btoa(String.fromCharCode.apply(null, data as unknown as number[])).replace(/\+/g, '-').replace(/\//g, '_'));
+// Gets new credentials from the server, and stores them in the local storage.
+export async function issueCredentials(baseUrl: string): Promise<Credentials> {
+  const res = await fetch(`${baseUrl}/credentials`, {method: 'POST', mode: 'same-origin'})
+  if (res.status !== 200) throw new Error(`error getting credentials: ${res.status}`)
+
+  const credentials: Credentials = await res.json()
+  credentials.clientId = trimBase64Padding(credentials.clientId)
+  credentials.secret = trimBase64Padding(credentials.secret)
+  localStorage.setItem(CREDENTIALS_LS_KEY, JSON.stringify(credentials))
+
+  return credentials
 }
@@ -41,12 +41,12 @@ export default function(state: types.State, action: types.Action): types.State {
         ...state,
         room: {
           ...state.room!,
-          participants: state.room!.participants.filter((p) => p.clientId !== action.payload.clientId),
+          participants: state.room!.participants.filter((p) => p.participantId !== action.payload.participantId),
         }
       }
     case 'roomParticipantUpdated':
       const updatedParticipants = [...state.room!.participants]
-      const updatedIndex = updatedParticipants.findIndex((p) => p.clientId === action.payload.clientId)
+      const updatedIndex = updatedParticipants.findIndex((p) => p.participantId === action.payload.participantId)
       updatedParticipants[updatedIndex] = action.payload
       return {
         ...state,
@@ -85,6 +85,40 @@ export default function(state: types.State, action: types.Action): types.State {
           notes: notes,
         }
       }
+    case 'noteSaved':
+      const saved = action.payload
+      const savedNotes = state.room!.notes.map((n) => n.id === saved.id && n.authorId === saved.authorId ? saved : n)
+      if (!savedNotes.includes(saved)) {
+        // created from another tab
+        savedNotes.push(saved)
+      }
+      return {
+        ...state,
+        room: {
+          ...state.room!,
+          notes: savedNotes,
+        }
+      }
+    case 'actionItemSaved':
+      const actionItems = state.room!.actionItems.filter((a) => a.id !== action.payload.id)
+      actionItems.push(action.payload)
+      actionItems.sort((a, b) => a.id - b.id)
+      return {
+        ...state,
+        room: {
+          ...state.room!,
+          actionItems: actionItems,
+        }
+      }
+    case 'checkInsUpdated':
+      return {...state, room: {...state.room!, checkIns: action.payload}}
+    case 'voteSaved':
+      const vote = action.payload
+      const votes = (state.room!.votes || []).filter((v) => v.authorId !== vote.authorId || v.noteId !== vote.noteId)
+      if (vote.count > 0) {
+        votes.push(vote)
+      }
+      return {...state, room: {...state.room!, votes: votes}}
     default:
       throw new Error(`Unknown action ${action}`);
   }
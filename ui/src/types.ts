@@ -1,5 +1,5 @@
 export interface Participant {
-  clientId: string;
+  participantId: string;
   name: string;
   finishedWriting?: boolean;
 };
@@ -7,14 +7,53 @@ export interface Participant {
 export enum RoomState {
   WAITING_FOR_PARTICIPANTS = 1,
   RUNNING = 2,
-  REVIEWING = 3
+  REVIEWING = 3,
+  REVIEWING_ACTION_ITEMS = 4, // before RUNNING, when action items were carried over
+  CHECKING_IN = 5, // first step, when the room was created with a check-in
+  GROUPING = 6,
+  VOTING = 7,
+  DISCUSSING = 8,
+  CLOSING = 9,
 }
 
 export interface Room {
   state: RoomState;
+  agenda: RoomState[]; // phases of the room, in order
   participants: Participant[];
   notes: Note[];
   hostId: string;
+  selfId: string; // participant ID of the current user
+  teamId?: string;
+  actionItems: ActionItem[];
+  checkIns?: CheckInResults; // only for rooms with a check-in
+  votes?: NoteVotes[]; // only our own until the vote is over
+  version: number; // version of the room when it was sent
+}
+
+export interface CheckIn {
+  score?: number; // 1 to 5
+  word?: string;
+}
+
+export interface CheckInResults {
+  revealed: boolean;
+  answered: string[]; // participant IDs
+  checkIns: {[participantId: string]: CheckIn}; // only our own until revealed
+  summary?: CheckInSummary;
+}
+
+export interface CheckInSummary {
+  count: number;
+  averageScore?: number;
+  scoreCounts: {[score: string]: number};
+  words: string[];
+}
+
+export interface ActionItem {
+  id: number;
+  text: string;
+  done: boolean;
+  carriedOver?: boolean;
 }
 
 export enum Mood {
@@ -26,8 +65,16 @@ export enum Mood {
 export interface Note {
   authorId: string;
   id: number;
+  revision: number; // 0 until the note is saved by the server
   text: string;
   mood: Mood;
+  group?: number; // set during the group phase
+}
+
+export interface NoteVotes {
+  authorId: string;
+  noteId: number;
+  count: number;
 }
 
 export interface State {
@@ -76,7 +123,7 @@ export type Action = {
   payload: Participant;
 } | {
   type: 'hostChange';
-  payload: string; // host clientId
+  payload: string; // host participant ID
 } | {
   type: 'roomStateChanged';
   payload: RoomState;
@@ -86,6 +133,18 @@ export type Action = {
 } | {
   type: 'noteUpdated';
   payload: {noteId: number, text: string}
+} | {
+  type: 'noteSaved';
+  payload: Note; // the note as saved by the server
+} | {
+  type: 'actionItemSaved';
+  payload: ActionItem;
+} | {
+  type: 'checkInsUpdated';
+  payload: CheckInResults;
+} | {
+  type: 'voteSaved';
+  payload: NoteVotes; // our own vote
 }
 
 export enum Chars {
@@ -93,6 +152,8 @@ export enum Chars {
   VALIDATE = '✓',
   CANCEL =   '✕',
   DELETE =   '␡',
+  VOTED =    '★',
+  NOT_VOTED = '☆',
 }
 
 // …